@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Methods a principal can be authenticated with
+const (
+	AuthMethodAPIKey = "api_key"
+	AuthMethodJWT    = "jwt"
+)
+
+const apiKeyHeader = "X-API-Key"
+
+// Principal is the authenticated caller of a request
+type Principal struct {
+	// ID is the name of the API key or the subject of the token
+	ID     string
+	Method string
+	// OrganisationID restricts the principal to the payments of the
+	// organisation. Principals without organisation access every
+	// organisation.
+	OrganisationID string
+	// Roles are the roles claimed by the token of the principal
+	Roles []string
+}
+
+// contextPrincipal returns the authenticated principal of the context, or
+// nil when authentication is disabled
+func contextPrincipal(ctx context.Context) *Principal {
+	principal, _ := ctx.Value(ContextPrincipal).(*Principal)
+	return principal
+}
+
+var errUnauthenticated = errors.New("unauthenticated")
+
+// jwtClaims are the supported claims of bearer tokens
+type jwtClaims struct {
+	Subject        string   `json:"sub"`
+	ExpiresAt      *int64   `json:"exp"`
+	NotBefore      *int64   `json:"nbf"`
+	OrganisationID string   `json:"organisation_id"`
+	Roles          []string `json:"roles"`
+}
+
+// verifyJWT verifies a HS256 signed token and returns its claims. Tokens
+// must have a subject, an organisation and an expiry.
+func verifyJWT(secret string, token string, at time.Time) (*jwtClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errUnauthenticated
+	}
+	decode := func(part string, v interface{}) error {
+		raw, err := base64.RawURLEncoding.DecodeString(part)
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(raw, v)
+	}
+	var header struct {
+		Algorithm string `json:"alg"`
+	}
+	if err := decode(parts[0], &header); err != nil || header.Algorithm != "HS256" {
+		return nil, errUnauthenticated
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errUnauthenticated
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	_, _ = mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return nil, errUnauthenticated
+	}
+	claims := jwtClaims{}
+	if err = decode(parts[1], &claims); err != nil {
+		return nil, errUnauthenticated
+	}
+	if claims.Subject == "" || claims.OrganisationID == "" || claims.ExpiresAt == nil || at.Unix() >= *claims.ExpiresAt ||
+		(claims.NotBefore != nil && at.Unix() < *claims.NotBefore) {
+		return nil, errUnauthenticated
+	}
+	return &claims, nil
+}
+
+// authenticateRequest returns the principal of the API key or bearer token
+// of the request
+func authenticateRequest(config *Config, r *http.Request) (*Principal, error) {
+	if key := r.Header.Get(apiKeyHeader); key != "" {
+		for name, k := range config.APIKeys {
+			if subtle.ConstantTimeCompare([]byte(key), []byte(k.Key)) == 1 {
+				return &Principal{ID: name, Method: AuthMethodAPIKey, OrganisationID: k.OrganisationID}, nil
+			}
+		}
+		return nil, errUnauthenticated
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == r.Header.Get("Authorization") || config.JWTSecret == "" {
+		return nil, errUnauthenticated
+	}
+	claims, err := verifyJWT(config.JWTSecret, token, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	return &Principal{ID: claims.Subject, Method: AuthMethodJWT, OrganisationID: claims.OrganisationID,
+		Roles: claims.Roles}, nil
+}
+
+// authenticate rejects requests without a valid API key or bearer token and
+// stores the principal of the request in the context
+func authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		conf := ctx.Value(ContextConfig).(*Config)
+		if conf.AuthDisabled {
+			next.ServeHTTP(w, r)
+			return
+		}
+		principal, err := authenticateRequest(conf, r)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="form3"`)
+			renderError(w, r, http.StatusUnauthorized)
+			return
+		}
+		setLogField(ctx, "principal", principal.ID)
+		if principal.OrganisationID != "" {
+			setLogField(ctx, "organisation_id", principal.OrganisationID)
+		}
+		ctx = context.WithValue(ctx, ContextPrincipal, principal)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
@@ -0,0 +1,103 @@
+package main_test
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	. "./"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// signJWT creates a token signed with the algorithm, HS256 tokens with the
+// secret
+func signJWT(algorithm string, secret string, claims map[string]interface{}) string {
+	encode := func(v interface{}) string {
+		raw, _ := json.Marshal(v)
+		return base64.RawURLEncoding.EncodeToString(raw)
+	}
+	unsigned := encode(map[string]string{"alg": algorithm, "typ": "JWT"}) + "." + encode(claims)
+	mac := hmac.New(sha256.New, []byte(secret))
+	_, _ = mac.Write([]byte(unsigned))
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+var _ = Describe("Authentication", func() {
+	config := testConfig
+	config.AuthDisabled = false
+	config.APIKeys = map[string]APIKey{"ledger": {Key: "ledger-key"}}
+	config.JWTSecret = "jwt-secret"
+	config.Policy = &Policy{
+		Roles:      map[string][]string{"operator": {ActionPaymentsCreate}},
+		Principals: map[string][]string{"ledger": {"operator"}, "alice": {"operator"}},
+	}
+	memDb := NewMemoryDb()
+	ctx := context.WithValue(context.WithValue(testCtx, ContextConfig, &config), ContextDb, memDb)
+
+	request := func(headers map[string]string) *http.Response {
+		return performRequestHeaders(ctx, "POST", "/v1/payments", strings.NewReader(paymentRequestJSON), headers).Result()
+	}
+	bearer := func(token string) map[string]string {
+		return map[string]string{"Authorization": "Bearer " + token}
+	}
+	org := paymentSample.OrganisationID
+	valid := map[string]interface{}{"sub": "alice", "organisation_id": org, "exp": time.Now().Add(time.Hour).Unix()}
+
+	It("should reject requests without credentials", func() {
+		res := request(nil)
+		Expect(res.StatusCode).To(Equal(http.StatusUnauthorized))
+		Expect(res.Header.Get("WWW-Authenticate")).To(Equal(`Bearer realm="form3"`))
+		body, _ := ioutil.ReadAll(res.Body)
+		Expect(body).To(MatchJSON(`{"code": "unauthorized", "message": "Unauthorized"}`))
+	})
+	It("should accept API keys", func() {
+		Expect(request(map[string]string{"X-API-Key": "ledger-key"}).StatusCode).To(Equal(http.StatusCreated))
+	})
+	It("should reject unknown API keys", func() {
+		Expect(request(map[string]string{"X-API-Key": "other"}).StatusCode).To(Equal(http.StatusUnauthorized))
+	})
+	It("should accept signed bearer tokens", func() {
+		Expect(request(bearer(signJWT("HS256", "jwt-secret", valid))).StatusCode).To(Equal(http.StatusCreated))
+	})
+	It("should reject invalid bearer tokens", func() {
+		expired := map[string]interface{}{"sub": "alice", "organisation_id": org,
+			"exp": time.Now().Add(-time.Minute).Unix()}
+		early := map[string]interface{}{"sub": "alice", "organisation_id": org,
+			"exp": time.Now().Add(time.Hour).Unix(), "nbf": time.Now().Add(time.Minute).Unix()}
+		for _, token := range []string{
+			signJWT("HS256", "other-secret", valid),
+			signJWT("none", "jwt-secret", valid),
+			signJWT("HS256", "jwt-secret", expired),
+			signJWT("HS256", "jwt-secret", early),
+			signJWT("HS256", "jwt-secret", map[string]interface{}{"sub": "alice", "organisation_id": org}),
+			signJWT("HS256", "jwt-secret", map[string]interface{}{"organisation_id": org,
+				"exp": time.Now().Add(time.Hour).Unix()}),
+			signJWT("HS256", "jwt-secret", map[string]interface{}{"sub": "alice",
+				"exp": time.Now().Add(time.Hour).Unix()}),
+			"not-a-token",
+		} {
+			Expect(request(bearer(token)).StatusCode).To(Equal(http.StatusUnauthorized), token)
+		}
+	})
+	It("should record the principal as actor", func() {
+		w := performRequestHeaders(ctx, "POST", "/v1/payments", strings.NewReader(paymentRequestJSON),
+			map[string]string{"X-API-Key": "ledger-key", "X-Actor": "someone-else"})
+		var res struct {
+			ID string `json:"id"`
+		}
+		Expect(json.NewDecoder(w.Body).Decode(&res)).To(Succeed())
+		id, _ := StringToID(res.ID)
+		versions, _ := memDb.GetPaymentVersions(testCtx, *id)
+		Expect((*versions)[0].Actor).To(Equal("ledger"))
+	})
+	It("should not authenticate the root", func() {
+		Expect(performRequest(ctx, "GET", "/").Code).To(Equal(http.StatusOK))
+	})
+})
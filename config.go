@@ -1,24 +1,621 @@
 package main
 
 import (
-	"os"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Supported storage drivers
+const (
+	StorageDriverMongo    = "mongo"
+	StorageDriverPostgres = "postgres"
+	StorageDriverMemory   = "memory"
+)
+
+// Read preferences of MongoDB
+const (
+	MongoDbReadPreferencePrimary            = "primary"
+	MongoDbReadPreferencePrimaryPreferred   = "primaryPreferred"
+	MongoDbReadPreferenceSecondary          = "secondary"
+	MongoDbReadPreferenceSecondaryPreferred = "secondaryPreferred"
+	MongoDbReadPreferenceNearest            = "nearest"
+)
+
+var mongoDbReadPreferences = []string{
+	MongoDbReadPreferencePrimary,
+	MongoDbReadPreferencePrimaryPreferred,
+	MongoDbReadPreferenceSecondary,
+	MongoDbReadPreferenceSecondaryPreferred,
+	MongoDbReadPreferenceNearest,
+}
+
+// MongoDbWriteConcernMajority acknowledges writes by a majority of servers
+const MongoDbWriteConcernMajority = "majority"
+
+// Supported event publishers
+const (
+	EventPublisherNone    = "none"
+	EventPublisherFile    = "file"
+	EventPublisherWebhook = "webhook"
 )
 
 // Config Shared configuration format
 type Config struct {
 	Port            int    `json:"port"`
 	Host            string `json:"host"`
+	StorageDriver   string `json:"storage_driver"`
 	MongoDbURI      string `json:"mongo_db_uri"`
 	MongoDbDatabase string `json:"mongo_db_database"`
+	// MongoDbMaxPoolSize and MongoDbMinPoolSize bound the connections to
+	// each MongoDB server. The MongoDB settings override the options of
+	// MongoDbURI unless they are zero.
+	MongoDbMaxPoolSize int `json:"mongo_db_max_pool_size"`
+	MongoDbMinPoolSize int `json:"mongo_db_min_pool_size"`
+	// MongoDbServerSelectionTimeout is how long an operation waits for a
+	// suitable server
+	MongoDbServerSelectionTimeout time.Duration `json:"mongo_db_server_selection_timeout"`
+	// MongoDbReadPreference is the mode of the servers reads are sent to
+	MongoDbReadPreference string `json:"mongo_db_read_preference"`
+	// MongoDbWriteConcern is majority or the number of servers acknowledging
+	// writes
+	MongoDbWriteConcern string `json:"mongo_db_write_concern"`
+	// MongoDbRetryWrites is nil unless set
+	MongoDbRetryWrites *bool  `json:"mongo_db_retry_writes"`
+	PostgresURI        string `json:"postgres_uri"`
+	// DbConnectTimeout bounds connecting to the database on startup, and
+	// DbOperationTimeout every other operation of the database
+	DbConnectTimeout   time.Duration `json:"db_connect_timeout"`
+	DbOperationTimeout time.Duration `json:"db_operation_timeout"`
+	// IdempotencyKeyTTL is how long responses to requests with an
+	// Idempotency-Key header are replayed
+	IdempotencyKeyTTL time.Duration `json:"idempotency_key_ttl"`
+	// EventPublisher publishes payment events, events are kept in the outbox
+	// when none
+	EventPublisher string `json:"event_publisher"`
+	EventFile      string `json:"event_file"`
+	// EventDispatchInterval is how often the outbox is checked for events
+	EventDispatchInterval time.Duration `json:"event_dispatch_interval"`
+	// WebhookMaxAttempts is how many times a notification is sent before
+	// its delivery fails
+	WebhookMaxAttempts int `json:"webhook_max_attempts"`
+	// WebhookBackoff is the delay before the first retry, doubled for every
+	// following retry
+	WebhookBackoff time.Duration `json:"webhook_backoff"`
+	WebhookTimeout time.Duration `json:"webhook_timeout"`
+	// APIKeys maps the names of API keys to the keys
+	APIKeys map[string]APIKey `json:"api_keys"`
+	// JWTSecret verifies HS256 signed bearer tokens
+	JWTSecret string `json:"jwt_secret"`
+	// AuthDisabled allows unauthenticated requests, e.g. for local
+	// development
+	AuthDisabled bool `json:"auth_disabled"`
+	// PolicyFile is the path of the authorization policy. Without a policy
+	// every authenticated request is denied, unless auth_disabled is set.
+	PolicyFile string `json:"policy_file"`
+	// Policy is loaded from the policy file
+	Policy *Policy `json:"-"`
+	// ReadTimeout, WriteTimeout and IdleTimeout limit the connections of the
+	// server
+	ReadTimeout  time.Duration `json:"read_timeout"`
+	WriteTimeout time.Duration `json:"write_timeout"`
+	IdleTimeout  time.Duration `json:"idle_timeout"`
+	// ShutdownTimeout is how long in-flight requests are awaited on shutdown
+	ShutdownTimeout time.Duration `json:"shutdown_timeout"`
+	// TraceExporter exports the spans of requests, spans are only used for
+	// trace ids when none
+	TraceExporter string `json:"trace_exporter"`
+	// LogLevel is the least severe level logged
+	LogLevel string `json:"log_level"`
+	// ConfigFile is the file the configuration was read from, if any
+	ConfigFile string `json:"-"`
+	// ConfigReloadInterval is how often the configuration and policy files
+	// are checked for changes, never when zero
+	ConfigReloadInterval time.Duration `json:"config_reload_interval"`
+}
+
+// APIKey is a static credential, optionally restricted to the payments of an
+// organisation
+type APIKey struct {
+	Key            string `json:"key"`
+	OrganisationID string `json:"organisation_id"`
+}
+
+// parseAPIKeys parses comma separated name:key or name:organisation_id:key
+// entries
+func parseAPIKeys(s string) (map[string]APIKey, error) {
+	keys := map[string]APIKey{}
+	for _, entry := range strings.Split(s, ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		parts := strings.SplitN(strings.TrimSpace(entry), ":", 3)
+		switch {
+		case len(parts) == 2 && parts[0] != "" && parts[1] != "":
+			keys[parts[0]] = APIKey{Key: parts[1]}
+		case len(parts) == 3 && parts[0] != "" && parts[2] != "":
+			keys[parts[0]] = APIKey{Key: parts[2], OrganisationID: parts[1]}
+		default:
+			return nil, fmt.Errorf("API key %q is not name:key or name:organisation_id:key", entry)
+		}
+	}
+	return keys, nil
+}
+
+// apiKeysValue is the flag.Value of API keys, either formatted as parsed by
+// parseAPIKeys or as a JSON object of APIKey by name
+type apiKeysValue map[string]APIKey
+
+func (v *apiKeysValue) String() string {
+	if v == nil {
+		return ""
+	}
+	var entries []string
+	for name, k := range *v {
+		if k.OrganisationID == "" {
+			entries = append(entries, name+":"+k.Key)
+		} else {
+			entries = append(entries, name+":"+k.OrganisationID+":"+k.Key)
+		}
+	}
+	sort.Strings(entries)
+	return strings.Join(entries, ",")
+}
+
+func (v *apiKeysValue) Set(s string) error {
+	keys := map[string]APIKey{}
+	var err error
+	if strings.HasPrefix(strings.TrimSpace(s), "{") {
+		err = json.Unmarshal([]byte(s), &keys)
+	} else {
+		keys, err = parseAPIKeys(s)
+	}
+	if err != nil {
+		return err
+	}
+	*v = keys
+	return nil
+}
+
+func (v *apiKeysValue) Get() interface{} {
+	return map[string]APIKey(*v)
+}
+
+// optionalBoolValue is the flag.Value of a bool which is nil unless set
+type optionalBoolValue struct {
+	value **bool
+}
+
+func (v optionalBoolValue) String() string {
+	if v.value == nil || *v.value == nil {
+		return ""
+	}
+	return strconv.FormatBool(**v.value)
+}
+
+func (v optionalBoolValue) Set(s string) error {
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return err
+	}
+	*v.value = &b
+	return nil
+}
+
+func (v optionalBoolValue) Get() interface{} {
+	if *v.value == nil {
+		return nil
+	}
+	return **v.value
+}
+
+// IsBoolFlag allows setting the flag without value
+func (v optionalBoolValue) IsBoolFlag() bool {
+	return true
+}
+
+// defaultConfig returns the configuration of no settings
+func defaultConfig() *Config {
+	return &Config{
+		Port:                  8080,
+		StorageDriver:         StorageDriverMongo,
+		DbConnectTimeout:      10 * time.Second,
+		DbOperationTimeout:    10 * time.Second,
+		IdempotencyKeyTTL:     24 * time.Hour,
+		EventPublisher:        EventPublisherWebhook,
+		EventFile:             "events.jsonl",
+		EventDispatchInterval: time.Second,
+		WebhookMaxAttempts:    8,
+		WebhookBackoff:        30 * time.Second,
+		WebhookTimeout:        10 * time.Second,
+		APIKeys:               map[string]APIKey{},
+		ReadTimeout:           10 * time.Second,
+		WriteTimeout:          30 * time.Second,
+		IdleTimeout:           2 * time.Minute,
+		ShutdownTimeout:       30 * time.Second,
+		TraceExporter:         TraceExporterNone,
+		LogLevel:              LogLevelInfo,
+		ConfigReloadInterval:  10 * time.Second,
+	}
+}
+
+// configFlags returns the settings of the configuration as flags setting the
+// configuration. The key of a setting in configuration files is the name of
+// its flag with underscores, and its environment variable is the upper case
+// key, e.g. mongo-db-uri, mongo_db_uri and MONGO_DB_URI.
+func configFlags(c *Config) *flag.FlagSet {
+	fs := flag.NewFlagSet("form3", flag.ContinueOnError)
+	fs.IntVar(&c.Port, "port", c.Port, "The port of the server")
+	fs.StringVar(&c.Host, "host", c.Host, "The host name used in REST-resource links")
+	fs.StringVar(&c.StorageDriver, "storage-driver", c.StorageDriver,
+		"The storage to use, either mongo, postgres or memory")
+	fs.StringVar(&c.MongoDbURI, "mongo-db-uri", c.MongoDbURI, "The url to the MongoDB database")
+	fs.StringVar(&c.MongoDbDatabase, "mongo-db-database", c.MongoDbDatabase, "The MongoDB database to use")
+	fs.IntVar(&c.MongoDbMaxPoolSize, "mongo-db-max-pool-size", c.MongoDbMaxPoolSize,
+		"The maximum number of connections to each MongoDB server")
+	fs.IntVar(&c.MongoDbMinPoolSize, "mongo-db-min-pool-size", c.MongoDbMinPoolSize,
+		"The number of idle connections kept to each MongoDB server")
+	fs.DurationVar(&c.MongoDbServerSelectionTimeout, "mongo-db-server-selection-timeout",
+		c.MongoDbServerSelectionTimeout, "How long an operation waits for a suitable MongoDB server")
+	fs.StringVar(&c.MongoDbReadPreference, "mongo-db-read-preference", c.MongoDbReadPreference,
+		"The MongoDB servers reads are sent to, e.g. primary or secondaryPreferred")
+	fs.StringVar(&c.MongoDbWriteConcern, "mongo-db-write-concern", c.MongoDbWriteConcern,
+		"majority or the number of MongoDB servers acknowledging writes")
+	fs.Var(optionalBoolValue{&c.MongoDbRetryWrites}, "mongo-db-retry-writes",
+		"Retry writes to MongoDB once on network errors and failovers")
+	fs.StringVar(&c.PostgresURI, "postgres-uri", c.PostgresURI, "The url to the PostgreSQL database")
+	fs.DurationVar(&c.DbConnectTimeout, "db-connect-timeout", c.DbConnectTimeout,
+		"How long connecting to the database on startup may take")
+	fs.DurationVar(&c.DbOperationTimeout, "db-operation-timeout", c.DbOperationTimeout,
+		"How long a database operation may take")
+	fs.DurationVar(&c.IdempotencyKeyTTL, "idempotency-key-ttl", c.IdempotencyKeyTTL,
+		"How long responses to requests with an Idempotency-Key header are replayed")
+	fs.StringVar(&c.EventPublisher, "event-publisher", c.EventPublisher,
+		"Where payment events are published, either none, file or webhook")
+	fs.StringVar(&c.EventFile, "event-file", c.EventFile, "The file the file publisher appends events to")
+	fs.DurationVar(&c.EventDispatchInterval, "event-dispatch-interval", c.EventDispatchInterval,
+		"How often the outbox is checked for events to publish")
+	fs.IntVar(&c.WebhookMaxAttempts, "webhook-max-attempts", c.WebhookMaxAttempts,
+		"How many times a webhook notification is sent before its delivery fails")
+	fs.DurationVar(&c.WebhookBackoff, "webhook-backoff", c.WebhookBackoff,
+		"The delay before retrying a failed notification, doubled for every retry")
+	fs.DurationVar(&c.WebhookTimeout, "webhook-timeout", c.WebhookTimeout, "How long to wait for a subscriber to respond")
+	fs.Var((*apiKeysValue)(&c.APIKeys), "api-keys",
+		"Comma separated API keys as name:key or name:organisation_id:key")
+	fs.StringVar(&c.JWTSecret, "jwt-secret", c.JWTSecret, "The secret verifying HS256 signed bearer tokens")
+	fs.BoolVar(&c.AuthDisabled, "auth-disabled", c.AuthDisabled, "Allow unauthenticated requests")
+	fs.StringVar(&c.PolicyFile, "policy-file", c.PolicyFile, "The JSON policy granting actions to roles")
+	fs.DurationVar(&c.ReadTimeout, "read-timeout", c.ReadTimeout, "How long the server waits for a request to be read")
+	fs.DurationVar(&c.WriteTimeout, "write-timeout", c.WriteTimeout,
+		"How long the server waits for a response to be written")
+	fs.DurationVar(&c.IdleTimeout, "idle-timeout", c.IdleTimeout, "How long idle keep-alive connections are kept open")
+	fs.DurationVar(&c.ShutdownTimeout, "shutdown-timeout", c.ShutdownTimeout,
+		"How long in-flight requests are awaited on shutdown")
+	fs.StringVar(&c.TraceExporter, "trace-exporter", c.TraceExporter, "Where spans are exported, either none or stdout")
+	fs.StringVar(&c.LogLevel, "log-level", c.LogLevel, "The minimum level of logged entries")
+	fs.DurationVar(&c.ConfigReloadInterval, "config-reload-interval", c.ConfigReloadInterval,
+		"How often the configuration and policy files are checked for changes, never when 0")
+	return fs
+}
+
+// settingKey returns the key of the setting of the flag in configuration
+// files
+func settingKey(flagName string) string {
+	return strings.Replace(flagName, "-", "_", -1)
+}
+
+// settingEnv returns the environment variable of the setting of the flag
+func settingEnv(flagName string) string {
+	return strings.ToUpper(settingKey(flagName))
 }
 
-// ReadConfigFromEnv Open a configuration at the given path.
-func ReadConfigFromEnv() *Config {
-	var c = Config{
-		Port:            SafeStringToInt(os.Getenv("PORT"), 8080),
-		Host:            os.Getenv("HOST"),
-		MongoDbDatabase: os.Getenv("MONGO_DB_DATABASE"),
-		MongoDbURI:      os.Getenv("MONGO_DB_URI"),
+// LoadConfig reads the configuration from, in increasing precedence, the
+// defaults, a configuration file, the environment and the command line
+// arguments. Besides the settings the arguments accept -config, the path of
+// the configuration file which defaults to the CONFIG_FILE environment
+// variable, and -print-config which is returned as printConfig. Empty
+// environment variables are ignored. The configuration is not validated, see
+// Validate.
+func LoadConfig(args []string, lookupEnv func(string) (string, bool)) (c *Config, printConfig bool, err error) {
+	c = defaultConfig()
+	settings := configFlags(c)
+	// The arguments are parsed first to find the configuration file, and
+	// applied last
+	cli := configFlags(defaultConfig())
+	configFile := cli.String("config", "", "The path of a JSON or YAML configuration file")
+	cli.BoolVar(&printConfig, "print-config", false,
+		"Print the effective configuration, with secrets redacted, and exit")
+	cli.VisitAll(func(f *flag.Flag) {
+		f.Value = &rawFlagValue{Value: f.Value}
+	})
+	if err = cli.Parse(args); err != nil {
+		return nil, false, err
 	}
-	return &c
+	if cli.NArg() > 0 {
+		return nil, false, fmt.Errorf("unexpected argument %q", cli.Arg(0))
+	}
+	path := *configFile
+	if path == "" {
+		path, _ = lookupEnv("CONFIG_FILE")
+	}
+	if path != "" {
+		if err = readConfigFile(settings, path); err != nil {
+			return nil, false, fmt.Errorf("failed to read configuration file %s: %v", path, err)
+		}
+		c.ConfigFile = path
+	}
+	settings.VisitAll(func(f *flag.Flag) {
+		env := settingEnv(f.Name)
+		if v, ok := lookupEnv(env); ok && v != "" && err == nil {
+			if serr := settings.Set(f.Name, v); serr != nil {
+				err = fmt.Errorf("invalid %s %q: %v", env, v, serr)
+			}
+		}
+	})
+	cli.Visit(func(f *flag.Flag) {
+		if settings.Lookup(f.Name) == nil {
+			return
+		}
+		for _, v := range f.Value.(*rawFlagValue).raw {
+			if serr := settings.Set(f.Name, v); serr != nil && err == nil {
+				err = fmt.Errorf("invalid -%s: %v", f.Name, serr)
+			}
+		}
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return c, printConfig, nil
+}
+
+// rawFlagValue is a flag.Value recording the arguments it is set to, such
+// that they can be applied to another flag set as given
+type rawFlagValue struct {
+	flag.Value
+	raw []string
+}
+
+func (v *rawFlagValue) Set(s string) error {
+	v.raw = append(v.raw, s)
+	return v.Value.Set(s)
+}
+
+// IsBoolFlag allows boolean flags without an argument
+func (v *rawFlagValue) IsBoolFlag() bool {
+	b, ok := v.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
+
+// readConfigFile sets the settings of a JSON or YAML file, YAML if its
+// extension is .yaml or .yml
+func readConfigFile(settings *flag.FlagSet, path string) error {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	values := map[string]interface{}{}
+	if ext := filepath.Ext(path); ext == ".yaml" || ext == ".yml" {
+		var doc map[interface{}]interface{}
+		if err = yaml.Unmarshal(raw, &doc); err != nil {
+			return err
+		}
+		for k, v := range doc {
+			values[fmt.Sprint(k)] = yamlToJSON(v)
+		}
+	} else if err = json.Unmarshal(raw, &values); err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		name := strings.Replace(k, "_", "-", -1)
+		if settings.Lookup(name) == nil {
+			return fmt.Errorf("unknown setting %q", k)
+		}
+		var s string
+		switch v := values[k].(type) {
+		case nil:
+			// Settings without value keep their default
+			continue
+		case string:
+			s = v
+		case float64:
+			s = strconv.FormatFloat(v, 'f', -1, 64)
+		case map[string]interface{}:
+			encoded, err := json.Marshal(v)
+			if err != nil {
+				return err
+			}
+			s = string(encoded)
+		default:
+			s = fmt.Sprint(v)
+		}
+		if err = settings.Set(name, s); err != nil {
+			return fmt.Errorf("invalid %s %q: %v", k, s, err)
+		}
+	}
+	return nil
+}
+
+// yamlToJSON converts the maps of a YAML document to maps of strings, as
+// decoded from JSON
+func yamlToJSON(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			m[fmt.Sprint(k)] = yamlToJSON(e)
+		}
+		return m
+	case []interface{}:
+		for i, e := range v {
+			v[i] = yamlToJSON(e)
+		}
+	}
+	return v
+}
+
+// ConfigError lists the problems of an invalid configuration
+type ConfigError struct {
+	Problems []string
+}
+
+func (e *ConfigError) Error() string {
+	return "invalid configuration: " + strings.Join(e.Problems, "; ")
+}
+
+// Validate returns a *ConfigError if the configuration is invalid
+func (c *Config) Validate() error {
+	var problems []string
+	invalid := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+	if c.Port < 1 || c.Port > 65535 {
+		invalid("port must be between 1 and 65535, got %d", c.Port)
+	}
+	switch c.StorageDriver {
+	case StorageDriverMongo:
+		if c.MongoDbURI == "" {
+			invalid("mongo_db_uri is required by the mongo storage driver")
+		}
+		if c.MongoDbDatabase == "" {
+			invalid("mongo_db_database is required by the mongo storage driver")
+		}
+		if c.MongoDbMaxPoolSize < 0 || c.MongoDbMinPoolSize < 0 ||
+			(c.MongoDbMaxPoolSize > 0 && c.MongoDbMinPoolSize > c.MongoDbMaxPoolSize) {
+			invalid("mongo_db_min_pool_size must be between 0 and mongo_db_max_pool_size, got %d and %d",
+				c.MongoDbMinPoolSize, c.MongoDbMaxPoolSize)
+		}
+		if c.MongoDbReadPreference != "" && !containsString(mongoDbReadPreferences, c.MongoDbReadPreference) {
+			invalid("mongo_db_read_preference must be one of %s, got %q",
+				strings.Join(mongoDbReadPreferences, ", "), c.MongoDbReadPreference)
+		}
+		if w, err := strconv.Atoi(c.MongoDbWriteConcern); c.MongoDbWriteConcern != "" &&
+			c.MongoDbWriteConcern != MongoDbWriteConcernMajority && (err != nil || w < 0) {
+			invalid("mongo_db_write_concern must be majority or a number of servers, got %q", c.MongoDbWriteConcern)
+		}
+		if c.MongoDbServerSelectionTimeout < 0 {
+			invalid("mongo_db_server_selection_timeout must not be negative, got %v", c.MongoDbServerSelectionTimeout)
+		}
+	case StorageDriverPostgres:
+		if c.PostgresURI == "" {
+			invalid("postgres_uri is required by the postgres storage driver")
+		}
+	case StorageDriverMemory:
+	default:
+		invalid("storage_driver must be mongo, postgres or memory, got %q", c.StorageDriver)
+	}
+	switch c.EventPublisher {
+	case EventPublisherFile:
+		if c.EventFile == "" {
+			invalid("event_file is required by the file event publisher")
+		}
+	case EventPublisherNone, EventPublisherWebhook:
+	default:
+		invalid("event_publisher must be none, file or webhook, got %q", c.EventPublisher)
+	}
+	if c.TraceExporter != TraceExporterNone && c.TraceExporter != TraceExporterStdout {
+		invalid("trace_exporter must be none or stdout, got %q", c.TraceExporter)
+	}
+	if _, ok := logLevelSeverities[c.LogLevel]; !ok {
+		invalid("log_level must be debug, info, warn or error, got %q", c.LogLevel)
+	}
+	if c.WebhookMaxAttempts < 1 {
+		invalid("webhook_max_attempts must be at least 1, got %d", c.WebhookMaxAttempts)
+	}
+	for _, d := range []struct {
+		key   string
+		value time.Duration
+	}{
+		{"db_connect_timeout", c.DbConnectTimeout},
+		{"db_operation_timeout", c.DbOperationTimeout},
+		{"idempotency_key_ttl", c.IdempotencyKeyTTL},
+		{"event_dispatch_interval", c.EventDispatchInterval},
+		{"webhook_backoff", c.WebhookBackoff},
+		{"webhook_timeout", c.WebhookTimeout},
+		{"read_timeout", c.ReadTimeout},
+		{"write_timeout", c.WriteTimeout},
+		{"idle_timeout", c.IdleTimeout},
+		{"shutdown_timeout", c.ShutdownTimeout},
+	} {
+		if d.value <= 0 {
+			invalid("%s must be positive, got %v", d.key, d.value)
+		}
+	}
+	if c.ConfigReloadInterval < 0 {
+		invalid("config_reload_interval must not be negative, got %v", c.ConfigReloadInterval)
+	}
+	if !c.AuthDisabled && len(c.APIKeys) == 0 && c.JWTSecret == "" {
+		invalid("api_keys or jwt_secret is required unless auth_disabled is set")
+	}
+	if !c.AuthDisabled && c.PolicyFile == "" {
+		invalid("policy_file is required unless auth_disabled is set")
+	}
+	if len(problems) > 0 {
+		return &ConfigError{Problems: problems}
+	}
+	return nil
+}
+
+// redacted replaces secrets of printed configurations
+const redacted = "REDACTED"
+
+// uriPassword matches the password of the user info of an URI
+var uriPassword = regexp.MustCompile(`(://[^:/@]*:)[^@/]*@`)
+
+// dsnPassword matches the password of a key=value connection string, quoted
+// or not, and of the password parameter of an URI
+var dsnPassword = regexp.MustCompile(`(\bpassword\s*=\s*)('(?:[^'\\]|\\.)*'|[^\s&']*)`)
+
+// redactPasswords replaces the passwords of a database URI or connection
+// string
+func redactPasswords(uri string) string {
+	uri = uriPassword.ReplaceAllString(uri, "${1}"+redacted+"@")
+	return dsnPassword.ReplaceAllString(uri, "${1}"+redacted)
+}
+
+// Redacted returns a copy of the configuration with the keys of API keys,
+// the JWT secret and the passwords of database URIs and connection strings
+// redacted
+func (c *Config) Redacted() *Config {
+	r := *c
+	r.APIKeys = make(map[string]APIKey, len(c.APIKeys))
+	for name, k := range c.APIKeys {
+		k.Key = redacted
+		r.APIKeys[name] = k
+	}
+	if r.JWTSecret != "" {
+		r.JWTSecret = redacted
+	}
+	r.MongoDbURI = redactPasswords(r.MongoDbURI)
+	r.PostgresURI = redactPasswords(r.PostgresURI)
+	return &r
+}
+
+// PrintConfig writes the redacted configuration as a JSON configuration file
+func PrintConfig(w io.Writer, c *Config) error {
+	settings := map[string]interface{}{}
+	configFlags(c.Redacted()).VisitAll(func(f *flag.Flag) {
+		v := f.Value.(flag.Getter).Get()
+		if d, ok := v.(time.Duration); ok {
+			v = d.String()
+		}
+		settings[settingKey(f.Name)] = v
+	})
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(settings)
 }
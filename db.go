@@ -2,11 +2,19 @@ package main
 
 import (
 	"context"
-	"github.com/google/logger"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
 )
 
 // ID is an unique identifier in the database
@@ -26,11 +34,6 @@ func IDToString(id ID) string {
 	return id.Hex()
 }
 
-// PaymentSummary is a simplification of the payment resource
-type PaymentSummary struct {
-	ID ID `bson:"_id"`
-}
-
 // PaymentParty ...
 type PaymentParty struct {
 	AccountName       string `bson:"account_name"`
@@ -98,82 +101,1021 @@ type Payment struct {
 	ID             ID                `bson:"_id"`
 	OrganisationID string            `bson:"organisation_id"`
 	Version        int               `bson:"version"`
+	Status         string            `bson:"status"`
 	Attributes     PaymentAttributes `bson:"attributes"`
+	// DeletedAt is set once the payment has been deleted by DeletedBy
+	DeletedAt *time.Time `bson:"deleted_at,omitempty"`
+	DeletedBy string     `bson:"deleted_by,omitempty"`
 }
 
+// cPayment is the document of a payment. The version recorded by a
+// modification is written to PendingVersions along with the modification,
+// and moved to the payment versions afterwards, such that no version is lost
+// if the process stops in between.
 type cPayment struct {
-	OrganisationID string            `bson:"organisation_id"`
-	Version        int               `bson:"version"`
-	Attributes     PaymentAttributes `bson:"attributes"`
+	ID              ID                `bson:"_id"`
+	OrganisationID  string            `bson:"organisation_id"`
+	Version         int               `bson:"version"`
+	Status          string            `bson:"status"`
+	Attributes      PaymentAttributes `bson:"attributes"`
+	PendingVersions []cPaymentVersion `bson:"pending_versions,omitempty"`
+}
+
+// Statuses of the payment lifecycle
+const (
+	PaymentStatusCreated           = "created"
+	PaymentStatusPendingSubmission = "pending_submission"
+	PaymentStatusSubmitted         = "submitted"
+	PaymentStatusAccepted          = "accepted"
+	PaymentStatusRejected          = "rejected"
+	PaymentStatusCancelled         = "cancelled"
+)
+
+// paymentTransitions maps statuses to the statuses a payment can transition
+// to. Accepted, rejected and cancelled payments are final.
+var paymentTransitions = map[string][]string{
+	PaymentStatusCreated:           {PaymentStatusPendingSubmission, PaymentStatusCancelled},
+	PaymentStatusPendingSubmission: {PaymentStatusCreated, PaymentStatusSubmitted, PaymentStatusCancelled},
+	PaymentStatusSubmitted:         {PaymentStatusAccepted, PaymentStatusRejected},
+	PaymentStatusAccepted:          {},
+	PaymentStatusRejected:          {},
+	PaymentStatusCancelled:         {},
+}
+
+// paymentUpdatableStatuses are the statuses in which payments can be updated
+var paymentUpdatableStatuses = []string{PaymentStatusCreated, PaymentStatusPendingSubmission}
+
+// paymentDeletableStatuses are the statuses in which payments can be deleted,
+// that is all statuses before submission
+var paymentDeletableStatuses = []string{PaymentStatusCreated, PaymentStatusPendingSubmission, PaymentStatusCancelled}
+
+// paymentTransitionSources returns the statuses a payment can transition to
+// the status from
+func paymentTransitionSources(status string) []string {
+	var sources []string
+	for from, to := range paymentTransitions {
+		if containsString(to, status) {
+			sources = append(sources, from)
+		}
+	}
+	sort.Strings(sources)
+	return sources
+}
+
+// paymentDeleted is the status reported by a *PaymentLockedError for deleted
+// payments
+const paymentDeleted = "deleted"
+
+// errNothingToDo is returned by checks when a payment already is in the state
+// a modification brings it to
+var errNothingToDo = errors.New("nothing to do")
+
+// now returns the current time at the precision kept by all backends
+func now() time.Time {
+	return time.Now().UTC().Truncate(time.Millisecond)
+}
+
+// checkPaymentUpdate returns the error of updating the payment in the version
+func checkPaymentUpdate(payment Payment, version int) error {
+	if payment.Version != version {
+		return &VersionConflictError{Version: payment.Version}
+	}
+	if payment.DeletedAt != nil {
+		return &PaymentLockedError{Status: paymentDeleted}
+	}
+	if !containsString(paymentUpdatableStatuses, payment.Status) {
+		return &PaymentLockedError{Status: payment.Status}
+	}
+	return nil
+}
+
+// checkPaymentTransition returns the error of transitioning the payment in the
+// version to the status
+func checkPaymentTransition(payment Payment, version int, status string) error {
+	if payment.Version != version {
+		return &VersionConflictError{Version: payment.Version}
+	}
+	if payment.DeletedAt != nil {
+		return &PaymentLockedError{Status: paymentDeleted}
+	}
+	if !containsString(paymentTransitions[payment.Status], status) {
+		return &InvalidTransitionError{From: payment.Status, To: status}
+	}
+	return nil
+}
+
+// checkPaymentDelete returns the error of deleting the payment
+func checkPaymentDelete(payment Payment) error {
+	if payment.DeletedAt != nil {
+		return errNothingToDo
+	}
+	if !containsString(paymentDeletableStatuses, payment.Status) {
+		return &PaymentLockedError{Status: payment.Status}
+	}
+	return nil
+}
+
+// checkPaymentRestore returns the error of restoring the payment
+func checkPaymentRestore(payment Payment) error {
+	if payment.DeletedAt == nil {
+		return errNothingToDo
+	}
+	return nil
+}
+
+// IsPaymentStatus returns whether the status is a known payment status
+func IsPaymentStatus(status string) bool {
+	_, ok := paymentTransitions[status]
+	return ok
+}
+
+// Events recorded in the history of a payment
+const (
+	PaymentEventCreated       = "created"
+	PaymentEventUpdated       = "updated"
+	PaymentEventStatusChanged = "status_changed"
+	PaymentEventDeleted       = "deleted"
+	PaymentEventRestored      = "restored"
+)
+
+// PaymentVersion is an immutable snapshot of a payment recorded by every
+// modification
+type PaymentVersion struct {
+	Version   int       `bson:"version"`
+	Event     string    `bson:"event"`
+	Actor     string    `bson:"actor"`
+	Timestamp time.Time `bson:"timestamp"`
+	// Payment is the payment after the modification
+	Payment Payment `bson:"payment"`
+}
+
+// newPaymentVersion records the event leading to the payment by the actor of
+// the context
+func newPaymentVersion(ctx context.Context, event string, payment Payment) PaymentVersion {
+	return PaymentVersion{
+		Version:   payment.Version,
+		Event:     event,
+		Actor:     contextActor(ctx),
+		Timestamp: now(),
+		Payment:   payment,
+	}
+}
+
+// contextActor returns who performs the modifications of the context
+func contextActor(ctx context.Context) string {
+	actor, _ := ctx.Value(ContextActor).(string)
+	return StringOrDefault(actor, "system")
+}
+
+// contextOrganisation returns the organisation the context is scoped to, or
+// an empty string when the context may access every organisation
+func contextOrganisation(ctx context.Context) string {
+	if principal := contextPrincipal(ctx); principal != nil {
+		return principal.OrganisationID
+	}
+	return ""
+}
+
+// inOrganisationScope returns whether the context may access the
+// organisation
+func inOrganisationScope(ctx context.Context, organisationID string) bool {
+	org := contextOrganisation(ctx)
+	return org == "" || org == organisationID
+}
+
+// scopePaymentFilter restricts the filter to the organisation of the context.
+// Filters of other organisations match nothing, which is signalled by false.
+func scopePaymentFilter(ctx context.Context, filter PaymentFilter) (PaymentFilter, bool) {
+	org := contextOrganisation(ctx)
+	if org == "" {
+		return filter, true
+	}
+	if filter.OrganisationID != "" && filter.OrganisationID != org {
+		return filter, false
+	}
+	filter.OrganisationID = org
+	return filter, true
+}
+
+// Fields payments can be sorted by
+const (
+	PaymentSortID             = "id"
+	PaymentSortProcessingDate = "processing_date"
+	PaymentSortAmount         = "amount"
+)
+
+// Fields of payments which can be retrieved when listing payments
+const (
+	PaymentFieldOrganisationID = "organisation_id"
+	PaymentFieldVersion        = "version"
+	PaymentFieldStatus         = "status"
+	PaymentFieldDeletedAt      = "deleted_at"
+	PaymentFieldDeletedBy      = "deleted_by"
+	PaymentFieldAttributes     = "attributes"
+	// PaymentFieldAttributePrefix prefixes the name of a single attribute
+	PaymentFieldAttributePrefix = "attributes."
+)
+
+// PaymentFilter restricts the listed payments. Empty fields match all
+// payments. Ranges are inclusive, dates are formatted as YYYY-MM-DD and
+// amounts are decimal strings.
+type PaymentFilter struct {
+	OrganisationID           string
+	Status                   string
+	Currency                 string
+	PaymentScheme            string
+	PaymentType              string
+	ProcessingDateFrom       string
+	ProcessingDateTo         string
+	AmountMin                string
+	AmountMax                string
+	DebtorAccountNumber      string
+	BeneficiaryAccountNumber string
+}
+
+// PaymentQuery describes a page of payments
+type PaymentQuery struct {
+	Filter PaymentFilter
+	// Sort is the field to sort by, ties are broken by ID
+	Sort       string
+	Descending bool
+	// Size is the maximum number of payments to return
+	Size int
+	// After is the ID of the last payment of the previous page
+	After *ID
+	// Fields are the PaymentField values to retrieve besides the ID, all
+	// other fields are left empty
+	Fields []string
+	// IncludeDeleted includes deleted payments
+	IncludeDeleted bool
+}
+
+// attributeFields returns whether all attributes are retrieved and the names
+// of the individually retrieved attributes
+func (q PaymentQuery) attributeFields() (bool, []string) {
+	var names []string
+	for _, f := range q.Fields {
+		if f == PaymentFieldAttributes {
+			return true, nil
+		}
+		if strings.HasPrefix(f, PaymentFieldAttributePrefix) {
+			names = append(names, strings.TrimPrefix(f, PaymentFieldAttributePrefix))
+		}
+	}
+	return false, names
+}
+
+func (q PaymentQuery) hasField(field string) bool {
+	for _, f := range q.Fields {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+// projectAttributes returns the attributes with only the named attributes
+// set
+func projectAttributes(attributes PaymentAttributes, names []string) (PaymentAttributes, error) {
+	res := PaymentAttributes{}
+	raw, err := bson.Marshal(attributes)
+	if err != nil {
+		return res, err
+	}
+	all := bson.M{}
+	if err = bson.Unmarshal(raw, &all); err != nil {
+		return res, err
+	}
+	projected := bson.M{}
+	for _, name := range names {
+		if v, ok := all[name]; ok {
+			projected[name] = v
+		}
+	}
+	if raw, err = bson.Marshal(projected); err != nil {
+		return res, err
+	}
+	err = bson.Unmarshal(raw, &res)
+	return res, err
+}
+
+// sortValue returns the value of the payment field the query is sorted by
+func (q PaymentQuery) sortValue(payment Payment) string {
+	switch q.Sort {
+	case PaymentSortProcessingDate:
+		return payment.Attributes.ProcessingDate
+	case PaymentSortAmount:
+		return payment.Attributes.Amount
+	}
+	return IDToString(payment.ID)
+}
+
+// VersionConflictError is returned when a payment is modified with an
+// outdated version.
+type VersionConflictError struct {
+	Version int
+}
+
+func (e *VersionConflictError) Error() string {
+	return fmt.Sprintf("version conflict, current version is %d", e.Version)
+}
+
+// InvalidTransitionError is returned when a payment can not transition to a
+// status from its current status.
+type InvalidTransitionError struct {
+	From string
+	To   string
+}
+
+func (e *InvalidTransitionError) Error() string {
+	return fmt.Sprintf("payment can not transition from %s to %s", e.From, e.To)
+}
+
+// PaymentLockedError is returned when a payment is modified in a status not
+// allowing it, e.g. once it has been submitted.
+type PaymentLockedError struct {
+	Status string
+}
+
+func (e *PaymentLockedError) Error() string {
+	return fmt.Sprintf("payment can not be modified when %s", e.Status)
+}
+
+// IdempotencyKey identifies the requests of an organisation sharing an
+// Idempotency-Key header
+type IdempotencyKey struct {
+	OrganisationID string `bson:"organisation_id"`
+	Key            string `bson:"key"`
+}
+
+// IdempotencyRecord is the response of a request with an idempotency key
+type IdempotencyRecord struct {
+	ID IdempotencyKey `bson:"_id"`
+	// RequestHash identifies the request the key was first used with
+	RequestHash string `bson:"request_hash"`
+	// Status is zero while the first request is in progress
+	Status    int       `bson:"status"`
+	Body      []byte    `bson:"body"`
+	ExpiresAt time.Time `bson:"expires_at"`
+}
+
+// Subscription registers a callback URL receiving payment events of the
+// event types. Subscriptions of an organisation only receive events of its
+// payments, subscriptions of no organisation receive events of all
+// organisations.
+type Subscription struct {
+	ID             ID       `bson:"_id"`
+	OrganisationID string   `bson:"organisation_id"`
+	URL            string   `bson:"url"`
+	EventTypes     []string `bson:"event_types"`
+	// Secret signs the notifications of the subscription
+	Secret    string    `bson:"secret"`
+	CreatedAt time.Time `bson:"created_at"`
+}
+
+// Statuses of a webhook delivery
+const (
+	WebhookDeliveryPending   = "pending"
+	WebhookDeliverySucceeded = "succeeded"
+	WebhookDeliveryFailed    = "failed"
+)
+
+// WebhookAttempt is a single attempt to deliver a notification
+type WebhookAttempt struct {
+	Timestamp time.Time `bson:"timestamp" json:"timestamp"`
+	// StatusCode is zero when no response was received
+	StatusCode int    `bson:"status_code" json:"status_code"`
+	Error      string `bson:"error" json:"error"`
+}
+
+// WebhookDelivery is the notification of a subscription about a payment
+// event
+type WebhookDelivery struct {
+	ID             ID               `bson:"_id"`
+	SubscriptionID ID               `bson:"subscription_id"`
+	PaymentID      ID               `bson:"payment_id"`
+	Version        int              `bson:"version"`
+	EventType      string           `bson:"event_type"`
+	Payload        []byte           `bson:"payload"`
+	Status         string           `bson:"status"`
+	Attempts       []WebhookAttempt `bson:"attempts"`
+	NextAttemptAt  time.Time        `bson:"next_attempt_at"`
+	CreatedAt      time.Time        `bson:"created_at"`
 }
 
 // Db is an abstraction responsible for all retrieval and modification of
-// persistent storage.
+// persistent storage. Payments and subscriptions are only accessible within
+// the organisation of the context, see contextOrganisation. Failures are
+// reported as errors of a kind, see ErrorKind, and entities which are missing
+// or not accessible give ErrNotFound.
 type Db interface {
-	// Retrieve a list of payments
-	GetPayments(ctx context.Context, size int, after *ID) (*[]PaymentSummary, error)
+	// Retrieve a filtered and sorted page of payments with only the queried
+	// fields
+	GetPayments(ctx context.Context, query PaymentQuery) (*[]Payment, error)
 
-	// Retrieve a single payment
-	GetPaymentByID(ctx context.Context, id ID) (*Payment, error)
+	// Retrieve a single payment, deleted payments only if includeDeleted is
+	// set
+	GetPaymentByID(ctx context.Context, id ID, includeDeleted bool) (*Payment, error)
 
 	// Create a new payment
 	CreatePayment(ctx context.Context, organizationID string, attributes PaymentAttributes) (*ID, error)
 
-	// Update a new payment
-	UpdatePayment(ctx context.Context, ID ID, organizationID string, attributes PaymentAttributes) error
+	// Update a payment if its current version matches the given version,
+	// otherwise a *VersionConflictError is returned. Payments which are no
+	// longer updatable give a *PaymentLockedError.
+	UpdatePayment(ctx context.Context, ID ID, organizationID string, version int, attributes PaymentAttributes) error
+
+	// Transition a payment to the status if its current version matches the
+	// given version. Transitions not allowed from the current status give an
+	// *InvalidTransitionError.
+	UpdatePaymentStatus(ctx context.Context, ID ID, version int, status string) error
 
-	// Delete a payment for good
+	// Mark a payment as deleted by the actor of the context. Payments which
+	// have been submitted give a *PaymentLockedError.
 	DeletePayment(ctx context.Context, ID ID) error
 
+	// Restore a deleted payment
+	RestorePayment(ctx context.Context, ID ID) error
+
+	// Retrieve the history of a payment, also when deleted, oldest version
+	// first
+	GetPaymentVersions(ctx context.Context, ID ID) (*[]PaymentVersion, error)
+
+	// Retrieve a single version of a payment, also when deleted
+	GetPaymentVersion(ctx context.Context, ID ID, version int) (*PaymentVersion, error)
+
+	// Retrieve at most size versions which have not been published, oldest
+	// first. Versions are the outbox of payment events.
+	GetUnpublishedPaymentVersions(ctx context.Context, size int) (*[]PaymentVersion, error)
+
+	// Mark a version as published
+	MarkPaymentVersionPublished(ctx context.Context, ID ID, version int) error
+
+	// Reserve an idempotency key for a request. If the key is reserved and
+	// not yet expired the existing record is returned, otherwise nil.
+	ReserveIdempotencyKey(ctx context.Context, record IdempotencyRecord) (*IdempotencyRecord, error)
+
+	// Store the response and expiry of a request with a reserved idempotency
+	// key
+	SaveIdempotencyKey(ctx context.Context, record IdempotencyRecord) error
+
+	// Release a reserved idempotency key, such that the request can be
+	// retried
+	ReleaseIdempotencyKey(ctx context.Context, key IdempotencyKey) error
+
+	// Create a new subscription of the organisation, which is empty for
+	// events of all organisations
+	CreateSubscription(ctx context.Context, organisationID string, url string, eventTypes []string, secret string) (*Subscription, error)
+
+	// Retrieve all subscriptions, oldest first
+	GetSubscriptions(ctx context.Context) (*[]Subscription, error)
+
+	// Retrieve a single subscription
+	GetSubscriptionByID(ctx context.Context, ID ID) (*Subscription, error)
+
+	// Delete a subscription and its deliveries
+	DeleteSubscription(ctx context.Context, ID ID) error
+
+	// Create a pending delivery. Deliveries of a payment version which
+	// already exist for the subscription are ignored.
+	CreateWebhookDelivery(ctx context.Context, delivery WebhookDelivery) error
+
+	// Retrieve at most size pending deliveries due before the time, earliest
+	// first
+	GetDueWebhookDeliveries(ctx context.Context, before time.Time, size int) (*[]WebhookDelivery, error)
+
+	// Store the status, attempts and next attempt of a delivery
+	SaveWebhookDelivery(ctx context.Context, delivery WebhookDelivery) error
+
+	// Retrieve the deliveries of a subscription, oldest first
+	GetWebhookDeliveries(ctx context.Context, subscriptionID ID) (*[]WebhookDelivery, error)
+
 	// Connect to database
 	Connect(ctx context.Context) error
 
+	// Ping verifies the database is reachable
+	Ping(ctx context.Context) error
+
 	// Close connection
 	Close(ctx context.Context) error
 }
 
+// MongoCollection is the part of *mongo.Collection used by the MongoDB Db
+type MongoCollection interface {
+	InsertOne(ctx context.Context, document interface{}, opts ...*options.InsertOneOptions) (*mongo.InsertOneResult, error)
+	FindOne(ctx context.Context, filter interface{}, opts ...*options.FindOneOptions) *mongo.SingleResult
+	FindOneAndUpdate(ctx context.Context, filter interface{}, update interface{}, opts ...*options.FindOneAndUpdateOptions) *mongo.SingleResult
+	Find(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (*mongo.Cursor, error)
+	Aggregate(ctx context.Context, pipeline interface{}, opts ...*options.AggregateOptions) (*mongo.Cursor, error)
+	UpdateOne(ctx context.Context, filter interface{}, update interface{}, opts ...*options.UpdateOptions) (*mongo.UpdateResult, error)
+	DeleteOne(ctx context.Context, filter interface{}, opts ...*options.DeleteOptions) (*mongo.DeleteResult, error)
+	DeleteMany(ctx context.Context, filter interface{}, opts ...*options.DeleteOptions) (*mongo.DeleteResult, error)
+	Indexes() mongo.IndexView
+	Drop(ctx context.Context) error
+}
+
 type db struct {
 	Client *mongo.Client
+	// collection returns the collection of the name
+	collection func(ctx context.Context, name string) MongoCollection
 }
 
-func (db *db) DeletePayment(ctx context.Context, id ID) error {
-	_, err := db.paymentsCollection(ctx).DeleteOne(ctx, bson.M{"_id": id})
+// mongoError returns the error of the driver as an error of a kind, see
+// ErrorKind. Errors of no known kind are returned as they are.
+func mongoError(err error) error {
+	if err == nil || ErrorKind(err) != nil {
+		return err
+	}
+	switch {
+	case errors.Is(err, mongo.ErrNoDocuments):
+		return ErrNotFound
+	case mongo.IsDuplicateKeyError(err):
+		return &DbError{Kind: ErrConflict, Err: err}
+	case mongo.IsNetworkError(err), mongo.IsTimeout(err), errors.Is(err, mongo.ErrClientDisconnected),
+		errors.Is(err, context.Canceled):
+		return &DbError{Kind: ErrUnavailable, Err: err}
+	}
 	return err
 }
 
-func (db *db) UpdatePayment(ctx context.Context, id ID, organisationID string, attributes PaymentAttributes) error {
-	_, err := db.paymentsCollection(ctx).UpdateMany(ctx, bson.M{"_id": id}, bson.M{
-		"$set": bson.M{
-			"organisation_id": organisationID,
-			"attributes":      attributes,
-		},
-		"$inc": bson.M{"version": 1},
+// mongoStatusFilter matches payments in any of the statuses. Payments stored
+// before statuses were introduced have no status and count as created.
+func mongoStatusFilter(statuses []string) bson.M {
+	values := bson.A{}
+	for _, status := range statuses {
+		values = append(values, status)
+		if status == PaymentStatusCreated {
+			values = append(values, nil)
+		}
+	}
+	return bson.M{"$in": values}
+}
+
+// mongoPaymentStatus defaults the status of payments stored before statuses
+// were introduced
+func mongoPaymentStatus(payment *Payment) {
+	if payment.Status == "" {
+		payment.Status = PaymentStatusCreated
+	}
+}
+
+func (db *db) paymentVersionsCollection(ctx context.Context) MongoCollection {
+	return db.collection(ctx, "payment_versions")
+}
+
+// cPaymentVersion is the document of a payment version
+type cPaymentVersion struct {
+	PaymentID      ID `bson:"payment_id"`
+	PaymentVersion `bson:",inline"`
+	Published      bool `bson:"published"`
+}
+
+// movePendingVersion moves a pending version of a payment to the payment
+// versions. Versions which have been moved already are only removed from the
+// payment.
+func (db *db) movePendingVersion(ctx context.Context, version cPaymentVersion) error {
+	_, err := db.paymentVersionsCollection(ctx).InsertOne(ctx, version)
+	if err != nil && !mongo.IsDuplicateKeyError(err) {
+		return mongoError(err)
+	}
+	_, err = db.paymentsCollection(ctx).UpdateOne(ctx, bson.M{"_id": version.PaymentID},
+		bson.M{"$pull": bson.M{"pending_versions": bson.M{"version": version.Version}}})
+	return mongoError(err)
+}
+
+// moveModificationVersion moves the version recorded by a modification. The
+// modification is stored already, so a failure is only logged and the
+// version is moved by the next movePendingVersions.
+func (db *db) moveModificationVersion(ctx context.Context, version cPaymentVersion) {
+	if err := db.movePendingVersion(ctx, version); err != nil {
+		contextLogger(ctx).With("payment_id", IDToString(version.PaymentID)).With("event", version.Event).
+			Warn("failed to move pending payment version", err)
+	}
+}
+
+// movePendingVersions moves the pending versions of the payments matching
+// the filter, left behind by modifications whose versions were not moved
+func (db *db) movePendingVersions(ctx context.Context, filter bson.M) error {
+	filter["pending_versions.version"] = bson.M{"$exists": true}
+	cur, err := db.paymentsCollection(ctx).Find(ctx, filter,
+		options.Find().SetProjection(bson.M{"pending_versions": 1}))
+	if err != nil {
+		return mongoError(err)
+	}
+	defer cur.Close(ctx)
+	for cur.Next(ctx) {
+		var payment cPayment
+		if err = cur.Decode(&payment); err != nil {
+			return mongoError(err)
+		}
+		for _, version := range payment.PendingVersions {
+			if err = db.movePendingVersion(ctx, version); err != nil {
+				return err
+			}
+		}
+	}
+	return mongoError(cur.Err())
+}
+
+// mongoUpdateAttempts is how many times a payment modified concurrently is
+// read again before the modification is rejected as a conflict
+const mongoUpdateAttempts = 3
+
+// updatePayment applies the modification to the payment if the check of the
+// payment passes. The modified payment is written along with its version,
+// unless the payment was modified in the meantime, in which case the payment
+// is checked again.
+func (db *db) updatePayment(ctx context.Context, id ID, event string, check func(Payment) error, modify func(*Payment)) error {
+	var payment *Payment
+	for attempt := 0; attempt < mongoUpdateAttempts; attempt++ {
+		var err error
+		if payment, err = db.GetPaymentByID(ctx, id, true); err != nil {
+			return err
+		}
+		if err = check(*payment); err == errNothingToDo {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		previous := payment.Version
+		modify(payment)
+		payment.Version++
+		version := cPaymentVersion{
+			PaymentID:      id,
+			PaymentVersion: newPaymentVersion(ctx, event, *payment),
+		}
+		update := bson.M{
+			"$set": bson.M{
+				"organisation_id": payment.OrganisationID,
+				"version":         payment.Version,
+				"status":          payment.Status,
+				"attributes":      payment.Attributes,
+			},
+			"$push": bson.M{"pending_versions": version},
+		}
+		if payment.DeletedAt == nil {
+			update["$unset"] = bson.M{"deleted_at": "", "deleted_by": ""}
+		} else {
+			update["$set"].(bson.M)["deleted_at"] = payment.DeletedAt
+			update["$set"].(bson.M)["deleted_by"] = payment.DeletedBy
+		}
+		res, err := db.paymentsCollection(ctx).UpdateOne(ctx, bson.M{"_id": id, "version": previous}, update)
+		if err != nil {
+			return mongoError(err)
+		}
+		if res.MatchedCount == 1 {
+			db.moveModificationVersion(ctx, version)
+			return nil
+		}
+	}
+	// Modified in the meantime
+	return &VersionConflictError{Version: payment.Version}
+}
+
+func (db *db) UpdatePayment(ctx context.Context, id ID, organisationID string, version int, attributes PaymentAttributes) error {
+	return db.updatePayment(ctx, id, PaymentEventUpdated, func(payment Payment) error {
+		return checkPaymentUpdate(payment, version)
+	}, func(payment *Payment) {
+		payment.OrganisationID = organisationID
+		payment.Attributes = attributes
 	})
-	return err
 }
 
-func (db *db) paymentsCollection(ctx context.Context) *mongo.Collection {
-	conf := ctx.Value(ContextConfig).(*Config)
-	return db.Client.Database(conf.MongoDbDatabase).Collection("payments")
+func (db *db) UpdatePaymentStatus(ctx context.Context, id ID, version int, status string) error {
+	return db.updatePayment(ctx, id, PaymentEventStatusChanged, func(payment Payment) error {
+		return checkPaymentTransition(payment, version, status)
+	}, func(payment *Payment) {
+		payment.Status = status
+	})
+}
+
+func (db *db) DeletePayment(ctx context.Context, id ID) error {
+	return db.updatePayment(ctx, id, PaymentEventDeleted, checkPaymentDelete, func(payment *Payment) {
+		deletedAt := now()
+		payment.DeletedAt = &deletedAt
+		payment.DeletedBy = contextActor(ctx)
+	})
+}
+
+func (db *db) RestorePayment(ctx context.Context, id ID) error {
+	return db.updatePayment(ctx, id, PaymentEventRestored, checkPaymentRestore, func(payment *Payment) {
+		payment.DeletedAt = nil
+		payment.DeletedBy = ""
+	})
+}
+
+// scopePaymentVersions moves the pending versions of the payment, also when
+// deleted, or returns ErrNotFound if the context may not access it
+func (db *db) scopePaymentVersions(ctx context.Context, id ID) error {
+	if _, err := db.GetPaymentByID(ctx, id, true); err != nil {
+		return err
+	}
+	return db.movePendingVersions(ctx, bson.M{"_id": id})
+}
+
+func (db *db) GetPaymentVersions(ctx context.Context, id ID) (*[]PaymentVersion, error) {
+	if err := db.scopePaymentVersions(ctx, id); err != nil {
+		return nil, err
+	}
+	cur, err := db.paymentVersionsCollection(ctx).Find(ctx, bson.M{"payment_id": id},
+		options.Find().SetSort(bson.M{"version": 1}))
+	if err != nil {
+		return nil, mongoError(err)
+	}
+	defer cur.Close(ctx)
+	res := []PaymentVersion{}
+	for cur.Next(ctx) {
+		var elm cPaymentVersion
+		if err = cur.Decode(&elm); err != nil {
+			return nil, mongoError(err)
+		}
+		res = append(res, elm.PaymentVersion)
+	}
+	return &res, mongoError(cur.Err())
+}
+
+func (db *db) GetUnpublishedPaymentVersions(ctx context.Context, size int) (*[]PaymentVersion, error) {
+	if err := db.movePendingVersions(ctx, bson.M{}); err != nil {
+		return nil, err
+	}
+	cur, err := db.paymentVersionsCollection(ctx).Find(ctx, bson.M{"published": false},
+		options.Find().SetSort(bson.D{{Key: "timestamp", Value: 1}, {Key: "_id", Value: 1}}).SetLimit(int64(size)))
+	if err != nil {
+		return nil, mongoError(err)
+	}
+	defer cur.Close(ctx)
+	res := []PaymentVersion{}
+	for cur.Next(ctx) {
+		var elm cPaymentVersion
+		if err = cur.Decode(&elm); err != nil {
+			return nil, mongoError(err)
+		}
+		res = append(res, elm.PaymentVersion)
+	}
+	return &res, mongoError(cur.Err())
+}
+
+func (db *db) MarkPaymentVersionPublished(ctx context.Context, id ID, version int) error {
+	_, err := db.paymentVersionsCollection(ctx).UpdateOne(ctx, bson.M{"payment_id": id, "version": version},
+		bson.M{"$set": bson.M{"published": true}})
+	return mongoError(err)
+}
+
+func (db *db) GetPaymentVersion(ctx context.Context, id ID, version int) (*PaymentVersion, error) {
+	if err := db.scopePaymentVersions(ctx, id); err != nil {
+		return nil, err
+	}
+	res := db.paymentVersionsCollection(ctx).FindOne(ctx, bson.M{"payment_id": id, "version": version})
+	elm := cPaymentVersion{}
+	if err := res.Decode(&elm); err != nil {
+		return nil, mongoError(err)
+	}
+	return &elm.PaymentVersion, nil
+}
+
+func (db *db) paymentsCollection(ctx context.Context) MongoCollection {
+	return db.collection(ctx, "payments")
 }
 
 func (db *db) CreatePayment(ctx context.Context, organizationID string, attributes PaymentAttributes) (*ID, error) {
-	res, err := db.paymentsCollection(ctx).InsertOne(
-		ctx, cPayment{
-			OrganisationID: organizationID,
-			Attributes:     attributes,
-			Version:        0,
+	payment := Payment{
+		ID:             primitive.NewObjectID(),
+		OrganisationID: organizationID,
+		Version:        0,
+		Status:         PaymentStatusCreated,
+		Attributes:     attributes,
+	}
+	version := cPaymentVersion{
+		PaymentID:      payment.ID,
+		PaymentVersion: newPaymentVersion(ctx, PaymentEventCreated, payment),
+	}
+	_, err := db.paymentsCollection(ctx).InsertOne(ctx, cPayment{
+		ID:              payment.ID,
+		OrganisationID:  payment.OrganisationID,
+		Version:         payment.Version,
+		Status:          payment.Status,
+		Attributes:      payment.Attributes,
+		PendingVersions: []cPaymentVersion{version},
+	})
+	if err != nil {
+		return nil, mongoError(err)
+	}
+	db.moveModificationVersion(ctx, version)
+	return &payment.ID, nil
+}
+
+func (db *db) idempotencyKeysCollection(ctx context.Context) MongoCollection {
+	return db.collection(ctx, "idempotency_keys")
+}
+
+func (db *db) ReserveIdempotencyKey(ctx context.Context, record IdempotencyRecord) (*IdempotencyRecord, error) {
+	collection := db.idempotencyKeysCollection(ctx)
+	// The TTL index removes expired records eventually, so remove this one now
+	_, err := collection.DeleteOne(ctx, bson.M{"_id": record.ID, "expires_at": bson.M{"$lte": time.Now()}})
+	if err != nil {
+		return nil, mongoError(err)
+	}
+	res := collection.FindOneAndUpdate(ctx, bson.M{"_id": record.ID}, bson.M{
+		"$setOnInsert": bson.M{
+			"request_hash": record.RequestHash,
+			"status":       record.Status,
+			"body":         record.Body,
+			"expires_at":   record.ExpiresAt,
 		},
-	)
+	}, options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.Before))
+	existing := IdempotencyRecord{}
+	err = res.Decode(&existing)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
 	if err != nil {
-		logger.Fatal(err)
+		return nil, mongoError(err)
 	}
-	str := res.InsertedID.(primitive.ObjectID)
-	return &str, nil
+	return &existing, nil
+}
+
+func (db *db) SaveIdempotencyKey(ctx context.Context, record IdempotencyRecord) error {
+	_, err := db.idempotencyKeysCollection(ctx).UpdateOne(ctx, bson.M{"_id": record.ID}, bson.M{
+		"$set": bson.M{
+			"status":     record.Status,
+			"body":       record.Body,
+			"expires_at": record.ExpiresAt,
+		},
+	})
+	return mongoError(err)
+}
+
+func (db *db) ReleaseIdempotencyKey(ctx context.Context, key IdempotencyKey) error {
+	_, err := db.idempotencyKeysCollection(ctx).DeleteOne(ctx, bson.M{"_id": key})
+	return mongoError(err)
+}
+
+func (db *db) subscriptionsCollection(ctx context.Context) MongoCollection {
+	return db.collection(ctx, "subscriptions")
+}
+
+func (db *db) webhookDeliveriesCollection(ctx context.Context) MongoCollection {
+	return db.collection(ctx, "webhook_deliveries")
+}
+
+// mongoSubscriptionFilter matches the subscriptions of the organisation of
+// the context
+func mongoSubscriptionFilter(ctx context.Context, filter bson.M) bson.M {
+	if org := contextOrganisation(ctx); org != "" {
+		filter["organisation_id"] = org
+	}
+	return filter
+}
+
+func (db *db) CreateSubscription(ctx context.Context, organisationID string, url string, eventTypes []string, secret string) (*Subscription, error) {
+	subscription := Subscription{
+		ID:             primitive.NewObjectID(),
+		OrganisationID: organisationID,
+		URL:            url,
+		EventTypes:     eventTypes,
+		Secret:         secret,
+		CreatedAt:      now(),
+	}
+	if _, err := db.subscriptionsCollection(ctx).InsertOne(ctx, subscription); err != nil {
+		return nil, mongoError(err)
+	}
+	return &subscription, nil
+}
+
+func (db *db) GetSubscriptions(ctx context.Context) (*[]Subscription, error) {
+	cur, err := db.subscriptionsCollection(ctx).Find(ctx, mongoSubscriptionFilter(ctx, bson.M{}),
+		options.Find().SetSort(bson.M{"_id": 1}))
+	if err != nil {
+		return nil, mongoError(err)
+	}
+	defer cur.Close(ctx)
+	res := []Subscription{}
+	for cur.Next(ctx) {
+		var elm Subscription
+		if err = cur.Decode(&elm); err != nil {
+			return nil, mongoError(err)
+		}
+		res = append(res, elm)
+	}
+	return &res, mongoError(cur.Err())
+}
+
+func (db *db) GetSubscriptionByID(ctx context.Context, id ID) (*Subscription, error) {
+	res := db.subscriptionsCollection(ctx).FindOne(ctx, mongoSubscriptionFilter(ctx, bson.M{"_id": id}))
+	subscription := Subscription{}
+	if err := res.Decode(&subscription); err != nil {
+		return nil, mongoError(err)
+	}
+	return &subscription, nil
+}
+
+func (db *db) DeleteSubscription(ctx context.Context, id ID) error {
+	res, err := db.subscriptionsCollection(ctx).DeleteOne(ctx, mongoSubscriptionFilter(ctx, bson.M{"_id": id}))
+	if err != nil {
+		return mongoError(err)
+	}
+	if res.DeletedCount == 0 {
+		return ErrNotFound
+	}
+	_, err = db.webhookDeliveriesCollection(ctx).DeleteMany(ctx, bson.M{"subscription_id": id})
+	return mongoError(err)
+}
+
+func (db *db) CreateWebhookDelivery(ctx context.Context, delivery WebhookDelivery) error {
+	delivery.ID = primitive.NewObjectID()
+	_, err := db.webhookDeliveriesCollection(ctx).UpdateOne(ctx, bson.M{
+		"subscription_id": delivery.SubscriptionID,
+		"payment_id":      delivery.PaymentID,
+		"version":         delivery.Version,
+	}, bson.M{"$setOnInsert": delivery}, options.Update().SetUpsert(true))
+	return mongoError(err)
+}
+
+func (db *db) findWebhookDeliveries(ctx context.Context, filter bson.M, opts *options.FindOptions) (*[]WebhookDelivery, error) {
+	cur, err := db.webhookDeliveriesCollection(ctx).Find(ctx, filter, opts)
+	if err != nil {
+		return nil, mongoError(err)
+	}
+	defer cur.Close(ctx)
+	res := []WebhookDelivery{}
+	for cur.Next(ctx) {
+		var elm WebhookDelivery
+		if err = cur.Decode(&elm); err != nil {
+			return nil, mongoError(err)
+		}
+		res = append(res, elm)
+	}
+	return &res, mongoError(cur.Err())
+}
+
+func (db *db) GetDueWebhookDeliveries(ctx context.Context, before time.Time, size int) (*[]WebhookDelivery, error) {
+	return db.findWebhookDeliveries(ctx,
+		bson.M{"status": WebhookDeliveryPending, "next_attempt_at": bson.M{"$lte": before}},
+		options.Find().SetSort(bson.D{{Key: "next_attempt_at", Value: 1}, {Key: "_id", Value: 1}}).SetLimit(int64(size)))
+}
+
+func (db *db) SaveWebhookDelivery(ctx context.Context, delivery WebhookDelivery) error {
+	_, err := db.webhookDeliveriesCollection(ctx).UpdateOne(ctx, bson.M{"_id": delivery.ID}, bson.M{
+		"$set": bson.M{
+			"status":          delivery.Status,
+			"attempts":        delivery.Attempts,
+			"next_attempt_at": delivery.NextAttemptAt,
+		},
+	})
+	return mongoError(err)
+}
+
+func (db *db) GetWebhookDeliveries(ctx context.Context, subscriptionID ID) (*[]WebhookDelivery, error) {
+	return db.findWebhookDeliveries(ctx, bson.M{"subscription_id": subscriptionID},
+		options.Find().SetSort(bson.M{"_id": 1}))
 }
 
 func (db *db) Connect(ctx context.Context) error {
-	return db.Client.Connect(ctx)
+	if err := db.Client.Connect(ctx); err != nil {
+		return mongoError(err)
+	}
+	_, err := db.idempotencyKeysCollection(ctx).Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.M{"expires_at": 1},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	if err != nil {
+		return mongoError(err)
+	}
+	_, err = db.paymentsCollection(ctx).Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.M{"pending_versions.version": 1},
+		Options: options.Index().SetSparse(true),
+	})
+	if err != nil {
+		return mongoError(err)
+	}
+	_, err = db.paymentVersionsCollection(ctx).Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "payment_id", Value: 1}, {Key: "version", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys:    bson.D{{Key: "timestamp", Value: 1}, {Key: "_id", Value: 1}},
+			Options: options.Index().SetPartialFilterExpression(bson.M{"published": false}),
+		},
+	})
+	if err != nil {
+		return mongoError(err)
+	}
+	_, err = db.webhookDeliveriesCollection(ctx).Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys: bson.D{{Key: "subscription_id", Value: 1}, {Key: "payment_id", Value: 1},
+				{Key: "version", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys: bson.D{{Key: "status", Value: 1}, {Key: "next_attempt_at", Value: 1}},
+		},
+	})
+	return mongoError(err)
+}
+
+func (db *db) Ping(ctx context.Context) error {
+	return db.Client.Ping(ctx, readpref.Primary())
 }
 
 func (db *db) Close(ctx context.Context) error {
@@ -181,52 +1123,256 @@ func (db *db) Close(ctx context.Context) error {
 }
 
 func (db *db) Drop(ctx context.Context) error {
+	if err := db.idempotencyKeysCollection(ctx).Drop(ctx); err != nil {
+		return mongoError(err)
+	}
+	if err := db.paymentVersionsCollection(ctx).Drop(ctx); err != nil {
+		return mongoError(err)
+	}
+	if err := db.subscriptionsCollection(ctx).Drop(ctx); err != nil {
+		return mongoError(err)
+	}
+	if err := db.webhookDeliveriesCollection(ctx).Drop(ctx); err != nil {
+		return mongoError(err)
+	}
 	return db.paymentsCollection(ctx).Drop(ctx)
 }
 
-func (db *db) GetPayments(ctx context.Context, size int, after *ID) (*[]PaymentSummary, error) {
-	opts := options.FindOptions{
-		Projection: bson.M{"_id": 1},
-		Sort:       bson.M{"_id": 1},
-	}
+// mongoSortFields maps sort fields to the document fields of the payments
+// pipeline
+var mongoSortFields = map[string]string{
+	PaymentSortID:             "_id",
+	PaymentSortProcessingDate: "attributes.processing_date",
+	PaymentSortAmount:         "amount_value",
+}
+
+func mongoPaymentFilter(query PaymentQuery) (bson.M, error) {
+	f := query.Filter
 	filter := bson.M{}
-	if after != nil {
-		filter["_id"] = bson.M{
-			"$gt": *after,
+	if !query.IncludeDeleted {
+		filter["deleted_at"] = nil
+	}
+	eq := func(field string, value string) {
+		if value != "" {
+			filter[field] = value
+		}
+	}
+	eq("organisation_id", f.OrganisationID)
+	if f.Status != "" {
+		filter["status"] = mongoStatusFilter([]string{f.Status})
+	}
+	eq("attributes.currency", f.Currency)
+	eq("attributes.payment_scheme", f.PaymentScheme)
+	eq("attributes.payment_type", f.PaymentType)
+	eq("attributes.debtor_party.account_number", f.DebtorAccountNumber)
+	eq("attributes.beneficiary_party.account_number", f.BeneficiaryAccountNumber)
+	dates := bson.M{}
+	if f.ProcessingDateFrom != "" {
+		dates["$gte"] = f.ProcessingDateFrom
+	}
+	if f.ProcessingDateTo != "" {
+		dates["$lte"] = f.ProcessingDateTo
+	}
+	if len(dates) > 0 {
+		filter["attributes.processing_date"] = dates
+	}
+	amounts := bson.M{}
+	if f.AmountMin != "" {
+		v, err := primitive.ParseDecimal128(f.AmountMin)
+		if err != nil {
+			return nil, &DbError{Kind: ErrInvalid, Err: err}
+		}
+		amounts["$gte"] = v
+	}
+	if f.AmountMax != "" {
+		v, err := primitive.ParseDecimal128(f.AmountMax)
+		if err != nil {
+			return nil, &DbError{Kind: ErrInvalid, Err: err}
+		}
+		amounts["$lte"] = v
+	}
+	if len(amounts) > 0 {
+		filter["amount_value"] = amounts
+	}
+	return filter, nil
+}
+
+func mongoProjection(query PaymentQuery) bson.M {
+	projection := bson.M{"_id": 1}
+	for _, f := range query.Fields {
+		projection[f] = 1
+	}
+	return projection
+}
+
+func (db *db) GetPayments(ctx context.Context, query PaymentQuery) (*[]Payment, error) {
+	var ok bool
+	if query.Filter, ok = scopePaymentFilter(ctx, query.Filter); !ok {
+		return &[]Payment{}, nil
+	}
+	filter, err := mongoPaymentFilter(query)
+	if err != nil {
+		return nil, mongoError(err)
+	}
+	sortField := mongoSortFields[query.Sort]
+	if sortField == "" {
+		sortField = "_id"
+	}
+	op, direction := "$gt", 1
+	if query.Descending {
+		op, direction = "$lt", -1
+	}
+	if query.After != nil && sortField == "_id" {
+		filter["_id"] = bson.M{op: *query.After}
+	} else if query.After != nil {
+		// Continue after the sort value of the last payment of the previous page
+		after, err := db.GetPaymentByID(ctx, *query.After, true)
+		if ErrorKind(err) == ErrNotFound {
+			return &[]Payment{}, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		var value interface{} = query.sortValue(*after)
+		if query.Sort == PaymentSortAmount {
+			if value, err = primitive.ParseDecimal128(after.Attributes.Amount); err != nil {
+				return nil, &DbError{Kind: ErrInvalid, Err: err}
+			}
+		}
+		filter["$or"] = bson.A{
+			bson.M{sortField: bson.M{op: value}},
+			bson.M{sortField: value, "_id": bson.M{op: *query.After}},
 		}
 	}
-	cur, err := db.paymentsCollection(ctx).Find(ctx, filter, &opts)
+	var pipeline []bson.M
+	if _, ok := filter["amount_value"]; ok || sortField == "amount_value" {
+		pipeline = append(pipeline, bson.M{"$addFields": bson.M{
+			"amount_value": bson.M{"$convert": bson.M{
+				"input":   "$attributes.amount",
+				"to":      "decimal",
+				"onError": nil,
+				"onNull":  nil,
+			}},
+		}})
+	}
+	sort := bson.D{{Key: sortField, Value: direction}}
+	if sortField != "_id" {
+		sort = append(sort, bson.E{Key: "_id", Value: direction})
+	}
+	pipeline = append(pipeline,
+		bson.M{"$match": filter},
+		bson.M{"$sort": sort},
+		bson.M{"$limit": query.Size},
+		bson.M{"$project": mongoProjection(query)},
+	)
+	cur, err := db.paymentsCollection(ctx).Aggregate(ctx, pipeline)
 	if err != nil {
-		logger.Fatal(err)
+		return nil, mongoError(err)
 	}
 	defer cur.Close(ctx)
-	var res []PaymentSummary
+	var res []Payment
 	for cur.Next(ctx) {
-		var elm PaymentSummary
+		var elm Payment
 		err = cur.Decode(&elm)
 		if err != nil {
-			return nil, err
+			return nil, mongoError(err)
 		}
-		res = append(res, elm)
-		if len(res) >= size {
-			break
+		if query.hasField(PaymentFieldStatus) {
+			mongoPaymentStatus(&elm)
 		}
+		res = append(res, elm)
 	}
-	return &res, nil
+	return &res, mongoError(cur.Err())
 }
 
-func (db *db) GetPaymentByID(ctx context.Context, id ID) (*Payment, error) {
-	res := db.paymentsCollection(ctx).FindOne(ctx, bson.M{"_id": id})
+func (db *db) GetPaymentByID(ctx context.Context, id ID, includeDeleted bool) (*Payment, error) {
+	filter := bson.M{"_id": id}
+	if !includeDeleted {
+		filter["deleted_at"] = nil
+	}
+	if org := contextOrganisation(ctx); org != "" {
+		filter["organisation_id"] = org
+	}
+	res := db.paymentsCollection(ctx).FindOne(ctx, filter)
 	payment := Payment{}
-	err := res.Decode(&payment)
-	if err == mongo.ErrNoDocuments {
-		return nil, nil
+	if err := res.Decode(&payment); err != nil {
+		return nil, mongoError(err)
 	}
+	mongoPaymentStatus(&payment)
 	return &payment, nil
 }
 
-// NewDb constructs a new Db wrapper
+// NewDb constructs a new Db wrapper using the configured storage driver
 func NewDb(config *Config) (Db, error) {
-	client, err := mongo.NewClient(options.Client().ApplyURI(config.MongoDbURI))
-	return &db{Client: client}, err
+	switch config.StorageDriver {
+	case StorageDriverMongo:
+		return NewMongoDb(config)
+	case StorageDriverPostgres:
+		return NewPostgresDb(config)
+	case StorageDriverMemory:
+		return NewMemoryDb(), nil
+	}
+	return nil, fmt.Errorf("unknown storage driver %q", config.StorageDriver)
+}
+
+// MongoClientOptions returns the options of the client of the MongoDB
+// database. Settings of the configuration override options of the URI,
+// unless they are zero. Options set by neither keep the default of the
+// driver.
+func MongoClientOptions(config *Config) (*options.ClientOptions, error) {
+	opts := options.Client().ApplyURI(config.MongoDbURI)
+	if config.MongoDbRetryWrites != nil {
+		opts.SetRetryWrites(*config.MongoDbRetryWrites)
+	}
+	if config.MongoDbMaxPoolSize > 0 {
+		opts.SetMaxPoolSize(uint64(config.MongoDbMaxPoolSize))
+	}
+	if config.MongoDbMinPoolSize > 0 {
+		opts.SetMinPoolSize(uint64(config.MongoDbMinPoolSize))
+	}
+	if config.MongoDbServerSelectionTimeout > 0 {
+		opts.SetServerSelectionTimeout(config.MongoDbServerSelectionTimeout)
+	}
+	if config.MongoDbReadPreference != "" {
+		mode, err := readpref.ModeFromString(config.MongoDbReadPreference)
+		if err != nil {
+			return nil, err
+		}
+		pref, err := readpref.New(mode)
+		if err != nil {
+			return nil, err
+		}
+		opts.SetReadPreference(pref)
+	}
+	switch config.MongoDbWriteConcern {
+	case "":
+	case MongoDbWriteConcernMajority:
+		opts.SetWriteConcern(writeconcern.New(writeconcern.WMajority()))
+	default:
+		w, err := strconv.Atoi(config.MongoDbWriteConcern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid write concern %q", config.MongoDbWriteConcern)
+		}
+		opts.SetWriteConcern(writeconcern.New(writeconcern.W(w)))
+	}
+	return opts, nil
+}
+
+// NewMongoDb constructs a new Db backed by MongoDB
+func NewMongoDb(config *Config) (Db, error) {
+	opts, err := MongoClientOptions(config)
+	if err != nil {
+		return nil, err
+	}
+	client, err := mongo.NewClient(opts)
+	return &db{Client: client, collection: func(ctx context.Context, name string) MongoCollection {
+		conf := ctx.Value(ContextConfig).(*Config)
+		return client.Database(conf.MongoDbDatabase).Collection(name)
+	}}, err
+}
+
+// NewMongoDbOfCollections constructs a Db of the collections returned by the
+// function instead of those of a client, e.g. to simulate driver failures
+func NewMongoDbOfCollections(collection func(ctx context.Context, name string) MongoCollection) Db {
+	return &db{collection: collection}
 }
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Kinds of errors returned by Db implementations. An error of a kind is
+// either the kind itself or a *DbError of the kind, see ErrorKind.
+var (
+	// ErrNotFound is returned when the requested entity does not exist
+	ErrNotFound = errors.New("not found")
+	// ErrConflict is returned when a modification conflicts with the stored
+	// state, e.g. on duplicate keys
+	ErrConflict = errors.New("conflict")
+	// ErrUnavailable is returned when the database can not be reached, or
+	// does not respond in time
+	ErrUnavailable = errors.New("database unavailable")
+	// ErrInvalid is returned when the arguments of an operation are rejected
+	// by the database
+	ErrInvalid = errors.New("invalid argument")
+)
+
+// DbError is a failed database operation of a kind
+type DbError struct {
+	Kind error
+	// Err is the error of the driver
+	Err error
+}
+
+func (e *DbError) Error() string {
+	return fmt.Sprintf("%v: %v", e.Kind, e.Err)
+}
+
+// Is reports whether the error is of the kind
+func (e *DbError) Is(target error) bool {
+	return e.Kind == target
+}
+
+// Unwrap returns the error of the driver
+func (e *DbError) Unwrap() error {
+	return e.Err
+}
+
+// ErrorKind returns the kind of an error returned by a Db, or nil for errors
+// of no known kind. Rejected modifications of payments are conflicts. Errors
+// wrapping an error of a kind are of the kind.
+func ErrorKind(err error) error {
+	var dbErr *DbError
+	if errors.As(err, &dbErr) {
+		return dbErr.Kind
+	}
+	var versionConflict *VersionConflictError
+	var invalidTransition *InvalidTransitionError
+	var paymentLocked *PaymentLockedError
+	if errors.As(err, &versionConflict) || errors.As(err, &invalidTransition) || errors.As(err, &paymentLocked) {
+		return ErrConflict
+	}
+	for _, kind := range []error{ErrNotFound, ErrConflict, ErrUnavailable, ErrInvalid} {
+		if errors.Is(err, kind) {
+			return kind
+		}
+	}
+	return nil
+}
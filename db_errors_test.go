@@ -0,0 +1,219 @@
+package main_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	. "./"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// fakeCollection fails every operation with the error. Found documents are
+// the document.
+type fakeCollection struct {
+	MongoCollection
+	err      error
+	document interface{}
+}
+
+func (c fakeCollection) InsertOne(ctx context.Context, document interface{}, opts ...*options.InsertOneOptions) (*mongo.InsertOneResult, error) {
+	return nil, c.err
+}
+
+func (c fakeCollection) FindOne(ctx context.Context, filter interface{}, opts ...*options.FindOneOptions) *mongo.SingleResult {
+	document := c.document
+	if document == nil {
+		document = bson.M{}
+	}
+	return mongo.NewSingleResultFromDocument(document, c.err, nil)
+}
+
+func (c fakeCollection) Aggregate(ctx context.Context, pipeline interface{}, opts ...*options.AggregateOptions) (*mongo.Cursor, error) {
+	return nil, c.err
+}
+
+// insertingCollection stores the inserted documents
+type insertingCollection struct {
+	MongoCollection
+	documents *[]bson.M
+}
+
+func (c insertingCollection) InsertOne(ctx context.Context, document interface{}, opts ...*options.InsertOneOptions) (*mongo.InsertOneResult, error) {
+	raw, err := bson.Marshal(document)
+	if err != nil {
+		return nil, err
+	}
+	doc := bson.M{}
+	if err = bson.Unmarshal(raw, &doc); err != nil {
+		return nil, err
+	}
+	*c.documents = append(*c.documents, doc)
+	return &mongo.InsertOneResult{InsertedID: doc["_id"]}, nil
+}
+
+// updatingCollection finds the document and stores the updates matching it
+type updatingCollection struct {
+	fakeCollection
+	updates *[]bson.M
+}
+
+func (c updatingCollection) UpdateOne(ctx context.Context, filter interface{}, update interface{}, opts ...*options.UpdateOptions) (*mongo.UpdateResult, error) {
+	*c.updates = append(*c.updates, update.(bson.M))
+	return &mongo.UpdateResult{MatchedCount: 1, ModifiedCount: 1}, nil
+}
+
+var _ = Describe("DbErrors", func() {
+	fakeDb := func(collection fakeCollection) Db {
+		return NewMongoDbOfCollections(func(ctx context.Context, name string) MongoCollection {
+			return collection
+		})
+	}
+
+	Describe("Mongo", func() {
+		It("should not find missing payments", func() {
+			payment, err := fakeDb(fakeCollection{err: mongo.ErrNoDocuments}).GetPaymentByID(testCtx, *id, false)
+			Expect(err).To(Equal(ErrNotFound))
+			Expect(payment).To(BeNil())
+		})
+
+		It("should return errors decoding payments", func() {
+			payment, err := fakeDb(fakeCollection{document: bson.M{"version": "one"}}).GetPaymentByID(testCtx, *id, false)
+			Expect(err).ToNot(BeNil())
+			Expect(ErrorKind(err)).To(BeNil())
+			Expect(payment).To(BeNil())
+		})
+
+		It("should return conflicts on duplicate keys", func() {
+			driverErr := mongo.WriteException{WriteErrors: []mongo.WriteError{{Code: 11000, Message: "E11000 duplicate key"}}}
+			_, err := fakeDb(fakeCollection{err: driverErr}).CreatePayment(testCtx, "org", paymentSample.Attributes)
+			Expect(ErrorKind(err)).To(Equal(ErrConflict))
+			Expect(err.(*DbError).Err).To(Equal(driverErr))
+		})
+
+		It("should return unavailable on network errors", func() {
+			driverErr := mongo.CommandError{Message: "connection reset", Labels: []string{"NetworkError"}}
+			_, err := fakeDb(fakeCollection{err: driverErr}).CreatePayment(testCtx, "org", paymentSample.Attributes)
+			Expect(ErrorKind(err)).To(Equal(ErrUnavailable))
+		})
+
+		It("should store payments whose version can not be moved", func() {
+			var documents []bson.M
+			db := NewMongoDbOfCollections(func(ctx context.Context, name string) MongoCollection {
+				if name == "payments" {
+					return insertingCollection{documents: &documents}
+				}
+				return fakeCollection{err: context.DeadlineExceeded}
+			})
+			paymentID, err := db.CreatePayment(testCtx, "org", paymentSample.Attributes)
+			Expect(err).To(BeNil())
+			Expect(documents).To(HaveLen(1))
+			Expect(documents[0]["_id"]).To(Equal(*paymentID))
+			Expect(documents[0]["pending_versions"]).To(HaveLen(1))
+		})
+
+		It("should update payments whose version can not be moved", func() {
+			var updates []bson.M
+			db := NewMongoDbOfCollections(func(ctx context.Context, name string) MongoCollection {
+				if name == "payments" {
+					return updatingCollection{fakeCollection: fakeCollection{document: paymentSample}, updates: &updates}
+				}
+				return fakeCollection{err: context.DeadlineExceeded}
+			})
+			err := db.UpdatePaymentStatus(testCtx, paymentSample.ID, paymentSample.Version, PaymentStatusPendingSubmission)
+			Expect(err).To(BeNil())
+			Expect(updates).To(HaveLen(1))
+			Expect(updates[0]["$set"]).To(HaveKeyWithValue("version", paymentSample.Version+1))
+			Expect(updates[0]["$set"]).To(HaveKeyWithValue("status", PaymentStatusPendingSubmission))
+			Expect(updates[0]["$push"]).To(HaveKey("pending_versions"))
+		})
+
+		It("should return unavailable on timeouts", func() {
+			_, err := fakeDb(fakeCollection{err: context.DeadlineExceeded}).GetPayments(testCtx, PaymentQuery{Size: 10})
+			Expect(ErrorKind(err)).To(Equal(ErrUnavailable))
+		})
+
+		It("should return invalid after payments of invalid amounts", func() {
+			after := paymentSample
+			after.Attributes.Amount = "ten"
+			_, err := fakeDb(fakeCollection{document: after}).GetPayments(testCtx, PaymentQuery{Size: 10,
+				Sort: PaymentSortAmount, After: &after.ID})
+			Expect(ErrorKind(err)).To(Equal(ErrInvalid))
+		})
+
+		It("should return unavailable on cancelled operations", func() {
+			_, err := fakeDb(fakeCollection{err: fmt.Errorf("failed to find: %w", context.Canceled)}).
+				GetPayments(testCtx, PaymentQuery{Size: 10})
+			Expect(ErrorKind(err)).To(Equal(ErrUnavailable))
+		})
+
+		It("should return invalid on invalid amounts", func() {
+			_, err := fakeDb(fakeCollection{}).GetPayments(testCtx, PaymentQuery{Size: 10,
+				Filter: PaymentFilter{AmountMin: "ten"}})
+			Expect(ErrorKind(err)).To(Equal(ErrInvalid))
+		})
+	})
+
+	It("should consider rejected modifications conflicts", func() {
+		Expect(ErrorKind(&VersionConflictError{Version: 1})).To(Equal(ErrConflict))
+		Expect(ErrorKind(&PaymentLockedError{Status: PaymentStatusSubmitted})).To(Equal(ErrConflict))
+		Expect(ErrorKind(errors.New("unavailable"))).To(BeNil())
+	})
+
+	It("should return the kind of wrapped errors", func() {
+		wrapped := &DbError{Kind: ErrUnavailable, Err: context.DeadlineExceeded}
+		Expect(ErrorKind(fmt.Errorf("failed to fetch payment: %w", wrapped))).To(Equal(ErrUnavailable))
+		Expect(ErrorKind(fmt.Errorf("failed to update payment: %w", &VersionConflictError{Version: 1}))).
+			To(Equal(ErrConflict))
+		Expect(ErrorKind(fmt.Errorf("failed to fetch payment: %w", ErrNotFound))).To(Equal(ErrNotFound))
+		Expect(ErrorKind(fmt.Errorf("failed to fetch payment: %v", ErrNotFound))).To(BeNil())
+	})
+
+	Describe("responses", func() {
+		respond := func(err error) (int, string) {
+			ctx := context.WithValue(testCtx, ContextDb, mockDb{Payments: []Payment{paymentSample}, error: err})
+			w := performRequest(ctx, "GET", "/v1/payments/5cdd382e9549af35c3b94301/versions")
+			body, _ := ioutil.ReadAll(w.Body)
+			return w.Code, string(body)
+		}
+
+		It("should map kinds of errors to statuses", func() {
+			for _, c := range []struct {
+				err    error
+				status int
+			}{
+				{ErrNotFound, http.StatusNotFound},
+				{&DbError{Kind: ErrConflict, Err: errors.New("duplicate")}, http.StatusConflict},
+				{&DbError{Kind: ErrInvalid, Err: errors.New("bad")}, http.StatusBadRequest},
+				{&DbError{Kind: ErrUnavailable, Err: errors.New("timeout")}, http.StatusServiceUnavailable},
+				{errors.New("unknown"), http.StatusInternalServerError},
+			} {
+				code, _ := respond(c.err)
+				Expect(code).To(Equal(c.status), c.err.Error())
+			}
+		})
+
+		It("should map wrapped errors to statuses", func() {
+			code, body := respond(fmt.Errorf("failed to update payment: %w", &VersionConflictError{Version: 2}))
+			Expect(code).To(Equal(http.StatusConflict))
+			Expect(body).To(MatchJSON(`{"code": "version_conflict", "message": "Conflict", "version": 2}`))
+			code, body = respond(fmt.Errorf("failed to update payment: %w",
+				&PaymentLockedError{Status: PaymentStatusSubmitted}))
+			Expect(code).To(Equal(http.StatusConflict))
+			Expect(body).To(ContainSubstring(`"code":"payment_locked"`))
+		})
+
+		It("should respond with the code of the kind", func() {
+			_, body := respond(&DbError{Kind: ErrConflict, Err: errors.New("duplicate")})
+			Expect(body).To(MatchJSON(`{"code": "conflict", "message": "Request conflicts with the current state"}`))
+			_, body = respond(ErrUnavailable)
+			Expect(body).To(MatchJSON(`{"code": "unavailable", "message": "Service Unavailable"}`))
+		})
+	})
+})
@@ -3,105 +3,552 @@
 package main_test
 
 import (
+	"context"
+	"time"
+
 	. "./"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 )
 
 var _ = Describe("DbIntegration", func() {
-	BeforeEach(func() {
-		_ = db.(TestDb).Drop(testCtx)
-	})
+	for _, backend := range testBackends {
+		backend := backend
+		db := backend.Db
+		ctx := backend.Ctx
+		testerCtx := context.WithValue(ctx, ContextActor, "tester")
 
-	Describe("GetPayments", func() {
-		BeforeEach(func() {
-			_ = db.(TestDb).Drop(testCtx)
-			_ = populateDatabase(100)
-		})
-		It("should list all payments", func() {
-			res, err := db.GetPayments(testCtx, 150, nil)
-			Expect(err).To(BeNil())
-			Expect(*res).To(HaveLen(100))
-		})
-		It("should limit the output", func() {
-			res, err := db.GetPayments(testCtx, 10, nil)
-			Expect(err).To(BeNil())
-			Expect(*res).To(HaveLen(10))
-		})
-		It("should fetch after", func() {
-			res1, err := db.GetPayments(testCtx, 100, nil)
-			Expect(err).To(BeNil())
-			Expect(*res1).To(HaveLen(100))
-			id := (*res1)[10].ID
-			res2, err := db.GetPayments(testCtx, 2, &id)
-			Expect(err).To(BeNil())
-			Expect(*res2).To(Equal([]PaymentSummary{
-				{
-					ID: (*res1)[11].ID,
-				},
-				{
-					ID: (*res1)[12].ID,
-				},
-			}))
-		})
-	})
+		Describe(backend.Name, func() {
+			BeforeEach(func() {
+				_ = db.Drop(ctx)
+			})
 
-	Describe("CreatePayment", func() {
-		It("should create and return id", func() {
-			orgId := "org"
-			id, err := db.CreatePayment(testCtx, orgId, paymentSample.Attributes)
-			Expect(err).To(BeNil())
-			Expect(id).ToNot(BeNil())
-		})
-		It("should be possible to fetch newly created resource", func() {
-			orgId := "org"
-			id, err := db.CreatePayment(testCtx, orgId, paymentSample.Attributes)
-			Expect(err).To(BeNil())
-			Expect(id).ToNot(BeNil())
-			payment, _ := db.GetPaymentByID(testCtx, *id)
-			Expect(*payment).To(Equal(Payment{
-				ID:             *id,
-				OrganisationID: orgId,
-				Version:        0,
-				Attributes:     paymentSample.Attributes,
-			}))
-		})
-	})
-	Describe("UpdatePayment", func() {
-		It("should update organization", func() {
-			id, _ := db.CreatePayment(testCtx, paymentSample.OrganisationID, paymentSample.Attributes)
-			err := db.UpdatePayment(testCtx, *id, "org", paymentSample.Attributes)
-			Expect(err).To(BeNil())
-			payment, _ := db.GetPaymentByID(testCtx, *id)
-			Expect(*payment).To(Equal(Payment{
-				Version:        1,
-				OrganisationID: "org",
-				Attributes:     paymentSample.Attributes,
-				ID:             *id,
-			}))
-		})
-		It("should update on non-existing-id", func() {
-			id, _ := StringToID("aaaaaaaaaaaaaaaaaaaaaaaa")
-			err := db.UpdatePayment(testCtx, *id, "org", paymentSample.Attributes)
-			Expect(err).To(BeNil())
-			payment, _ := db.GetPaymentByID(testCtx, *id)
-			Expect(payment).To(BeNil())
-		})
-	})
-	Describe("DeletePayment", func() {
-		It("should delete an existing payment", func() {
-			id, _ := db.CreatePayment(testCtx, paymentSample.OrganisationID, paymentSample.Attributes)
-			err := db.DeletePayment(testCtx, *id)
-			Expect(err).To(BeNil())
-			payment, _ := db.GetPaymentByID(testCtx, *id)
-			Expect(payment).To(BeNil())
-		})
-		It("should delete a non-existing-id without failure", func() {
-			id, _ := StringToID("aaaaaaaaaaaaaaaaaaaaaaaa")
-			err := db.UpdatePayment(testCtx, *id, "org", paymentSample.Attributes)
-			Expect(err).To(BeNil())
-			payment, _ := db.GetPaymentByID(testCtx, *id)
-			Expect(payment).To(BeNil())
+			Describe("GetPayments", func() {
+				BeforeEach(func() {
+					_ = db.Drop(ctx)
+					_ = populateDatabase(backend, 100)
+				})
+				It("should list all payments", func() {
+					res, err := db.GetPayments(ctx, PaymentQuery{Size: 150})
+					Expect(err).To(BeNil())
+					Expect(*res).To(HaveLen(100))
+				})
+				It("should limit the output", func() {
+					res, err := db.GetPayments(ctx, PaymentQuery{Size: 10})
+					Expect(err).To(BeNil())
+					Expect(*res).To(HaveLen(10))
+				})
+				It("should fetch after", func() {
+					res1, err := db.GetPayments(ctx, PaymentQuery{Size: 100})
+					Expect(err).To(BeNil())
+					Expect(*res1).To(HaveLen(100))
+					id := (*res1)[10].ID
+					res2, err := db.GetPayments(ctx, PaymentQuery{Size: 2, After: &id})
+					Expect(err).To(BeNil())
+					Expect(*res2).To(Equal([]Payment{
+						{
+							ID: (*res1)[11].ID,
+						},
+						{
+							ID: (*res1)[12].ID,
+						},
+					}))
+				})
+			})
+
+			Describe("GetPayments with filter and sort", func() {
+				var ids []ID
+				amounts := []string{"10.00", "9.50", "100.21", "9.50"}
+				dates := []string{"2019-01-03", "2019-01-01", "2019-01-02", "2019-01-04"}
+				BeforeEach(func() {
+					_ = db.Drop(ctx)
+					ids = make([]ID, len(amounts))
+					for i := range amounts {
+						attributes := paymentSample.Attributes
+						attributes.Amount = amounts[i]
+						attributes.ProcessingDate = dates[i]
+						if i%2 == 1 {
+							attributes.Currency = "USD"
+						}
+						id, _ := db.CreatePayment(ctx, paymentSample.OrganisationID, attributes)
+						ids[i] = *id
+					}
+				})
+				list := func(query PaymentQuery) []ID {
+					query.Size = IntMax(query.Size, 10)
+					res, err := db.GetPayments(ctx, query)
+					Expect(err).To(BeNil())
+					listed := []ID{}
+					for _, v := range *res {
+						listed = append(listed, v.ID)
+					}
+					return listed
+				}
+				It("should filter by currency", func() {
+					Expect(list(PaymentQuery{Filter: PaymentFilter{Currency: "USD"}})).To(Equal([]ID{ids[1], ids[3]}))
+				})
+				It("should filter by organisation", func() {
+					Expect(list(PaymentQuery{Filter: PaymentFilter{OrganisationID: "other"}})).To(BeEmpty())
+				})
+				It("should filter by amount range", func() {
+					Expect(list(PaymentQuery{Filter: PaymentFilter{AmountMin: "9.5", AmountMax: "10"}})).To(Equal([]ID{ids[0], ids[1], ids[3]}))
+				})
+				It("should filter by processing date range", func() {
+					Expect(list(PaymentQuery{Filter: PaymentFilter{
+						ProcessingDateFrom: "2019-01-02",
+						ProcessingDateTo:   "2019-01-03",
+					}})).To(Equal([]ID{ids[0], ids[2]}))
+				})
+				It("should sort by amount numerically", func() {
+					Expect(list(PaymentQuery{Sort: PaymentSortAmount})).To(Equal([]ID{ids[1], ids[3], ids[0], ids[2]}))
+				})
+				It("should sort descending", func() {
+					Expect(list(PaymentQuery{Sort: PaymentSortAmount, Descending: true})).To(Equal([]ID{ids[2], ids[0], ids[3], ids[1]}))
+				})
+				It("should page through sorted and filtered payments", func() {
+					query := PaymentQuery{
+						Filter:     PaymentFilter{AmountMax: "50"},
+						Sort:       PaymentSortProcessingDate,
+						Descending: true,
+						Size:       1,
+					}
+					var listed []ID
+					for i := 0; i < 5; i++ {
+						res, err := db.GetPayments(ctx, query)
+						Expect(err).To(BeNil())
+						if len(*res) == 0 {
+							break
+						}
+						listed = append(listed, (*res)[0].ID)
+						query.After = &(*res)[0].ID
+					}
+					Expect(listed).To(Equal([]ID{ids[3], ids[0], ids[1]}))
+				})
+			})
+
+			Describe("GetPayments with fields", func() {
+				var id *ID
+				BeforeEach(func() {
+					id, _ = db.CreatePayment(ctx, paymentSample.OrganisationID, paymentSample.Attributes)
+				})
+				It("should only return ids without fields", func() {
+					res, err := db.GetPayments(ctx, PaymentQuery{Size: 1})
+					Expect(err).To(BeNil())
+					Expect(*res).To(Equal([]Payment{{ID: *id}}))
+				})
+				It("should return full payments with all attributes", func() {
+					res, err := db.GetPayments(ctx, PaymentQuery{Size: 1, Fields: []string{
+						PaymentFieldOrganisationID, PaymentFieldVersion, PaymentFieldAttributes}})
+					Expect(err).To(BeNil())
+					Expect(*res).To(Equal([]Payment{{
+						ID:             *id,
+						OrganisationID: paymentSample.OrganisationID,
+						Attributes:     paymentSample.Attributes,
+					}}))
+				})
+				It("should return only the requested attributes", func() {
+					res, err := db.GetPayments(ctx, PaymentQuery{Size: 1, Fields: []string{
+						PaymentFieldAttributePrefix + "amount", PaymentFieldAttributePrefix + "debtor_party"}})
+					Expect(err).To(BeNil())
+					Expect(*res).To(Equal([]Payment{{
+						ID: *id,
+						Attributes: PaymentAttributes{
+							Amount:      paymentSample.Attributes.Amount,
+							DebtorParty: paymentSample.Attributes.DebtorParty,
+						},
+					}}))
+				})
+			})
+
+			Describe("CreatePayment", func() {
+				It("should create and return id", func() {
+					orgId := "org"
+					id, err := db.CreatePayment(ctx, orgId, paymentSample.Attributes)
+					Expect(err).To(BeNil())
+					Expect(id).ToNot(BeNil())
+				})
+				It("should be possible to fetch newly created resource", func() {
+					orgId := "org"
+					id, err := db.CreatePayment(ctx, orgId, paymentSample.Attributes)
+					Expect(err).To(BeNil())
+					Expect(id).ToNot(BeNil())
+					payment, _ := db.GetPaymentByID(ctx, *id, false)
+					Expect(*payment).To(Equal(Payment{
+						ID:             *id,
+						OrganisationID: orgId,
+						Version:        0,
+						Status:         PaymentStatusCreated,
+						Attributes:     paymentSample.Attributes,
+					}))
+				})
+			})
+			Describe("UpdatePayment", func() {
+				It("should update organization", func() {
+					id, _ := db.CreatePayment(ctx, paymentSample.OrganisationID, paymentSample.Attributes)
+					err := db.UpdatePayment(ctx, *id, "org", 0, paymentSample.Attributes)
+					Expect(err).To(BeNil())
+					payment, _ := db.GetPaymentByID(ctx, *id, false)
+					Expect(*payment).To(Equal(Payment{
+						Version:        1,
+						Status:         PaymentStatusCreated,
+						OrganisationID: "org",
+						Attributes:     paymentSample.Attributes,
+						ID:             *id,
+					}))
+				})
+				It("should fail on version conflict", func() {
+					id, _ := db.CreatePayment(ctx, paymentSample.OrganisationID, paymentSample.Attributes)
+					_ = db.UpdatePayment(ctx, *id, "org", 0, paymentSample.Attributes)
+					err := db.UpdatePayment(ctx, *id, "org2", 0, paymentSample.Attributes)
+					Expect(err).To(Equal(&VersionConflictError{Version: 1}))
+					payment, _ := db.GetPaymentByID(ctx, *id, false)
+					Expect(payment.OrganisationID).To(Equal("org"))
+					Expect(payment.Version).To(Equal(1))
+				})
+				It("should not update non-existing ids", func() {
+					id, _ := StringToID("aaaaaaaaaaaaaaaaaaaaaaaa")
+					err := db.UpdatePayment(ctx, *id, "org", 0, paymentSample.Attributes)
+					Expect(err).To(Equal(ErrNotFound))
+					payment, err := db.GetPaymentByID(ctx, *id, false)
+					Expect(err).To(Equal(ErrNotFound))
+					Expect(payment).To(BeNil())
+				})
+			})
+			Describe("IdempotencyKey", func() {
+				key := IdempotencyKey{OrganisationID: paymentSample.OrganisationID, Key: "key"}
+				record := func(hash string, ttl time.Duration) IdempotencyRecord {
+					return IdempotencyRecord{ID: key, RequestHash: hash, ExpiresAt: time.Now().Add(ttl)}
+				}
+				It("should reserve an unused key", func() {
+					existing, err := db.ReserveIdempotencyKey(ctx, record("hash", time.Hour))
+					Expect(err).To(BeNil())
+					Expect(existing).To(BeNil())
+				})
+				It("should return the saved response of a reserved key", func() {
+					r := record("hash", time.Hour)
+					_, _ = db.ReserveIdempotencyKey(ctx, r)
+					r.Status = 201
+					r.Body = []byte("{}")
+					Expect(db.SaveIdempotencyKey(ctx, r)).To(Succeed())
+					existing, err := db.ReserveIdempotencyKey(ctx, record("other", time.Hour))
+					Expect(err).To(BeNil())
+					Expect(existing.RequestHash).To(Equal("hash"))
+					Expect(existing.Status).To(Equal(201))
+					Expect(existing.Body).To(Equal([]byte("{}")))
+				})
+				It("should reserve expired keys again", func() {
+					_, _ = db.ReserveIdempotencyKey(ctx, record("hash", -time.Second))
+					existing, err := db.ReserveIdempotencyKey(ctx, record("hash", time.Hour))
+					Expect(err).To(BeNil())
+					Expect(existing).To(BeNil())
+				})
+				It("should reserve released keys again", func() {
+					_, _ = db.ReserveIdempotencyKey(ctx, record("hash", time.Hour))
+					Expect(db.ReleaseIdempotencyKey(ctx, key)).To(Succeed())
+					existing, err := db.ReserveIdempotencyKey(ctx, record("hash", time.Hour))
+					Expect(err).To(BeNil())
+					Expect(existing).To(BeNil())
+				})
+				It("should scope keys by organisation", func() {
+					_, _ = db.ReserveIdempotencyKey(ctx, record("hash", time.Hour))
+					other := record("hash", time.Hour)
+					other.ID.OrganisationID = "other"
+					existing, err := db.ReserveIdempotencyKey(ctx, other)
+					Expect(err).To(BeNil())
+					Expect(existing).To(BeNil())
+				})
+			})
+
+			Describe("UpdatePaymentStatus", func() {
+				// submitted creates a payment and submits it
+				submitted := func() *ID {
+					id, _ := db.CreatePayment(ctx, paymentSample.OrganisationID, paymentSample.Attributes)
+					Expect(db.UpdatePaymentStatus(ctx, *id, 0, PaymentStatusPendingSubmission)).To(Succeed())
+					Expect(db.UpdatePaymentStatus(ctx, *id, 1, PaymentStatusSubmitted)).To(Succeed())
+					return id
+				}
+				It("should transition and increment version", func() {
+					id := submitted()
+					Expect(db.UpdatePaymentStatus(ctx, *id, 2, PaymentStatusAccepted)).To(Succeed())
+					payment, _ := db.GetPaymentByID(ctx, *id, false)
+					Expect(payment.Status).To(Equal(PaymentStatusAccepted))
+					Expect(payment.Version).To(Equal(3))
+				})
+				It("should fail on invalid transition", func() {
+					id, _ := db.CreatePayment(ctx, paymentSample.OrganisationID, paymentSample.Attributes)
+					err := db.UpdatePaymentStatus(ctx, *id, 0, PaymentStatusAccepted)
+					Expect(err).To(Equal(&InvalidTransitionError{From: PaymentStatusCreated, To: PaymentStatusAccepted}))
+				})
+				It("should fail on version conflict", func() {
+					id, _ := db.CreatePayment(ctx, paymentSample.OrganisationID, paymentSample.Attributes)
+					err := db.UpdatePaymentStatus(ctx, *id, 1, PaymentStatusCancelled)
+					Expect(err).To(Equal(&VersionConflictError{Version: 0}))
+				})
+				It("should reject updates once submitted", func() {
+					id := submitted()
+					err := db.UpdatePayment(ctx, *id, "org", 2, paymentSample.Attributes)
+					Expect(err).To(Equal(&PaymentLockedError{Status: PaymentStatusSubmitted}))
+				})
+				It("should reject deletes once submitted", func() {
+					id := submitted()
+					err := db.DeletePayment(testerCtx, *id)
+					Expect(err).To(Equal(&PaymentLockedError{Status: PaymentStatusSubmitted}))
+					payment, _ := db.GetPaymentByID(ctx, *id, false)
+					Expect(payment).ToNot(BeNil())
+				})
+				It("should filter by status", func() {
+					id := submitted()
+					_, _ = db.CreatePayment(ctx, paymentSample.OrganisationID, paymentSample.Attributes)
+					res, err := db.GetPayments(ctx, PaymentQuery{Size: 10, Filter: PaymentFilter{Status: PaymentStatusSubmitted}})
+					Expect(err).To(BeNil())
+					Expect(*res).To(Equal([]Payment{{ID: *id}}))
+				})
+			})
+
+			Describe("DeletePayment", func() {
+				It("should delete an existing payment", func() {
+					id, _ := db.CreatePayment(ctx, paymentSample.OrganisationID, paymentSample.Attributes)
+					err := db.DeletePayment(testerCtx, *id)
+					Expect(err).To(BeNil())
+					_, err = db.GetPaymentByID(ctx, *id, false)
+					Expect(err).To(Equal(ErrNotFound))
+				})
+				It("should keep deleted payments", func() {
+					id, _ := db.CreatePayment(ctx, paymentSample.OrganisationID, paymentSample.Attributes)
+					Expect(db.DeletePayment(testerCtx, *id)).To(Succeed())
+					payment, err := db.GetPaymentByID(ctx, *id, true)
+					Expect(err).To(BeNil())
+					Expect(payment.Version).To(Equal(1))
+					Expect(payment.DeletedBy).To(Equal("tester"))
+					Expect(*payment.DeletedAt).To(BeTemporally("~", time.Now(), time.Minute))
+				})
+				It("should hide deleted payments from listings by default", func() {
+					id, _ := db.CreatePayment(ctx, paymentSample.OrganisationID, paymentSample.Attributes)
+					_ = db.DeletePayment(testerCtx, *id)
+					res, err := db.GetPayments(ctx, PaymentQuery{Size: 10})
+					Expect(err).To(BeNil())
+					Expect(*res).To(BeEmpty())
+					res, err = db.GetPayments(ctx, PaymentQuery{Size: 10, IncludeDeleted: true,
+						Fields: []string{PaymentFieldDeletedBy}})
+					Expect(err).To(BeNil())
+					Expect(*res).To(Equal([]Payment{{ID: *id, DeletedBy: "tester"}}))
+				})
+				It("should restore deleted payments", func() {
+					id, _ := db.CreatePayment(ctx, paymentSample.OrganisationID, paymentSample.Attributes)
+					_ = db.DeletePayment(testerCtx, *id)
+					Expect(db.RestorePayment(ctx, *id)).To(Succeed())
+					payment, _ := db.GetPaymentByID(ctx, *id, false)
+					Expect(payment).ToNot(BeNil())
+					Expect(payment.Version).To(Equal(2))
+					Expect(payment.DeletedAt).To(BeNil())
+					Expect(payment.DeletedBy).To(BeEmpty())
+				})
+				It("should reject updates of deleted payments", func() {
+					id, _ := db.CreatePayment(ctx, paymentSample.OrganisationID, paymentSample.Attributes)
+					_ = db.DeletePayment(testerCtx, *id)
+					err := db.UpdatePayment(ctx, *id, "org", 1, paymentSample.Attributes)
+					Expect(err).To(Equal(&PaymentLockedError{Status: "deleted"}))
+				})
+				It("should not delete non-existing ids", func() {
+					id, _ := StringToID("aaaaaaaaaaaaaaaaaaaaaaaa")
+					Expect(db.DeletePayment(ctx, *id)).To(Equal(ErrNotFound))
+				})
+			})
+
+			Describe("Subscriptions", func() {
+				It("should create, get and delete subscriptions", func() {
+					s, err := db.CreateSubscription(ctx, "", "https://example.org", []string{"payment.created"}, "secret")
+					Expect(err).To(BeNil())
+					res, err := db.GetSubscriptionByID(ctx, s.ID)
+					Expect(err).To(BeNil())
+					Expect(res).To(Equal(s))
+					all, err := db.GetSubscriptions(ctx)
+					Expect(err).To(BeNil())
+					Expect(*all).To(Equal([]Subscription{*s}))
+					Expect(db.DeleteSubscription(ctx, s.ID)).To(Succeed())
+					_, err = db.GetSubscriptionByID(ctx, s.ID)
+					Expect(err).To(Equal(ErrNotFound))
+					Expect(db.DeleteSubscription(ctx, s.ID)).To(Equal(ErrNotFound))
+				})
+				It("should keep a log of deliveries", func() {
+					s, _ := db.CreateSubscription(ctx, "", "https://example.org", []string{"payment.created"}, "secret")
+					id, _ := db.CreatePayment(ctx, paymentSample.OrganisationID, paymentSample.Attributes)
+					delivery := WebhookDelivery{
+						SubscriptionID: s.ID,
+						PaymentID:      *id,
+						EventType:      "payment.created",
+						Payload:        []byte(`{}`),
+						Status:         WebhookDeliveryPending,
+						NextAttemptAt:  time.Now().Add(-time.Minute),
+						CreatedAt:      time.Now(),
+					}
+					Expect(db.CreateWebhookDelivery(ctx, delivery)).To(Succeed())
+					Expect(db.CreateWebhookDelivery(ctx, delivery)).To(Succeed())
+					due, err := db.GetDueWebhookDeliveries(ctx, time.Now(), 10)
+					Expect(err).To(BeNil())
+					Expect(*due).To(HaveLen(1))
+					d := (*due)[0]
+					Expect(d.Payload).To(Equal([]byte(`{}`)))
+					d.Status = WebhookDeliveryFailed
+					d.Attempts = []WebhookAttempt{{Timestamp: time.Now(), StatusCode: 500, Error: "unexpected status 500"}}
+					Expect(db.SaveWebhookDelivery(ctx, d)).To(Succeed())
+					due, _ = db.GetDueWebhookDeliveries(ctx, time.Now(), 10)
+					Expect(*due).To(BeEmpty())
+					log, err := db.GetWebhookDeliveries(ctx, s.ID)
+					Expect(err).To(BeNil())
+					Expect(*log).To(HaveLen(1))
+					Expect((*log)[0].Status).To(Equal(WebhookDeliveryFailed))
+					Expect((*log)[0].Attempts[0].StatusCode).To(Equal(500))
+					Expect(db.DeleteSubscription(ctx, s.ID)).To(Succeed())
+					log, _ = db.GetWebhookDeliveries(ctx, s.ID)
+					Expect(*log).To(BeEmpty())
+				})
+			})
+
+			Describe("Ping", func() {
+				It("should reach the database", func() {
+					Expect(db.Ping(ctx)).To(Succeed())
+				})
+			})
+
+			Describe("Tenancy", func() {
+				other := "3e1f4f2b-1f3a-4a5e-9d4e-0c1d2e3f4a5b"
+				tenantCtx := context.WithValue(ctx, ContextPrincipal, &Principal{ID: "tenant", OrganisationID: other})
+				It("should hide payments of other organisations", func() {
+					id, _ := db.CreatePayment(ctx, paymentSample.OrganisationID, paymentSample.Attributes)
+					own, _ := db.CreatePayment(tenantCtx, other, paymentSample.Attributes)
+					_, err := db.GetPaymentByID(tenantCtx, *id, true)
+					Expect(err).To(Equal(ErrNotFound))
+					res, err := db.GetPayments(tenantCtx, PaymentQuery{Size: 10})
+					Expect(err).To(BeNil())
+					Expect(*res).To(Equal([]Payment{{ID: *own}}))
+					res, err = db.GetPayments(tenantCtx, PaymentQuery{Size: 10,
+						Filter: PaymentFilter{OrganisationID: paymentSample.OrganisationID}})
+					Expect(err).To(BeNil())
+					Expect(*res).To(BeEmpty())
+				})
+				It("should not modify payments of other organisations", func() {
+					id, _ := db.CreatePayment(ctx, paymentSample.OrganisationID, paymentSample.Attributes)
+					Expect(db.UpdatePayment(tenantCtx, *id, other, 0, paymentSample.Attributes)).To(Equal(ErrNotFound))
+					Expect(db.UpdatePaymentStatus(tenantCtx, *id, 0, PaymentStatusCancelled)).To(Equal(ErrNotFound))
+					Expect(db.DeletePayment(tenantCtx, *id)).To(Equal(ErrNotFound))
+					payment, _ := db.GetPaymentByID(ctx, *id, false)
+					Expect(payment.Version).To(Equal(0))
+					Expect(payment.OrganisationID).To(Equal(paymentSample.OrganisationID))
+				})
+				It("should not continue after payments of other organisations", func() {
+					id, _ := db.CreatePayment(ctx, paymentSample.OrganisationID, paymentSample.Attributes)
+					_, _ = db.CreatePayment(tenantCtx, other, paymentSample.Attributes)
+					res, err := db.GetPayments(tenantCtx, PaymentQuery{Size: 10, Sort: PaymentSortAmount, After: id})
+					Expect(err).To(BeNil())
+					Expect(*res).To(BeEmpty())
+					res, err = db.GetPayments(tenantCtx, PaymentQuery{Size: 10, Sort: PaymentSortAmount})
+					Expect(err).To(BeNil())
+					Expect(*res).To(HaveLen(1))
+				})
+				It("should hide the versions of payments of other organisations", func() {
+					id, _ := db.CreatePayment(ctx, paymentSample.OrganisationID, paymentSample.Attributes)
+					Expect(db.DeletePayment(ctx, *id)).To(Succeed())
+					versions, err := db.GetPaymentVersions(tenantCtx, *id)
+					Expect(err).To(Equal(ErrNotFound))
+					Expect(versions).To(BeNil())
+					_, err = db.GetPaymentVersion(tenantCtx, *id, 0)
+					Expect(err).To(Equal(ErrNotFound))
+					own, _ := db.CreatePayment(tenantCtx, other, paymentSample.Attributes)
+					versions, err = db.GetPaymentVersions(tenantCtx, *own)
+					Expect(err).To(BeNil())
+					Expect(*versions).To(HaveLen(1))
+					versions, err = db.GetPaymentVersions(ctx, *id)
+					Expect(err).To(BeNil())
+					Expect(*versions).To(HaveLen(2))
+				})
+				It("should hide subscriptions of other organisations", func() {
+					s, _ := db.CreateSubscription(ctx, paymentSample.OrganisationID, "https://example.org",
+						[]string{"payment.created"}, "secret")
+					_, err := db.GetSubscriptionByID(tenantCtx, s.ID)
+					Expect(err).To(Equal(ErrNotFound))
+					all, _ := db.GetSubscriptions(tenantCtx)
+					Expect(*all).To(BeEmpty())
+					Expect(db.DeleteSubscription(tenantCtx, s.ID)).To(Equal(ErrNotFound))
+					res, _ := db.GetSubscriptionByID(ctx, s.ID)
+					Expect(res).ToNot(BeNil())
+				})
+			})
+
+			Describe("GetPaymentVersions", func() {
+				It("should record every modification", func() {
+					id, _ := db.CreatePayment(ctx, paymentSample.OrganisationID, paymentSample.Attributes)
+					Expect(db.UpdatePayment(testerCtx, *id, "org", 0, paymentSample.Attributes)).To(Succeed())
+					Expect(db.UpdatePaymentStatus(testerCtx, *id, 1, PaymentStatusCancelled)).To(Succeed())
+					Expect(db.DeletePayment(testerCtx, *id)).To(Succeed())
+					Expect(db.RestorePayment(testerCtx, *id)).To(Succeed())
+					versions, err := db.GetPaymentVersions(ctx, *id)
+					Expect(err).To(BeNil())
+					Expect(*versions).To(HaveLen(5))
+					var events []string
+					for i, v := range *versions {
+						Expect(v.Version).To(Equal(i))
+						Expect(v.Payment.Version).To(Equal(i))
+						Expect(v.Timestamp).To(BeTemporally("~", time.Now(), time.Minute))
+						events = append(events, v.Event)
+					}
+					Expect(events).To(Equal([]string{PaymentEventCreated, PaymentEventUpdated,
+						PaymentEventStatusChanged, PaymentEventDeleted, PaymentEventRestored}))
+					Expect((*versions)[0].Actor).To(Equal("system"))
+					Expect((*versions)[1].Actor).To(Equal("tester"))
+					Expect((*versions)[1].Payment.OrganisationID).To(Equal("org"))
+					Expect((*versions)[2].Payment.Status).To(Equal(PaymentStatusCancelled))
+					Expect((*versions)[3].Payment.DeletedBy).To(Equal("tester"))
+					Expect((*versions)[4].Payment.DeletedAt).To(BeNil())
+				})
+				It("should keep the snapshot of each version", func() {
+					id, _ := db.CreatePayment(ctx, paymentSample.OrganisationID, paymentSample.Attributes)
+					attributes := paymentSample.Attributes
+					attributes.Amount = "1.00"
+					Expect(db.UpdatePayment(ctx, *id, paymentSample.OrganisationID, 0, attributes)).To(Succeed())
+					v0, err := db.GetPaymentVersion(ctx, *id, 0)
+					Expect(err).To(BeNil())
+					Expect(v0.Payment).To(Equal(Payment{ID: *id, OrganisationID: paymentSample.OrganisationID,
+						Status: PaymentStatusCreated, Attributes: paymentSample.Attributes}))
+					v1, err := db.GetPaymentVersion(ctx, *id, 1)
+					Expect(err).To(BeNil())
+					Expect(v1.Payment.Attributes.Amount).To(Equal("1.00"))
+				})
+				It("should not record failed modifications", func() {
+					id, _ := db.CreatePayment(ctx, paymentSample.OrganisationID, paymentSample.Attributes)
+					err := db.UpdatePayment(ctx, *id, "org", 3, paymentSample.Attributes)
+					Expect(err).To(Equal(&VersionConflictError{Version: 0}))
+					versions, _ := db.GetPaymentVersions(ctx, *id)
+					Expect(*versions).To(HaveLen(1))
+				})
+				It("should keep unpublished versions in the outbox", func() {
+					id, _ := db.CreatePayment(ctx, paymentSample.OrganisationID, paymentSample.Attributes)
+					Expect(db.UpdatePayment(ctx, *id, "org", 0, paymentSample.Attributes)).To(Succeed())
+					versions, err := db.GetUnpublishedPaymentVersions(ctx, 10)
+					Expect(err).To(BeNil())
+					Expect(*versions).To(HaveLen(2))
+					Expect((*versions)[0].Event).To(Equal(PaymentEventCreated))
+					Expect((*versions)[1].Event).To(Equal(PaymentEventUpdated))
+					Expect(db.MarkPaymentVersionPublished(ctx, *id, 0)).To(Succeed())
+					versions, err = db.GetUnpublishedPaymentVersions(ctx, 10)
+					Expect(err).To(BeNil())
+					Expect(*versions).To(HaveLen(1))
+					Expect((*versions)[0].Version).To(Equal(1))
+					Expect((*versions)[0].Payment.ID).To(Equal(*id))
+				})
+				It("should not find unknown versions", func() {
+					id, _ := db.CreatePayment(ctx, paymentSample.OrganisationID, paymentSample.Attributes)
+					v, err := db.GetPaymentVersion(ctx, *id, 1)
+					Expect(err).To(Equal(ErrNotFound))
+					Expect(v).To(BeNil())
+				})
+				It("should not find the versions of unknown payments", func() {
+					id, _ := StringToID("aaaaaaaaaaaaaaaaaaaaaaaa")
+					versions, err := db.GetPaymentVersions(ctx, *id)
+					Expect(err).To(Equal(ErrNotFound))
+					Expect(versions).To(BeNil())
+				})
+			})
 		})
-	})
+	}
 })
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// timeoutDb bounds the operations of a database by deadlines
+type timeoutDb struct {
+	db               Db
+	connectTimeout   time.Duration
+	operationTimeout time.Duration
+}
+
+// NewTimeoutDb decorates the database such that connecting is bounded by the
+// DbConnectTimeout and every other operation by the DbOperationTimeout of the
+// configuration. Earlier deadlines of the context are kept.
+func NewTimeoutDb(config *Config, db Db) Db {
+	return &timeoutDb{db: db, connectTimeout: config.DbConnectTimeout, operationTimeout: config.DbOperationTimeout}
+}
+
+func (d *timeoutDb) GetPayments(ctx context.Context, query PaymentQuery) (*[]Payment, error) {
+	ctx, cancel := context.WithTimeout(ctx, d.operationTimeout)
+	defer cancel()
+	return d.db.GetPayments(ctx, query)
+}
+
+func (d *timeoutDb) GetPaymentByID(ctx context.Context, id ID, includeDeleted bool) (*Payment, error) {
+	ctx, cancel := context.WithTimeout(ctx, d.operationTimeout)
+	defer cancel()
+	return d.db.GetPaymentByID(ctx, id, includeDeleted)
+}
+
+func (d *timeoutDb) CreatePayment(ctx context.Context, organizationID string, attributes PaymentAttributes) (*ID, error) {
+	ctx, cancel := context.WithTimeout(ctx, d.operationTimeout)
+	defer cancel()
+	return d.db.CreatePayment(ctx, organizationID, attributes)
+}
+
+func (d *timeoutDb) UpdatePayment(ctx context.Context, ID ID, organizationID string, version int, attributes PaymentAttributes) error {
+	ctx, cancel := context.WithTimeout(ctx, d.operationTimeout)
+	defer cancel()
+	return d.db.UpdatePayment(ctx, ID, organizationID, version, attributes)
+}
+
+func (d *timeoutDb) UpdatePaymentStatus(ctx context.Context, ID ID, version int, status string) error {
+	ctx, cancel := context.WithTimeout(ctx, d.operationTimeout)
+	defer cancel()
+	return d.db.UpdatePaymentStatus(ctx, ID, version, status)
+}
+
+func (d *timeoutDb) DeletePayment(ctx context.Context, ID ID) error {
+	ctx, cancel := context.WithTimeout(ctx, d.operationTimeout)
+	defer cancel()
+	return d.db.DeletePayment(ctx, ID)
+}
+
+func (d *timeoutDb) RestorePayment(ctx context.Context, ID ID) error {
+	ctx, cancel := context.WithTimeout(ctx, d.operationTimeout)
+	defer cancel()
+	return d.db.RestorePayment(ctx, ID)
+}
+
+func (d *timeoutDb) GetPaymentVersions(ctx context.Context, ID ID) (*[]PaymentVersion, error) {
+	ctx, cancel := context.WithTimeout(ctx, d.operationTimeout)
+	defer cancel()
+	return d.db.GetPaymentVersions(ctx, ID)
+}
+
+func (d *timeoutDb) GetPaymentVersion(ctx context.Context, ID ID, version int) (*PaymentVersion, error) {
+	ctx, cancel := context.WithTimeout(ctx, d.operationTimeout)
+	defer cancel()
+	return d.db.GetPaymentVersion(ctx, ID, version)
+}
+
+func (d *timeoutDb) GetUnpublishedPaymentVersions(ctx context.Context, size int) (*[]PaymentVersion, error) {
+	ctx, cancel := context.WithTimeout(ctx, d.operationTimeout)
+	defer cancel()
+	return d.db.GetUnpublishedPaymentVersions(ctx, size)
+}
+
+func (d *timeoutDb) MarkPaymentVersionPublished(ctx context.Context, ID ID, version int) error {
+	ctx, cancel := context.WithTimeout(ctx, d.operationTimeout)
+	defer cancel()
+	return d.db.MarkPaymentVersionPublished(ctx, ID, version)
+}
+
+func (d *timeoutDb) ReserveIdempotencyKey(ctx context.Context, record IdempotencyRecord) (*IdempotencyRecord, error) {
+	ctx, cancel := context.WithTimeout(ctx, d.operationTimeout)
+	defer cancel()
+	return d.db.ReserveIdempotencyKey(ctx, record)
+}
+
+func (d *timeoutDb) SaveIdempotencyKey(ctx context.Context, record IdempotencyRecord) error {
+	ctx, cancel := context.WithTimeout(ctx, d.operationTimeout)
+	defer cancel()
+	return d.db.SaveIdempotencyKey(ctx, record)
+}
+
+func (d *timeoutDb) ReleaseIdempotencyKey(ctx context.Context, key IdempotencyKey) error {
+	ctx, cancel := context.WithTimeout(ctx, d.operationTimeout)
+	defer cancel()
+	return d.db.ReleaseIdempotencyKey(ctx, key)
+}
+
+func (d *timeoutDb) CreateSubscription(ctx context.Context, organisationID string, url string, eventTypes []string, secret string) (*Subscription, error) {
+	ctx, cancel := context.WithTimeout(ctx, d.operationTimeout)
+	defer cancel()
+	return d.db.CreateSubscription(ctx, organisationID, url, eventTypes, secret)
+}
+
+func (d *timeoutDb) GetSubscriptions(ctx context.Context) (*[]Subscription, error) {
+	ctx, cancel := context.WithTimeout(ctx, d.operationTimeout)
+	defer cancel()
+	return d.db.GetSubscriptions(ctx)
+}
+
+func (d *timeoutDb) GetSubscriptionByID(ctx context.Context, ID ID) (*Subscription, error) {
+	ctx, cancel := context.WithTimeout(ctx, d.operationTimeout)
+	defer cancel()
+	return d.db.GetSubscriptionByID(ctx, ID)
+}
+
+func (d *timeoutDb) DeleteSubscription(ctx context.Context, ID ID) error {
+	ctx, cancel := context.WithTimeout(ctx, d.operationTimeout)
+	defer cancel()
+	return d.db.DeleteSubscription(ctx, ID)
+}
+
+func (d *timeoutDb) CreateWebhookDelivery(ctx context.Context, delivery WebhookDelivery) error {
+	ctx, cancel := context.WithTimeout(ctx, d.operationTimeout)
+	defer cancel()
+	return d.db.CreateWebhookDelivery(ctx, delivery)
+}
+
+func (d *timeoutDb) GetDueWebhookDeliveries(ctx context.Context, before time.Time, size int) (*[]WebhookDelivery, error) {
+	ctx, cancel := context.WithTimeout(ctx, d.operationTimeout)
+	defer cancel()
+	return d.db.GetDueWebhookDeliveries(ctx, before, size)
+}
+
+func (d *timeoutDb) SaveWebhookDelivery(ctx context.Context, delivery WebhookDelivery) error {
+	ctx, cancel := context.WithTimeout(ctx, d.operationTimeout)
+	defer cancel()
+	return d.db.SaveWebhookDelivery(ctx, delivery)
+}
+
+func (d *timeoutDb) GetWebhookDeliveries(ctx context.Context, subscriptionID ID) (*[]WebhookDelivery, error) {
+	ctx, cancel := context.WithTimeout(ctx, d.operationTimeout)
+	defer cancel()
+	return d.db.GetWebhookDeliveries(ctx, subscriptionID)
+}
+
+func (d *timeoutDb) Connect(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, d.connectTimeout)
+	defer cancel()
+	return d.db.Connect(ctx)
+}
+
+func (d *timeoutDb) Ping(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, d.operationTimeout)
+	defer cancel()
+	return d.db.Ping(ctx)
+}
+
+func (d *timeoutDb) Close(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, d.operationTimeout)
+	defer cancel()
+	return d.db.Close(ctx)
+}
@@ -0,0 +1,130 @@
+package main_test
+
+import (
+	"context"
+	"time"
+
+	. "./"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+)
+
+// deadlineDb records the time left until the deadline of operations
+type deadlineDb struct {
+	Db
+	left *time.Duration
+}
+
+func (d deadlineDb) record(ctx context.Context) {
+	deadline, ok := ctx.Deadline()
+	Expect(ok).To(BeTrue())
+	*d.left = time.Until(deadline)
+}
+
+func (d deadlineDb) GetPayments(ctx context.Context, query PaymentQuery) (*[]Payment, error) {
+	d.record(ctx)
+	return &[]Payment{}, nil
+}
+
+func (d deadlineDb) Connect(ctx context.Context) error {
+	d.record(ctx)
+	return nil
+}
+
+var _ = Describe("TimeoutDb", func() {
+	var left time.Duration
+	var db Db
+
+	BeforeEach(func() {
+		db = NewTimeoutDb(&Config{DbConnectTimeout: time.Minute, DbOperationTimeout: time.Second},
+			deadlineDb{left: &left})
+	})
+
+	It("should bound operations by the operation timeout", func() {
+		_, err := db.GetPayments(context.Background(), PaymentQuery{})
+		Expect(err).To(BeNil())
+		Expect(left).To(BeNumerically("~", time.Second, 100*time.Millisecond))
+	})
+
+	It("should bound connecting by the connect timeout", func() {
+		Expect(db.Connect(context.Background())).To(Succeed())
+		Expect(left).To(BeNumerically("~", time.Minute, 100*time.Millisecond))
+	})
+
+	It("should keep earlier deadlines", func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		_, _ = db.GetPayments(ctx, PaymentQuery{})
+		Expect(left).To(BeNumerically("<=", 100*time.Millisecond))
+	})
+})
+
+var _ = Describe("MongoClientOptions", func() {
+	It("should apply the settings of the configuration", func() {
+		c, _, _ := LoadConfig([]string{"-mongo-db-uri", "mongodb://localhost/?maxPoolSize=5",
+			"-mongo-db-max-pool-size", "50", "-mongo-db-min-pool-size", "5",
+			"-mongo-db-server-selection-timeout", "5s", "-mongo-db-read-preference", "secondaryPreferred",
+			"-mongo-db-write-concern", "majority", "-mongo-db-retry-writes=false"},
+			func(string) (string, bool) { return "", false })
+		opts, err := MongoClientOptions(c)
+		Expect(err).To(BeNil())
+		Expect(*opts.MaxPoolSize).To(Equal(uint64(50)))
+		Expect(*opts.MinPoolSize).To(Equal(uint64(5)))
+		Expect(*opts.ServerSelectionTimeout).To(Equal(5 * time.Second))
+		Expect(opts.ReadPreference.Mode()).To(Equal(readpref.SecondaryPreferredMode))
+		Expect(opts.WriteConcern).To(Equal(writeconcern.New(writeconcern.WMajority())))
+		Expect(*opts.RetryWrites).To(BeFalse())
+	})
+
+	It("should acknowledge writes by a number of servers", func() {
+		opts, err := MongoClientOptions(&Config{MongoDbReadPreference: MongoDbReadPreferencePrimary,
+			MongoDbWriteConcern: "2"})
+		Expect(err).To(BeNil())
+		Expect(opts.WriteConcern).To(Equal(writeconcern.New(writeconcern.W(2))))
+	})
+
+	It("should keep the options of the URI without settings", func() {
+		c, _, err := LoadConfig([]string{"-mongo-db-uri", "mongodb://localhost/?maxPoolSize=5&minPoolSize=2" +
+			"&serverSelectionTimeoutMS=1000&readPreference=nearest&w=majority&retryWrites=false",
+			"-mongo-db-database", "form3", "-auth-disabled"}, func(string) (string, bool) { return "", false })
+		Expect(err).To(BeNil())
+		Expect(c.Validate()).To(Succeed())
+		opts, err := MongoClientOptions(c)
+		Expect(err).To(BeNil())
+		Expect(*opts.MaxPoolSize).To(Equal(uint64(5)))
+		Expect(*opts.MinPoolSize).To(Equal(uint64(2)))
+		Expect(*opts.ServerSelectionTimeout).To(Equal(time.Second))
+		Expect(opts.ReadPreference.Mode()).To(Equal(readpref.NearestMode))
+		Expect(opts.WriteConcern).To(Equal(writeconcern.New(writeconcern.WMajority())))
+		Expect(*opts.RetryWrites).To(BeFalse())
+	})
+
+	It("should keep the defaults of the driver without settings", func() {
+		c, _, err := LoadConfig([]string{"-mongo-db-uri", "mongodb://localhost"},
+			func(string) (string, bool) { return "", false })
+		Expect(err).To(BeNil())
+		opts, err := MongoClientOptions(c)
+		Expect(err).To(BeNil())
+		Expect(opts.MaxPoolSize).To(BeNil())
+		Expect(opts.ServerSelectionTimeout).To(BeNil())
+		Expect(opts.ReadPreference).To(BeNil())
+		Expect(opts.RetryWrites).To(BeNil())
+	})
+
+	It("should reject invalid settings", func() {
+		c, _, _ := LoadConfig([]string{"-mongo-db-uri", "mongodb://localhost", "-mongo-db-database", "form3",
+			"-auth-disabled", "-mongo-db-max-pool-size", "5", "-mongo-db-min-pool-size", "10",
+			"-mongo-db-read-preference", "closest", "-mongo-db-write-concern", "all"},
+			func(string) (string, bool) { return "", false })
+		err := c.Validate()
+		Expect(err).To(BeAssignableToTypeOf(&ConfigError{}))
+		Expect(err.(*ConfigError).Problems).To(Equal([]string{
+			"mongo_db_min_pool_size must be between 0 and mongo_db_max_pool_size, got 10 and 5",
+			"mongo_db_read_preference must be one of primary, primaryPreferred, secondary, secondaryPreferred, " +
+				`nearest, got "closest"`,
+			`mongo_db_write_concern must be majority or a number of servers, got "all"`,
+		}))
+	})
+})
@@ -1,8 +1,6 @@
 package main_test
 
 import (
-	"github.com/google/logger"
-	"io/ioutil"
 	"testing"
 
 	. "github.com/onsi/ginkgo"
@@ -10,7 +8,6 @@ import (
 )
 
 func TestForm3(t *testing.T) {
-	defer logger.Init("Form3 API", false, false, ioutil.Discard).Close()
 	RegisterFailHandler(Fail)
 	RunSpecs(t, "Form3 Suite")
 }
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-chi/render"
+)
+
+// Statuses of health checks
+const (
+	healthStatusOK          = "ok"
+	healthStatusUnavailable = "unavailable"
+)
+
+// healthCheckTimeout is how long a dependency may take to respond
+const healthCheckTimeout = 2 * time.Second
+
+// healthCheck verifies a dependency of the service is available
+type healthCheck func(ctx context.Context) error
+
+// readinessChecks returns the checks of the dependencies of the service
+func readinessChecks(ctx context.Context) map[string]healthCheck {
+	conf := ctx.Value(ContextConfig).(*Config)
+	db := ctx.Value(ContextDb).(Db)
+	checks := map[string]healthCheck{"database": db.Ping}
+	if conf.EventPublisher == EventPublisherFile {
+		checks["event_file"] = func(ctx context.Context) error {
+			f, err := os.OpenFile(conf.EventFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+			if err != nil {
+				return err
+			}
+			return f.Close()
+		}
+	}
+	return checks
+}
+
+// runHealthChecks runs the checks concurrently. Failures are logged rather
+// than returned, as the endpoints are not authenticated.
+func runHealthChecks(ctx context.Context, checks map[string]healthCheck) healthRest {
+	res := healthRest{Status: healthStatusOK, Checks: map[string]healthCheckRest{}}
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	for name, check := range checks {
+		wg.Add(1)
+		go func(name string, check healthCheck) {
+			defer wg.Done()
+			checkCtx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+			defer cancel()
+			start := time.Now()
+			err := check(checkCtx)
+			result := healthCheckRest{
+				Status:    healthStatusOK,
+				LatencyMs: float64(time.Since(start)) / float64(time.Millisecond),
+			}
+			mutex.Lock()
+			defer mutex.Unlock()
+			if err != nil {
+				contextLogger(ctx).With("check", name).Error("health check failed", err)
+				result.Status = healthStatusUnavailable
+				res.Status = healthStatusUnavailable
+			}
+			res.Checks[name] = result
+		}(name, check)
+	}
+	wg.Wait()
+	return res
+}
+
+// healthzEndpoint reports the process is alive
+func healthzEndpoint(w http.ResponseWriter, r *http.Request) {
+	render.JSON(w, r, healthRest{Status: healthStatusOK})
+}
+
+// readyzEndpoint reports whether the dependencies are available, such that
+// requests can be served
+func readyzEndpoint(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	res := runHealthChecks(ctx, readinessChecks(ctx))
+	if res.Status != healthStatusOK {
+		render.Status(r, http.StatusServiceUnavailable)
+	}
+	render.JSON(w, r, res)
+}
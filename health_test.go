@@ -0,0 +1,78 @@
+package main_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	. "./"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Health", func() {
+	config := testConfig
+	config.AuthDisabled = false
+	ctx := context.WithValue(context.WithValue(testCtx, ContextConfig, &config), ContextDb, mockDb{})
+
+	type health struct {
+		Status string `json:"status"`
+		Checks map[string]struct {
+			Status    string   `json:"status"`
+			LatencyMs *float64 `json:"latency_ms"`
+		} `json:"checks"`
+	}
+	decode := func(body []byte) health {
+		res := health{}
+		Expect(json.Unmarshal(body, &res)).To(Succeed())
+		return res
+	}
+
+	It("should report liveness without authentication", func() {
+		w := performRequest(ctx, "GET", "/healthz")
+		Expect(w.Code).To(Equal(http.StatusOK))
+		r, _ := ioutil.ReadAll(w.Body)
+		Expect(r).To(MatchJSON(`{"status": "ok"}`))
+	})
+
+	It("should report readiness without authentication", func() {
+		w := performRequest(ctx, "GET", "/readyz")
+		Expect(w.Code).To(Equal(http.StatusOK))
+		r, _ := ioutil.ReadAll(w.Body)
+		res := decode(r)
+		Expect(res.Status).To(Equal("ok"))
+		Expect(res.Checks).To(HaveLen(1))
+		Expect(res.Checks["database"].Status).To(Equal("ok"))
+		Expect(res.Checks["database"].LatencyMs).ToNot(BeNil())
+	})
+
+	It("should not be ready when the database is unreachable", func() {
+		c := context.WithValue(ctx, ContextDb, mockDb{error: errors.New("unreachable")})
+		w := performRequest(c, "GET", "/readyz")
+		Expect(w.Code).To(Equal(http.StatusServiceUnavailable))
+		r, _ := ioutil.ReadAll(w.Body)
+		res := decode(r)
+		Expect(res.Status).To(Equal("unavailable"))
+		Expect(res.Checks["database"].Status).To(Equal("unavailable"))
+		Expect(string(r)).ToNot(ContainSubstring("unreachable"))
+	})
+
+	It("should check the event file of the file publisher", func() {
+		dir, _ := ioutil.TempDir("", "health")
+		defer os.RemoveAll(dir)
+		fileConfig := config
+		fileConfig.EventPublisher = EventPublisherFile
+		fileConfig.EventFile = filepath.Join(dir, "missing", "events.jsonl")
+		c := context.WithValue(ctx, ContextConfig, &fileConfig)
+		w := performRequest(c, "GET", "/readyz")
+		Expect(w.Code).To(Equal(http.StatusServiceUnavailable))
+		r, _ := ioutil.ReadAll(w.Body)
+		Expect(decode(r).Checks["event_file"].Status).To(Equal("unavailable"))
+		fileConfig.EventFile = filepath.Join(dir, "events.jsonl")
+		Expect(performRequest(c, "GET", "/readyz").Code).To(Equal(http.StatusOK))
+	})
+})
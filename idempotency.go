@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	idempotencyKeyHeader     = "Idempotency-Key"
+	idempotentReplayedHeader = "Idempotent-Replayed"
+	idempotencyKeyMaxLength  = 255
+	// idempotencySaveAttempts is how many times a response is saved before
+	// it is given up
+	idempotencySaveAttempts = 3
+	// idempotencyLease is how long a key is reserved for a request in
+	// progress. Retries within the lease are rejected as in progress, also
+	// when the request failed after its payment may have been created.
+	idempotencyLease = 5 * time.Minute
+)
+
+// idempotentRequest is a request whose response is stored and replayed for
+// retries with the same Idempotency-Key header. Requests without the header
+// are not stored.
+type idempotentRequest struct {
+	record *IdempotencyRecord
+}
+
+// requestHash identifies the request data independent of its formatting
+func requestHash(data interface{}) (string, error) {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(raw)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// beginIdempotentRequest reserves the idempotency key of the request for the
+// organisation. When the key has been used before, the stored response or an
+// error is written and false is returned.
+func beginIdempotentRequest(w http.ResponseWriter, r *http.Request, organisationID string, data interface{}) (*idempotentRequest, bool) {
+	key := r.Header.Get(idempotencyKeyHeader)
+	if key == "" {
+		return &idempotentRequest{}, true
+	}
+	if len(key) > idempotencyKeyMaxLength {
+		renderErrorRest(w, r, http.StatusBadRequest, errorRest{
+			Message: fmt.Sprintf("%s must be at most %d characters", idempotencyKeyHeader, idempotencyKeyMaxLength),
+		})
+		return nil, false
+	}
+	hash, err := requestHash(data)
+	if err != nil {
+		contextLogger(r.Context()).Error("failed to hash request", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return nil, false
+	}
+	ctx := r.Context()
+	conf := ctx.Value(ContextConfig).(*Config)
+	db := ctx.Value(ContextDb).(Db)
+	lease := idempotencyLease
+	if conf.IdempotencyKeyTTL < lease {
+		lease = conf.IdempotencyKeyTTL
+	}
+	record := IdempotencyRecord{
+		ID:          IdempotencyKey{OrganisationID: organisationID, Key: key},
+		RequestHash: hash,
+		ExpiresAt:   time.Now().Add(lease),
+	}
+	existing, err := db.ReserveIdempotencyKey(ctx, record)
+	if err != nil {
+		renderDbError(w, r, "failed to reserve idempotency key", err)
+		return nil, false
+	}
+	switch {
+	case existing == nil:
+		return &idempotentRequest{record: &record}, true
+	case existing.Status == 0:
+		renderErrorRest(w, r, http.StatusConflict, errorRest{
+			Code:    errorCodeIdempotencyKeyInUse,
+			Message: fmt.Sprintf("a request with the same %s is in progress", idempotencyKeyHeader),
+		})
+	case existing.RequestHash != hash:
+		renderErrorRest(w, r, http.StatusUnprocessableEntity, errorRest{
+			Code:    errorCodeIdempotencyKeyReused,
+			Message: fmt.Sprintf("%s was used with a different request", idempotencyKeyHeader),
+		})
+	default:
+		w.Header().Set(idempotentReplayedHeader, "true")
+		writeJSON(w, existing.Status, existing.Body)
+	}
+	return nil, false
+}
+
+// respond writes the response and stores it for retries
+func (i *idempotentRequest) respond(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	buf := &bytes.Buffer{}
+	if err := json.NewEncoder(buf).Encode(v); err != nil {
+		// The key is kept until its lease expires, as the request has
+		// taken effect
+		contextLogger(r.Context()).Error("failed to encode response", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+	if i.record != nil {
+		conf := r.Context().Value(ContextConfig).(*Config)
+		i.record.Status = status
+		i.record.Body = buf.Bytes()
+		i.record.ExpiresAt = time.Now().Add(conf.IdempotencyKeyTTL)
+		i.save(r)
+	}
+	writeJSON(w, status, buf.Bytes())
+}
+
+// save stores the response for retries. A key whose response can not be
+// stored is kept reserved until its lease expires, such that retries are
+// rejected as in progress rather than repeating the request.
+func (i *idempotentRequest) save(r *http.Request) {
+	ctx, cancel := detachRequest(r)
+	defer cancel()
+	db := ctx.Value(ContextDb).(Db)
+	var err error
+	for attempt := 0; attempt < idempotencySaveAttempts; attempt++ {
+		if err = db.SaveIdempotencyKey(ctx, *i.record); err == nil {
+			return
+		}
+	}
+	contextLogger(ctx).Error("failed to save idempotency key", err)
+}
+
+// abort responds with the error response of the failed database operation.
+// The idempotency key is released, such that the request can be retried,
+// when the operation was rejected by the database. Otherwise, e.g. when the
+// database timed out, the operation may have taken effect and the key is kept
+// until its lease expires.
+func (i *idempotentRequest) abort(w http.ResponseWriter, r *http.Request, msg string, err error) {
+	if kind := ErrorKind(err); i.record != nil && (kind == ErrInvalid || kind == ErrConflict) {
+		ctx, cancel := detachRequest(r)
+		defer cancel()
+		db := ctx.Value(ContextDb).(Db)
+		if err := db.ReleaseIdempotencyKey(ctx, i.record.ID); err != nil {
+			contextLogger(ctx).Error("failed to release idempotency key", err)
+		}
+	}
+	renderDbError(w, r, msg, err)
+}
+
+// detachedContext keeps the values of its parent but is never cancelled
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (detachedContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (detachedContext) Err() error {
+	return nil
+}
+
+// detachRequest returns a context with the values of the request, bounded by
+// the DbOperationTimeout rather than the request. The idempotency key is
+// stored or released also when the client has disconnected, as it is likely
+// to retry.
+func detachRequest(r *http.Request) (context.Context, context.CancelFunc) {
+	conf := r.Context().Value(ContextConfig).(*Config)
+	return context.WithTimeout(detachedContext{r.Context()}, conf.DbOperationTimeout)
+}
+
+// writeJSON writes an encoded JSON response
+func writeJSON(w http.ResponseWriter, status int, body []byte) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	_, _ = w.Write(body)
+}
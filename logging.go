@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-chi/chi/middleware"
+)
+
+// Log levels, in increasing severity
+const (
+	LogLevelDebug = "debug"
+	LogLevelInfo  = "info"
+	LogLevelWarn  = "warn"
+	LogLevelError = "error"
+)
+
+var logLevelSeverities = map[string]int{
+	LogLevelDebug: 0,
+	LogLevelInfo:  1,
+	LogLevelWarn:  2,
+	LogLevelError: 3,
+}
+
+// logSink writes the entries of loggers at or above a level
+type logSink struct {
+	mutex    sync.Mutex
+	w        io.Writer
+	severity int32
+}
+
+// Logger writes leveled entries as lines of JSON. Every entry has the fields
+// of the logger. It is safe for concurrent use.
+type Logger struct {
+	sink   *logSink
+	mutex  sync.Mutex
+	fields map[string]interface{}
+}
+
+// NewLogger constructs a logger writing entries at or above the level to the
+// writer
+func NewLogger(w io.Writer, level string) (*Logger, error) {
+	severity, ok := logLevelSeverities[level]
+	if !ok {
+		return nil, fmt.Errorf("unknown log level %q", level)
+	}
+	return &Logger{sink: &logSink{w: w, severity: int32(severity)}, fields: map[string]interface{}{}}, nil
+}
+
+// SetLevel changes the level of the logger and of every logger derived from
+// it
+func (l *Logger) SetLevel(level string) error {
+	severity, ok := logLevelSeverities[level]
+	if !ok {
+		return fmt.Errorf("unknown log level %q", level)
+	}
+	atomic.StoreInt32(&l.sink.severity, int32(severity))
+	return nil
+}
+
+// defaultLogger logs where no logger is in the context
+var defaultLogger, _ = NewLogger(os.Stderr, LogLevelInfo)
+
+// With returns a logger with the field added to the fields of the logger
+func (l *Logger) With(key string, value interface{}) *Logger {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	fields := map[string]interface{}{key: value}
+	for k, v := range l.fields {
+		if k != key {
+			fields[k] = v
+		}
+	}
+	return &Logger{sink: l.sink, fields: fields}
+}
+
+// Set adds the field to the logger, such that it is included in entries of
+// the logger written later
+func (l *Logger) Set(key string, value interface{}) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.fields[key] = value
+}
+
+func (l *Logger) log(level string, msg string, err error) {
+	if int32(logLevelSeverities[level]) < atomic.LoadInt32(&l.sink.severity) {
+		return
+	}
+	l.mutex.Lock()
+	entry := make(map[string]interface{}, len(l.fields)+4)
+	for k, v := range l.fields {
+		entry[k] = v
+	}
+	l.mutex.Unlock()
+	entry["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	entry["level"] = level
+	entry["msg"] = msg
+	if err != nil {
+		entry["error"] = err.Error()
+	}
+	line, jerr := json.Marshal(entry)
+	if jerr != nil {
+		line, _ = json.Marshal(map[string]interface{}{"time": entry["time"], "level": level, "msg": msg,
+			"error": fmt.Sprintf("unencodable fields: %v", jerr)})
+	}
+	l.sink.mutex.Lock()
+	defer l.sink.mutex.Unlock()
+	_, _ = l.sink.w.Write(append(line, '\n'))
+}
+
+// Debug logs a message with the debug level
+func (l *Logger) Debug(msg string) {
+	l.log(LogLevelDebug, msg, nil)
+}
+
+// Info logs a message with the info level
+func (l *Logger) Info(msg string) {
+	l.log(LogLevelInfo, msg, nil)
+}
+
+// Warn logs a message with the warn level and the error, if any
+func (l *Logger) Warn(msg string, err error) {
+	l.log(LogLevelWarn, msg, err)
+}
+
+// Error logs a message with the error level and the error
+func (l *Logger) Error(msg string, err error) {
+	l.log(LogLevelError, msg, err)
+}
+
+// contextLogger returns the logger of the context, or the default logger
+func contextLogger(ctx context.Context) *Logger {
+	if l, ok := ctx.Value(ContextLogger).(*Logger); ok {
+		return l
+	}
+	return defaultLogger
+}
+
+// setLogField adds the field to the logger of the request of the context.
+// Without a request logger nothing is done, such that the default logger is
+// not modified.
+func setLogField(ctx context.Context, key string, value interface{}) {
+	if l, ok := ctx.Value(ContextLogger).(*Logger); ok {
+		l.Set(key, value)
+	}
+}
+
+// Middleware stores a logger of the request in the context and logs the
+// completion of every request. Handlers add fields to the logger of the
+// request with setLogField.
+func (l *Logger) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ctx := r.Context()
+		rl := l.With("request_id", middleware.GetReqID(ctx))
+		if traceID := contextTraceID(ctx); traceID != "" {
+			rl.Set("trace_id", traceID)
+		}
+		rl.Set("method", r.Method)
+		rl.Set("path", r.URL.Path)
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r.WithContext(context.WithValue(ctx, ContextLogger, rl)))
+		rl.Set("route", requestRoute(r))
+		rl.Set("status", responseStatus(ww))
+		rl.Set("duration_ms", float64(time.Since(start))/float64(time.Millisecond))
+		rl.Info("request completed")
+	})
+}
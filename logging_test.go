@@ -0,0 +1,119 @@
+package main_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	. "./"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Logging", func() {
+	var buf *bytes.Buffer
+	var log *Logger
+
+	BeforeEach(func() {
+		buf = &bytes.Buffer{}
+		log, _ = NewLogger(buf, LogLevelInfo)
+	})
+
+	entries := func() []map[string]interface{} {
+		var res []map[string]interface{}
+		for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+			if line == "" {
+				continue
+			}
+			entry := map[string]interface{}{}
+			Expect(json.Unmarshal([]byte(line), &entry)).To(Succeed(), line)
+			res = append(res, entry)
+		}
+		return res
+	}
+
+	It("should write entries as lines of JSON", func() {
+		log.With("payment_id", "p1").Error("failed to update payment", errors.New("unavailable"))
+		res := entries()
+		Expect(res).To(HaveLen(1))
+		Expect(res[0]).To(HaveKeyWithValue("level", "error"))
+		Expect(res[0]).To(HaveKeyWithValue("msg", "failed to update payment"))
+		Expect(res[0]).To(HaveKeyWithValue("error", "unavailable"))
+		Expect(res[0]).To(HaveKeyWithValue("payment_id", "p1"))
+		Expect(res[0]).To(HaveKey("time"))
+	})
+
+	It("should only write entries at or above the level", func() {
+		log.Debug("debug")
+		log.Info("info")
+		log.Warn("warn", nil)
+		res := entries()
+		Expect(res).To(HaveLen(2))
+		Expect(res[0]).To(HaveKeyWithValue("level", "info"))
+		Expect(res[1]).To(HaveKeyWithValue("level", "warn"))
+		Expect(res[1]).ToNot(HaveKey("error"))
+	})
+
+	It("should not add fields to the parent logger", func() {
+		log.With("a", 1).Info("child")
+		log.Info("parent")
+		res := entries()
+		Expect(res[0]).To(HaveKeyWithValue("a", float64(1)))
+		Expect(res[1]).ToNot(HaveKey("a"))
+	})
+
+	It("should reject unknown levels", func() {
+		_, err := NewLogger(buf, "verbose")
+		Expect(err).To(MatchError(`unknown log level "verbose"`))
+	})
+
+	Describe("Middleware", func() {
+		var handler http.Handler
+
+		BeforeEach(func() {
+			r := chi.NewRouter()
+			r.Use(middleware.RequestID)
+			r.Use(log.Middleware)
+			r.Mount("/", RootRoute())
+			handler = r
+		})
+
+		request := func(db Db, method, path string, body string) {
+			req := httptest.NewRequest(method, path, strings.NewReader(body))
+			req.Header.Set("content-type", "application/json")
+			handler.ServeHTTP(httptest.NewRecorder(), req.WithContext(context.WithValue(testCtx, ContextDb, db)))
+		}
+
+		It("should log completed requests with the fields of the request", func() {
+			request(mockDb{Payments: []Payment{paymentSample}}, "GET", "/v1/payments/5cdd382e9549af35c3b94301", "")
+			res := entries()
+			Expect(res).To(HaveLen(1))
+			Expect(res[0]).To(HaveKeyWithValue("msg", "request completed"))
+			Expect(res[0]).To(HaveKeyWithValue("level", "info"))
+			Expect(res[0]).To(HaveKeyWithValue("method", "GET"))
+			Expect(res[0]).To(HaveKeyWithValue("path", "/v1/payments/5cdd382e9549af35c3b94301"))
+			Expect(res[0]).To(HaveKeyWithValue("route", "/v1/payments/{paymentID}/"))
+			Expect(res[0]).To(HaveKeyWithValue("status", float64(http.StatusOK)))
+			Expect(res[0]).To(HaveKeyWithValue("payment_id", "5cdd382e9549af35c3b94301"))
+			Expect(res[0]).To(HaveKeyWithValue("organisation_id", paymentSample.OrganisationID))
+			Expect(res[0]).To(HaveKey("request_id"))
+			Expect(res[0]).To(HaveKey("duration_ms"))
+		})
+
+		It("should log errors of handlers with the fields of the request", func() {
+			request(mockDb{error: errors.New("unavailable")}, "POST", "/v1/payments", paymentRequestJSON)
+			res := entries()
+			Expect(res).To(HaveLen(2))
+			Expect(res[0]).To(HaveKeyWithValue("msg", "failed to create payment"))
+			Expect(res[0]).To(HaveKeyWithValue("error", "unavailable"))
+			Expect(res[0]["request_id"]).To(Equal(res[1]["request_id"]))
+			Expect(res[1]).To(HaveKeyWithValue("status", float64(http.StatusInternalServerError)))
+		})
+	})
+})
@@ -2,14 +2,15 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"github.com/go-chi/chi/middleware"
-	"io/ioutil"
+	"net"
 	"net/http"
-	"time"
-
-	"github.com/go-chi/chi"
-	"github.com/google/logger"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 )
 
 type key int
@@ -21,36 +22,140 @@ const (
 	ContextDb key = iota
 	// ContextPayment key used to fetch current payment from context
 	ContextPayment key = iota
+	// ContextActor key used to fetch who performs the request from context
+	ContextActor key = iota
+	// ContextSubscription key used to fetch current subscription from context
+	ContextSubscription key = iota
+	// ContextPrincipal key used to fetch the authenticated caller from context
+	ContextPrincipal key = iota
+	// ContextSpan key used to fetch the current trace span from context
+	ContextSpan key = iota
+	// ContextLogger key used to fetch the logger of the request from context
+	ContextLogger key = iota
 )
 
 func main() {
-	defer logger.Init("Form3 API", true, false, ioutil.Discard).Close()
-	c := ReadConfigFromEnv()
-	db, err := NewDb(c)
+	c, printConfig, err := LoadConfig(os.Args[1:], os.LookupEnv)
+	if err == flag.ErrHelp {
+		return
+	}
 	if err != nil {
-		logger.Fatal("failed to initialize database: ", err)
+		defaultLogger.Error("failed to load configuration", err)
+		os.Exit(2)
+	}
+	if printConfig {
+		if err = PrintConfig(os.Stdout, c); err != nil {
+			defaultLogger.Error("failed to print configuration", err)
+			os.Exit(1)
+		}
+		return
 	}
-	ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
-	err = db.Connect(ctx)
+	if err = c.Validate(); err != nil {
+		defaultLogger.Error("failed to load configuration", err)
+		os.Exit(2)
+	}
+	log, err := NewLogger(os.Stderr, c.LogLevel)
 	if err != nil {
-		logger.Fatal("failed to connect with database: ", err)
+		defaultLogger.Error("failed to initialize logger", err)
+		os.Exit(1)
+	}
+	load := func() (*Config, error) {
+		c, _, err := LoadConfig(os.Args[1:], os.LookupEnv)
+		return c, err
+	}
+	if err = run(c, load, log); err != nil {
+		log.Error("failed to run server", err)
+		os.Exit(1)
+	}
+}
+
+// run serves the API until SIGINT or SIGTERM is received, reloading the
+// configuration with load on SIGHUP. Errors are returned rather than fatal,
+// such that the database is closed.
+func run(c *Config, load func() (*Config, error), log *Logger) error {
+	if c.PolicyFile != "" {
+		policy, err := LoadPolicy(c.PolicyFile)
+		if err != nil {
+			return fmt.Errorf("failed to load policy: %v", err)
+		}
+		c.Policy = policy
+	}
+	metrics := NewMetrics()
+	tracer, err := NewTracer(c)
+	if err != nil {
+		return fmt.Errorf("failed to initialize tracer: %v", err)
+	}
+	db, err := NewDb(c)
+	if err != nil {
+		return fmt.Errorf("failed to initialize database: %v", err)
+	}
+	db = tracer.InstrumentDb(metrics.InstrumentDb(NewTimeoutDb(c, db)))
+	baseCtx := context.WithValue(context.WithValue(context.Background(), ContextConfig, c), ContextLogger, log)
+	if err = db.Connect(baseCtx); err != nil {
+		return fmt.Errorf("failed to connect with database: %v", err)
 	}
 	defer db.Close(context.Background())
-	r := chi.NewRouter()
+	publisher, err := NewPublisher(c, db)
+	if err != nil {
+		return fmt.Errorf("failed to initialize event publisher: %v", err)
+	}
+	// Workers are stopped after the server, such that events of the last
+	// requests are still published
+	workerCtx, stopWorkers := context.WithCancel(baseCtx)
+	var workers sync.WaitGroup
+	startWorker := func(run func(context.Context)) {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			run(workerCtx)
+		}()
+	}
+	defer workers.Wait()
+	defer stopWorkers()
+	if publisher != nil {
+		startWorker(NewDispatcher(c, db, publisher).Run)
+	}
+	if c.EventPublisher == EventPublisherWebhook {
+		startWorker(NewWebhookWorker(c, db).Run)
+	}
+	configs := NewConfigStore(c, load, log, metrics)
+	reloads := make(chan os.Signal, 1)
+	signal.Notify(reloads, syscall.SIGHUP)
+	defer signal.Stop(reloads)
+	startWorker(func(ctx context.Context) {
+		configs.Run(ctx, reloads)
+	})
+	r := newRouter()
 	r.Use(middleware.RequestID)
 	r.Use(middleware.RealIP)
-	r.Use(middleware.Logger)
-	r.Use(middleware.Recoverer)
+	r.Use(tracer.Middleware)
+	r.Use(log.Middleware)
+	r.Use(metrics.Middleware)
+	r.Use(recoverer)
 	r.Use(func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			ctx := context.WithValue(r.Context(), ContextDb, db)
-			ctx = context.WithValue(ctx, ContextConfig, c)
-			next.ServeHTTP(w, r.WithContext(ctx))
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), ContextDb, db)))
 		})
 	})
+	r.Use(configs.Middleware)
+	r.Handle("/metrics", metrics.Handler())
 	r.Mount("/", RootRoute())
-	if err := http.ListenAndServe(fmt.Sprintf(":%d", c.Port), r); err != nil {
-		logger.Fatal("failed to start server ", err)
+	server := NewServer(c, r)
+	listener, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		return fmt.Errorf("failed to start server: %v", err)
 	}
-
+	ctx, shutdown := context.WithCancel(context.Background())
+	defer shutdown()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		log.With("signal", sig.String()).Info("shutting down")
+		shutdown()
+	}()
+	if err = RunServer(ctx, server, listener, c.ShutdownTimeout); err != nil {
+		return fmt.Errorf("failed to shut down server: %v", err)
+	}
+	return nil
 }
@@ -5,7 +5,10 @@ package main_test
 import (
 	. "./"
 	"context"
+	"os"
+
 	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
 )
 
 type TestDb interface {
@@ -13,22 +16,59 @@ type TestDb interface {
 	Drop(ctx context.Context) error
 }
 
-var db, _ = NewDb(&testConfig)
+// testBackend is a storage backend the integration tests run against
+type testBackend struct {
+	Name string
+	Db   TestDb
+	// Ctx holds the config and db of the backend
+	Ctx context.Context
+}
+
+func newTestBackend(driver string) testBackend {
+	config := testConfig
+	config.StorageDriver = driver
+	db, err := NewDb(&config)
+	if err != nil {
+		panic(err)
+	}
+	ctx := context.WithValue(context.Background(), ContextConfig, &config)
+	return testBackend{
+		Name: driver,
+		Db:   db.(TestDb),
+		Ctx:  context.WithValue(ctx, ContextDb, db),
+	}
+}
+
+// testBackends are all backends, or only the one selected with the
+// STORAGE_DRIVER environment variable
+var testBackends = func() []testBackend {
+	drivers := []string{StorageDriverMongo, StorageDriverPostgres, StorageDriverMemory}
+	if driver := os.Getenv("STORAGE_DRIVER"); driver != "" {
+		drivers = []string{driver}
+	}
+	backends := make([]testBackend, len(drivers))
+	for i, driver := range drivers {
+		backends[i] = newTestBackend(driver)
+	}
+	return backends
+}()
 
 var _ = BeforeSuite(func() {
-	_ = db.Connect(testCtx)
+	for _, backend := range testBackends {
+		Expect(backend.Db.Connect(backend.Ctx)).To(Succeed(), backend.Name)
+	}
 })
 
 var _ = AfterSuite(func() {
-	_ = db.Close(testCtx)
+	for _, backend := range testBackends {
+		_ = backend.Db.Close(backend.Ctx)
+	}
 })
 
-var testDbCtx = context.WithValue(testCtx, ContextDb, db)
-
-func populateDatabase(n int) []ID {
+func populateDatabase(backend testBackend, n int) []ID {
 	var ids = make([]ID, n)
 	for i := 0; i < n; i++ {
-		id, _ := db.CreatePayment(testCtx, paymentSample.OrganisationID, paymentSample.Attributes)
+		id, _ := backend.Db.CreatePayment(backend.Ctx, paymentSample.OrganisationID, paymentSample.Attributes)
 		ids[i] = *id
 	}
 	return ids
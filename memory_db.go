@@ -0,0 +1,518 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"math/big"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// memoryDb is a Db keeping all payments in memory. It is safe for concurrent
+// use.
+type memoryDb struct {
+	mutex           sync.RWMutex
+	payments        map[ID]Payment
+	versions        map[ID][]PaymentVersion
+	unpublished     []paymentVersionKey
+	idempotencyKeys map[IdempotencyKey]IdempotencyRecord
+	subscriptions   []Subscription
+	deliveries      []WebhookDelivery
+}
+
+// paymentVersionKey identifies a version of a payment
+type paymentVersionKey struct {
+	ID      ID
+	Version int
+}
+
+// NewMemoryDb constructs a new empty in-memory Db
+func NewMemoryDb() Db {
+	return &memoryDb{
+		payments:        map[ID]Payment{},
+		versions:        map[ID][]PaymentVersion{},
+		idempotencyKeys: map[IdempotencyKey]IdempotencyRecord{},
+	}
+}
+
+// copyPayment returns a deep copy of the payment such that stored payments
+// never share memory with callers
+func copyPayment(payment Payment) Payment {
+	charges := payment.Attributes.ChargesInformation.SenderCharges
+	if charges != nil {
+		payment.Attributes.ChargesInformation.SenderCharges = append([]PaymentSenderCharge{}, charges...)
+	}
+	if payment.DeletedAt != nil {
+		deletedAt := *payment.DeletedAt
+		payment.DeletedAt = &deletedAt
+	}
+	return payment
+}
+
+// compareDecimals compares two decimal strings numerically. Invalid
+// decimals are ordered as zero.
+func compareDecimals(d1 string, d2 string) int {
+	r1, ok := new(big.Rat).SetString(d1)
+	if !ok {
+		r1 = new(big.Rat)
+	}
+	r2, ok := new(big.Rat).SetString(d2)
+	if !ok {
+		r2 = new(big.Rat)
+	}
+	return r1.Cmp(r2)
+}
+
+// comparePayments compares two payments in the order of the query
+func comparePayments(query PaymentQuery, p1 Payment, p2 Payment) int {
+	c := 0
+	switch query.Sort {
+	case PaymentSortProcessingDate:
+		c = strings.Compare(p1.Attributes.ProcessingDate, p2.Attributes.ProcessingDate)
+	case PaymentSortAmount:
+		c = compareDecimals(p1.Attributes.Amount, p2.Attributes.Amount)
+	}
+	if c == 0 {
+		c = bytes.Compare(p1.ID[:], p2.ID[:])
+	}
+	if query.Descending {
+		return -c
+	}
+	return c
+}
+
+func paymentMatches(f PaymentFilter, payment Payment) bool {
+	a := payment.Attributes
+	eq := func(filter string, value string) bool {
+		return filter == "" || filter == value
+	}
+	return eq(f.OrganisationID, payment.OrganisationID) &&
+		eq(f.Status, payment.Status) &&
+		eq(f.Currency, a.Currency) &&
+		eq(f.PaymentScheme, a.PaymentScheme) &&
+		eq(f.PaymentType, a.PaymentType) &&
+		eq(f.DebtorAccountNumber, a.DebtorParty.AccountNumber) &&
+		eq(f.BeneficiaryAccountNumber, a.BeneficiaryParty.AccountNumber) &&
+		(f.ProcessingDateFrom == "" || a.ProcessingDate >= f.ProcessingDateFrom) &&
+		(f.ProcessingDateTo == "" || a.ProcessingDate <= f.ProcessingDateTo) &&
+		(f.AmountMin == "" || compareDecimals(a.Amount, f.AmountMin) >= 0) &&
+		(f.AmountMax == "" || compareDecimals(a.Amount, f.AmountMax) <= 0)
+}
+
+// projectPayment returns the payment with only the queried fields
+func projectPayment(query PaymentQuery, payment Payment) (Payment, error) {
+	res := Payment{ID: payment.ID}
+	if query.hasField(PaymentFieldOrganisationID) {
+		res.OrganisationID = payment.OrganisationID
+	}
+	if query.hasField(PaymentFieldVersion) {
+		res.Version = payment.Version
+	}
+	if query.hasField(PaymentFieldStatus) {
+		res.Status = payment.Status
+	}
+	if query.hasField(PaymentFieldDeletedAt) {
+		res.DeletedAt = copyPayment(payment).DeletedAt
+	}
+	if query.hasField(PaymentFieldDeletedBy) {
+		res.DeletedBy = payment.DeletedBy
+	}
+	all, names := query.attributeFields()
+	if all {
+		res.Attributes = copyPayment(payment).Attributes
+		return res, nil
+	}
+	if len(names) == 0 {
+		return res, nil
+	}
+	attributes, err := projectAttributes(payment.Attributes, names)
+	res.Attributes = attributes
+	return res, err
+}
+
+func (db *memoryDb) GetPayments(ctx context.Context, query PaymentQuery) (*[]Payment, error) {
+	var ok bool
+	if query.Filter, ok = scopePaymentFilter(ctx, query.Filter); !ok {
+		return &[]Payment{}, nil
+	}
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	var after *Payment
+	if query.After != nil {
+		p, ok := db.payments[*query.After]
+		ok = ok && inOrganisationScope(ctx, p.OrganisationID)
+		if !ok && query.Sort != PaymentSortID && query.Sort != "" {
+			return &[]Payment{}, nil
+		}
+		// Payments sorted by id can continue after removed payments
+		p.ID = *query.After
+		after = &p
+	}
+	payments := make([]Payment, 0, len(db.payments))
+	for _, p := range db.payments {
+		if (p.DeletedAt == nil || query.IncludeDeleted) && paymentMatches(query.Filter, p) &&
+			(after == nil || comparePayments(query, p, *after) > 0) {
+			payments = append(payments, p)
+		}
+	}
+	sort.Slice(payments, func(i, j int) bool {
+		return comparePayments(query, payments[i], payments[j]) < 0
+	})
+	var res []Payment
+	for _, p := range payments[:IntMin(query.Size, len(payments))] {
+		projected, err := projectPayment(query, p)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, projected)
+	}
+	return &res, nil
+}
+
+func (db *memoryDb) GetPaymentByID(ctx context.Context, id ID, includeDeleted bool) (*Payment, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	payment, ok := db.payments[id]
+	if !ok || (payment.DeletedAt != nil && !includeDeleted) || !inOrganisationScope(ctx, payment.OrganisationID) {
+		return nil, ErrNotFound
+	}
+	payment = copyPayment(payment)
+	return &payment, nil
+}
+
+func (db *memoryDb) CreatePayment(ctx context.Context, organizationID string, attributes PaymentAttributes) (*ID, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	id := primitive.NewObjectID()
+	payment := copyPayment(Payment{
+		ID:             id,
+		OrganisationID: organizationID,
+		Version:        0,
+		Status:         PaymentStatusCreated,
+		Attributes:     attributes,
+	})
+	db.payments[id] = payment
+	db.addVersion(ctx, PaymentEventCreated, payment)
+	return &id, nil
+}
+
+// modifyPayment applies the modification to the payment, increments its
+// version and records the event if the check passes
+func (db *memoryDb) modifyPayment(ctx context.Context, id ID, event string, check func(Payment) error, modify func(*Payment)) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	payment, ok := db.payments[id]
+	if !ok || !inOrganisationScope(ctx, payment.OrganisationID) {
+		return ErrNotFound
+	}
+	if err := check(payment); err == errNothingToDo {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	modify(&payment)
+	payment.Version++
+	db.payments[id] = copyPayment(payment)
+	db.addVersion(ctx, event, payment)
+	return nil
+}
+
+// addVersion records the event leading to the payment while holding the
+// lock, such that the version is recorded atomically with the modification
+func (db *memoryDb) addVersion(ctx context.Context, event string, payment Payment) {
+	db.versions[payment.ID] = append(db.versions[payment.ID], newPaymentVersion(ctx, event, copyPayment(payment)))
+	db.unpublished = append(db.unpublished, paymentVersionKey{ID: payment.ID, Version: payment.Version})
+}
+
+func (db *memoryDb) UpdatePayment(ctx context.Context, id ID, organizationID string, version int, attributes PaymentAttributes) error {
+	return db.modifyPayment(ctx, id, PaymentEventUpdated, func(payment Payment) error {
+		return checkPaymentUpdate(payment, version)
+	}, func(payment *Payment) {
+		payment.OrganisationID = organizationID
+		payment.Attributes = attributes
+	})
+}
+
+func (db *memoryDb) UpdatePaymentStatus(ctx context.Context, id ID, version int, status string) error {
+	return db.modifyPayment(ctx, id, PaymentEventStatusChanged, func(payment Payment) error {
+		return checkPaymentTransition(payment, version, status)
+	}, func(payment *Payment) {
+		payment.Status = status
+	})
+}
+
+func (db *memoryDb) DeletePayment(ctx context.Context, id ID) error {
+	deletedAt := now()
+	return db.modifyPayment(ctx, id, PaymentEventDeleted, checkPaymentDelete, func(payment *Payment) {
+		payment.DeletedAt = &deletedAt
+		payment.DeletedBy = contextActor(ctx)
+	})
+}
+
+func (db *memoryDb) RestorePayment(ctx context.Context, id ID) error {
+	return db.modifyPayment(ctx, id, PaymentEventRestored, checkPaymentRestore, func(payment *Payment) {
+		payment.DeletedAt = nil
+		payment.DeletedBy = ""
+	})
+}
+
+// inScope returns whether the payment exists, also when deleted, and the
+// context may access it
+func (db *memoryDb) inScope(ctx context.Context, id ID) bool {
+	payment, ok := db.payments[id]
+	return ok && inOrganisationScope(ctx, payment.OrganisationID)
+}
+
+func (db *memoryDb) GetPaymentVersions(ctx context.Context, id ID) (*[]PaymentVersion, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	if !db.inScope(ctx, id) {
+		return nil, ErrNotFound
+	}
+	res := []PaymentVersion{}
+	for _, v := range db.versions[id] {
+		v.Payment = copyPayment(v.Payment)
+		res = append(res, v)
+	}
+	return &res, nil
+}
+
+func (db *memoryDb) GetPaymentVersion(ctx context.Context, id ID, version int) (*PaymentVersion, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	if !db.inScope(ctx, id) {
+		return nil, ErrNotFound
+	}
+	if v := db.getVersion(id, version); v != nil {
+		return v, nil
+	}
+	return nil, ErrNotFound
+}
+
+func (db *memoryDb) getVersion(id ID, version int) *PaymentVersion {
+	for _, v := range db.versions[id] {
+		if v.Version == version {
+			v.Payment = copyPayment(v.Payment)
+			return &v
+		}
+	}
+	return nil
+}
+
+func (db *memoryDb) GetUnpublishedPaymentVersions(ctx context.Context, size int) (*[]PaymentVersion, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	res := []PaymentVersion{}
+	for _, key := range db.unpublished[:IntMin(size, len(db.unpublished))] {
+		res = append(res, *db.getVersion(key.ID, key.Version))
+	}
+	return &res, nil
+}
+
+func (db *memoryDb) MarkPaymentVersionPublished(ctx context.Context, id ID, version int) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	for i, key := range db.unpublished {
+		if key == (paymentVersionKey{ID: id, Version: version}) {
+			db.unpublished = append(db.unpublished[:i], db.unpublished[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (db *memoryDb) ReserveIdempotencyKey(ctx context.Context, record IdempotencyRecord) (*IdempotencyRecord, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	now := time.Now()
+	for key, r := range db.idempotencyKeys {
+		if !r.ExpiresAt.After(now) {
+			delete(db.idempotencyKeys, key)
+		}
+	}
+	if existing, ok := db.idempotencyKeys[record.ID]; ok {
+		return &existing, nil
+	}
+	db.idempotencyKeys[record.ID] = record
+	return nil, nil
+}
+
+func (db *memoryDb) SaveIdempotencyKey(ctx context.Context, record IdempotencyRecord) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if existing, ok := db.idempotencyKeys[record.ID]; ok {
+		existing.Status = record.Status
+		existing.Body = append([]byte{}, record.Body...)
+		existing.ExpiresAt = record.ExpiresAt
+		db.idempotencyKeys[record.ID] = existing
+	}
+	return nil
+}
+
+func (db *memoryDb) ReleaseIdempotencyKey(ctx context.Context, key IdempotencyKey) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	delete(db.idempotencyKeys, key)
+	return nil
+}
+
+// copySubscription returns a deep copy of the subscription
+func copySubscription(subscription Subscription) Subscription {
+	subscription.EventTypes = append([]string{}, subscription.EventTypes...)
+	return subscription
+}
+
+// copyWebhookDelivery returns a deep copy of the delivery
+func copyWebhookDelivery(delivery WebhookDelivery) WebhookDelivery {
+	delivery.Payload = append([]byte{}, delivery.Payload...)
+	delivery.Attempts = append([]WebhookAttempt{}, delivery.Attempts...)
+	return delivery
+}
+
+func (db *memoryDb) CreateSubscription(ctx context.Context, organisationID string, url string, eventTypes []string, secret string) (*Subscription, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	subscription := copySubscription(Subscription{
+		ID:             primitive.NewObjectID(),
+		OrganisationID: organisationID,
+		URL:            url,
+		EventTypes:     eventTypes,
+		Secret:         secret,
+		CreatedAt:      now(),
+	})
+	db.subscriptions = append(db.subscriptions, subscription)
+	subscription = copySubscription(subscription)
+	return &subscription, nil
+}
+
+func (db *memoryDb) GetSubscriptions(ctx context.Context) (*[]Subscription, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	res := []Subscription{}
+	for _, s := range db.subscriptions {
+		if inOrganisationScope(ctx, s.OrganisationID) {
+			res = append(res, copySubscription(s))
+		}
+	}
+	return &res, nil
+}
+
+func (db *memoryDb) GetSubscriptionByID(ctx context.Context, id ID) (*Subscription, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	for _, s := range db.subscriptions {
+		if s.ID == id && inOrganisationScope(ctx, s.OrganisationID) {
+			s = copySubscription(s)
+			return &s, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (db *memoryDb) DeleteSubscription(ctx context.Context, id ID) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	subscriptions := []Subscription{}
+	for _, s := range db.subscriptions {
+		if s.ID != id {
+			subscriptions = append(subscriptions, s)
+		} else if !inOrganisationScope(ctx, s.OrganisationID) {
+			return ErrNotFound
+		}
+	}
+	if len(subscriptions) == len(db.subscriptions) {
+		return ErrNotFound
+	}
+	deliveries := []WebhookDelivery{}
+	for _, d := range db.deliveries {
+		if d.SubscriptionID != id {
+			deliveries = append(deliveries, d)
+		}
+	}
+	db.subscriptions, db.deliveries = subscriptions, deliveries
+	return nil
+}
+
+func (db *memoryDb) CreateWebhookDelivery(ctx context.Context, delivery WebhookDelivery) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	for _, d := range db.deliveries {
+		if d.SubscriptionID == delivery.SubscriptionID && d.PaymentID == delivery.PaymentID &&
+			d.Version == delivery.Version {
+			return nil
+		}
+	}
+	delivery.ID = primitive.NewObjectID()
+	db.deliveries = append(db.deliveries, copyWebhookDelivery(delivery))
+	return nil
+}
+
+func (db *memoryDb) GetDueWebhookDeliveries(ctx context.Context, before time.Time, size int) (*[]WebhookDelivery, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	res := []WebhookDelivery{}
+	for _, d := range db.deliveries {
+		if d.Status == WebhookDeliveryPending && !d.NextAttemptAt.After(before) {
+			res = append(res, copyWebhookDelivery(d))
+		}
+	}
+	sort.SliceStable(res, func(i, j int) bool {
+		return res[i].NextAttemptAt.Before(res[j].NextAttemptAt)
+	})
+	res = res[:IntMin(size, len(res))]
+	return &res, nil
+}
+
+func (db *memoryDb) SaveWebhookDelivery(ctx context.Context, delivery WebhookDelivery) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	for i, d := range db.deliveries {
+		if d.ID == delivery.ID {
+			d.Status = delivery.Status
+			d.Attempts = delivery.Attempts
+			d.NextAttemptAt = delivery.NextAttemptAt
+			db.deliveries[i] = copyWebhookDelivery(d)
+		}
+	}
+	return nil
+}
+
+func (db *memoryDb) GetWebhookDeliveries(ctx context.Context, subscriptionID ID) (*[]WebhookDelivery, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	res := []WebhookDelivery{}
+	for _, d := range db.deliveries {
+		if d.SubscriptionID == subscriptionID {
+			res = append(res, copyWebhookDelivery(d))
+		}
+	}
+	return &res, nil
+}
+
+func (db *memoryDb) Connect(ctx context.Context) error {
+	return nil
+}
+
+func (db *memoryDb) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (db *memoryDb) Close(ctx context.Context) error {
+	return nil
+}
+
+func (db *memoryDb) Drop(ctx context.Context) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	db.payments = map[ID]Payment{}
+	db.versions = map[ID][]PaymentVersion{}
+	db.unpublished = nil
+	db.subscriptions = nil
+	db.deliveries = nil
+	db.idempotencyKeys = map[IdempotencyKey]IdempotencyRecord{}
+	return nil
+}
@@ -0,0 +1,140 @@
+package main_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+
+	. "./"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("MemoryDb", func() {
+	var memDb Db
+
+	BeforeEach(func() {
+		memDb = NewMemoryDb()
+	})
+
+	create := func(n int) []ID {
+		ids := make([]ID, n)
+		for i := range ids {
+			id, err := memDb.CreatePayment(testCtx, paymentSample.OrganisationID, paymentSample.Attributes)
+			Expect(err).To(BeNil())
+			ids[i] = *id
+		}
+		return ids
+	}
+
+	Describe("GetPayments", func() {
+		It("should list payments ordered by id", func() {
+			ids := create(20)
+			res, err := memDb.GetPayments(testCtx, PaymentQuery{Size: 30})
+			Expect(err).To(BeNil())
+			Expect(*res).To(HaveLen(20))
+			for i, v := range *res {
+				Expect(v.ID).To(Equal(ids[i]))
+			}
+		})
+		It("should limit the output", func() {
+			create(20)
+			res, _ := memDb.GetPayments(testCtx, PaymentQuery{Size: 5})
+			Expect(*res).To(HaveLen(5))
+		})
+		It("should fetch after", func() {
+			ids := create(20)
+			res, _ := memDb.GetPayments(testCtx, PaymentQuery{Size: 2, After: &ids[10]})
+			Expect(*res).To(Equal([]Payment{{ID: ids[11]}, {ID: ids[12]}}))
+		})
+		It("should be empty when nothing is after", func() {
+			ids := create(2)
+			res, _ := memDb.GetPayments(testCtx, PaymentQuery{Size: 2, After: &ids[1]})
+			Expect(*res).To(BeEmpty())
+		})
+	})
+
+	Describe("CreatePayment", func() {
+		It("should be possible to fetch newly created resource", func() {
+			id := create(1)[0]
+			payment, err := memDb.GetPaymentByID(testCtx, id, false)
+			Expect(err).To(BeNil())
+			Expect(*payment).To(Equal(Payment{
+				ID:             id,
+				OrganisationID: paymentSample.OrganisationID,
+				Version:        0,
+				Status:         PaymentStatusCreated,
+				Attributes:     paymentSample.Attributes,
+			}))
+		})
+		It("should not share memory with the caller", func() {
+			id := create(1)[0]
+			payment, _ := memDb.GetPaymentByID(testCtx, id, false)
+			payment.Attributes.ChargesInformation.SenderCharges[0].Amount = "0.00"
+			payment, _ = memDb.GetPaymentByID(testCtx, id, false)
+			Expect(payment.Attributes).To(Equal(paymentSample.Attributes))
+		})
+	})
+
+	Describe("UpdatePayment", func() {
+		It("should update and increment version", func() {
+			id := create(1)[0]
+			Expect(memDb.UpdatePayment(testCtx, id, "org", 0, paymentSample.Attributes)).To(BeNil())
+			Expect(memDb.UpdatePayment(testCtx, id, "org", 1, paymentSample.Attributes)).To(BeNil())
+			payment, _ := memDb.GetPaymentByID(testCtx, id, false)
+			Expect(payment.Version).To(Equal(2))
+			Expect(payment.OrganisationID).To(Equal("org"))
+		})
+		It("should fail on version conflict", func() {
+			id := create(1)[0]
+			_ = memDb.UpdatePayment(testCtx, id, "org", 0, paymentSample.Attributes)
+			err := memDb.UpdatePayment(testCtx, id, "org2", 0, paymentSample.Attributes)
+			Expect(err).To(Equal(&VersionConflictError{Version: 1}))
+		})
+		It("should let exactly one concurrent update win", func() {
+			id := create(1)[0]
+			var wg sync.WaitGroup
+			errs := make(chan error, 10)
+			for i := 0; i < 10; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					errs <- memDb.UpdatePayment(testCtx, id, "org", 0, paymentSample.Attributes)
+				}()
+			}
+			wg.Wait()
+			close(errs)
+			succeeded := 0
+			for err := range errs {
+				if err == nil {
+					succeeded++
+				}
+			}
+			Expect(succeeded).To(Equal(1))
+		})
+	})
+
+	Describe("DeletePayment", func() {
+		It("should delete an existing payment", func() {
+			id := create(1)[0]
+			Expect(memDb.DeletePayment(testCtx, id)).To(BeNil())
+			payment, _ := memDb.GetPaymentByID(testCtx, id, false)
+			Expect(payment).To(BeNil())
+		})
+	})
+
+	It("should serve the API", func() {
+		c := context.WithValue(testCtx, ContextDb, memDb)
+		w := performRequestBody(c, "POST", "/v1/payments", strings.NewReader(paymentRequestJSON))
+		Expect(w.Code).To(Equal(http.StatusCreated))
+		w = performRequest(c, "GET", "/v1/payments")
+		Expect(w.Code).To(Equal(http.StatusOK))
+		var res struct {
+			Data []struct{} `json:"data"`
+		}
+		_ = json.NewDecoder(w.Body).Decode(&res)
+		Expect(res.Data).To(HaveLen(1))
+	})
+})
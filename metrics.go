@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics are the Prometheus metrics of the service
+type Metrics struct {
+	registry         *prometheus.Registry
+	requests         *prometheus.CounterVec
+	requestDuration  *prometheus.HistogramVec
+	requestsInFlight prometheus.Gauge
+	dbDuration       *prometheus.HistogramVec
+	dbErrors         *prometheus.CounterVec
+	configReloads    *prometheus.CounterVec
+	configReloaded   prometheus.Gauge
+}
+
+// NewMetrics constructs the metrics of the service in a new registry
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "http_requests_total",
+			Help: "Number of HTTP requests by method, route and status.",
+		}, []string{"method", "route", "status"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "http_request_duration_seconds",
+			Help:    "Latency of HTTP requests by method, route and status.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"method", "route", "status"}),
+		requestsInFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "http_requests_in_flight",
+			Help: "Number of HTTP requests being served.",
+		}),
+		dbDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "db_operation_duration_seconds",
+			Help:    "Latency of database operations by operation.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"operation"}),
+		dbErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "db_operation_errors_total",
+			Help: "Number of failed database operations by operation.",
+		}, []string{"operation"}),
+		configReloads: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "config_reloads_total",
+			Help: "Number of configuration reloads by result.",
+		}, []string{"result"}),
+		configReloaded: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "config_last_reload_success_timestamp_seconds",
+			Help: "Unix time of the last successful configuration reload.",
+		}),
+	}
+	m.registry.MustRegister(m.requests, m.requestDuration, m.requestsInFlight, m.dbDuration, m.dbErrors,
+		m.configReloads, m.configReloaded, prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
+	return m
+}
+
+// Handler serves the metrics in the Prometheus exposition format
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// requestMethods are the methods requests are labelled with, other methods
+// are labelled "OTHER" such that arbitrary methods do not create series
+var requestMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodPost:    true,
+	http.MethodPut:     true,
+	http.MethodPatch:   true,
+	http.MethodDelete:  true,
+	http.MethodConnect: true,
+	http.MethodOptions: true,
+	http.MethodTrace:   true,
+}
+
+// requestMethod returns the method label of a request
+func requestMethod(r *http.Request) string {
+	if requestMethods[r.Method] {
+		return r.Method
+	}
+	return "OTHER"
+}
+
+// requestRoute returns the chi route pattern of a served request, or
+// "unmatched" for unknown routes
+func requestRoute(r *http.Request) string {
+	rctx := chi.RouteContext(r.Context())
+	if rctx == nil {
+		return "unmatched"
+	}
+	// Patterns keep the wildcards of mounts, and requests of unknown routes
+	// only match the wildcard of a mount
+	pattern := strings.Replace(rctx.RoutePattern(), "/*/", "/", -1)
+	if pattern == "" || strings.HasSuffix(pattern, "*") {
+		return "unmatched"
+	}
+	return pattern
+}
+
+// responseStatus returns the status written to the response, which is 200
+// when only a body was written
+func responseStatus(w middleware.WrapResponseWriter) int {
+	if w.Status() == 0 {
+		return http.StatusOK
+	}
+	return w.Status()
+}
+
+// Middleware records the count, latency and status of requests by the method
+// and chi route pattern. Requests of unknown routes are labelled "unmatched"
+// such that arbitrary paths do not create series.
+func (m *Metrics) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.requestsInFlight.Inc()
+		defer m.requestsInFlight.Dec()
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+		labels := prometheus.Labels{"method": requestMethod(r), "route": requestRoute(r),
+			"status": strconv.Itoa(responseStatus(ww))}
+		m.requests.With(labels).Inc()
+		m.requestDuration.With(labels).Observe(time.Since(start).Seconds())
+	})
+}
+
+// observeDb records the latency and failure of a database operation. Not
+// finding an entity is no failure.
+func (m *Metrics) observeDb(operation string, start time.Time, err error) {
+	m.dbDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+	if err != nil && ErrorKind(err) != ErrNotFound {
+		m.dbErrors.WithLabelValues(operation).Inc()
+	}
+}
+
+// observeConfigReload records the result of a configuration reload
+func (m *Metrics) observeConfigReload(err error) {
+	if err != nil {
+		m.configReloads.WithLabelValues("failure").Inc()
+		return
+	}
+	m.configReloads.WithLabelValues("success").Inc()
+	m.configReloaded.SetToCurrentTime()
+}
+
+// metricsDb records the metrics of the operations of a database
+type metricsDb struct {
+	db      Db
+	metrics *Metrics
+}
+
+// InstrumentDb decorates the database with metrics of its operations
+func (m *Metrics) InstrumentDb(db Db) Db {
+	return &metricsDb{db: db, metrics: m}
+}
+
+func (d *metricsDb) GetPayments(ctx context.Context, query PaymentQuery) (*[]Payment, error) {
+	start := time.Now()
+	res, err := d.db.GetPayments(ctx, query)
+	d.metrics.observeDb("GetPayments", start, err)
+	return res, err
+}
+
+func (d *metricsDb) GetPaymentByID(ctx context.Context, id ID, includeDeleted bool) (*Payment, error) {
+	start := time.Now()
+	res, err := d.db.GetPaymentByID(ctx, id, includeDeleted)
+	d.metrics.observeDb("GetPaymentByID", start, err)
+	return res, err
+}
+
+func (d *metricsDb) CreatePayment(ctx context.Context, organizationID string, attributes PaymentAttributes) (*ID, error) {
+	start := time.Now()
+	res, err := d.db.CreatePayment(ctx, organizationID, attributes)
+	d.metrics.observeDb("CreatePayment", start, err)
+	return res, err
+}
+
+func (d *metricsDb) UpdatePayment(ctx context.Context, ID ID, organizationID string, version int, attributes PaymentAttributes) error {
+	start := time.Now()
+	err := d.db.UpdatePayment(ctx, ID, organizationID, version, attributes)
+	d.metrics.observeDb("UpdatePayment", start, err)
+	return err
+}
+
+func (d *metricsDb) UpdatePaymentStatus(ctx context.Context, ID ID, version int, status string) error {
+	start := time.Now()
+	err := d.db.UpdatePaymentStatus(ctx, ID, version, status)
+	d.metrics.observeDb("UpdatePaymentStatus", start, err)
+	return err
+}
+
+func (d *metricsDb) DeletePayment(ctx context.Context, ID ID) error {
+	start := time.Now()
+	err := d.db.DeletePayment(ctx, ID)
+	d.metrics.observeDb("DeletePayment", start, err)
+	return err
+}
+
+func (d *metricsDb) RestorePayment(ctx context.Context, ID ID) error {
+	start := time.Now()
+	err := d.db.RestorePayment(ctx, ID)
+	d.metrics.observeDb("RestorePayment", start, err)
+	return err
+}
+
+func (d *metricsDb) GetPaymentVersions(ctx context.Context, ID ID) (*[]PaymentVersion, error) {
+	start := time.Now()
+	res, err := d.db.GetPaymentVersions(ctx, ID)
+	d.metrics.observeDb("GetPaymentVersions", start, err)
+	return res, err
+}
+
+func (d *metricsDb) GetPaymentVersion(ctx context.Context, ID ID, version int) (*PaymentVersion, error) {
+	start := time.Now()
+	res, err := d.db.GetPaymentVersion(ctx, ID, version)
+	d.metrics.observeDb("GetPaymentVersion", start, err)
+	return res, err
+}
+
+func (d *metricsDb) GetUnpublishedPaymentVersions(ctx context.Context, size int) (*[]PaymentVersion, error) {
+	start := time.Now()
+	res, err := d.db.GetUnpublishedPaymentVersions(ctx, size)
+	d.metrics.observeDb("GetUnpublishedPaymentVersions", start, err)
+	return res, err
+}
+
+func (d *metricsDb) MarkPaymentVersionPublished(ctx context.Context, ID ID, version int) error {
+	start := time.Now()
+	err := d.db.MarkPaymentVersionPublished(ctx, ID, version)
+	d.metrics.observeDb("MarkPaymentVersionPublished", start, err)
+	return err
+}
+
+func (d *metricsDb) ReserveIdempotencyKey(ctx context.Context, record IdempotencyRecord) (*IdempotencyRecord, error) {
+	start := time.Now()
+	res, err := d.db.ReserveIdempotencyKey(ctx, record)
+	d.metrics.observeDb("ReserveIdempotencyKey", start, err)
+	return res, err
+}
+
+func (d *metricsDb) SaveIdempotencyKey(ctx context.Context, record IdempotencyRecord) error {
+	start := time.Now()
+	err := d.db.SaveIdempotencyKey(ctx, record)
+	d.metrics.observeDb("SaveIdempotencyKey", start, err)
+	return err
+}
+
+func (d *metricsDb) ReleaseIdempotencyKey(ctx context.Context, key IdempotencyKey) error {
+	start := time.Now()
+	err := d.db.ReleaseIdempotencyKey(ctx, key)
+	d.metrics.observeDb("ReleaseIdempotencyKey", start, err)
+	return err
+}
+
+func (d *metricsDb) CreateSubscription(ctx context.Context, organisationID string, url string, eventTypes []string, secret string) (*Subscription, error) {
+	start := time.Now()
+	res, err := d.db.CreateSubscription(ctx, organisationID, url, eventTypes, secret)
+	d.metrics.observeDb("CreateSubscription", start, err)
+	return res, err
+}
+
+func (d *metricsDb) GetSubscriptions(ctx context.Context) (*[]Subscription, error) {
+	start := time.Now()
+	res, err := d.db.GetSubscriptions(ctx)
+	d.metrics.observeDb("GetSubscriptions", start, err)
+	return res, err
+}
+
+func (d *metricsDb) GetSubscriptionByID(ctx context.Context, ID ID) (*Subscription, error) {
+	start := time.Now()
+	res, err := d.db.GetSubscriptionByID(ctx, ID)
+	d.metrics.observeDb("GetSubscriptionByID", start, err)
+	return res, err
+}
+
+func (d *metricsDb) DeleteSubscription(ctx context.Context, ID ID) error {
+	start := time.Now()
+	err := d.db.DeleteSubscription(ctx, ID)
+	d.metrics.observeDb("DeleteSubscription", start, err)
+	return err
+}
+
+func (d *metricsDb) CreateWebhookDelivery(ctx context.Context, delivery WebhookDelivery) error {
+	start := time.Now()
+	err := d.db.CreateWebhookDelivery(ctx, delivery)
+	d.metrics.observeDb("CreateWebhookDelivery", start, err)
+	return err
+}
+
+func (d *metricsDb) GetDueWebhookDeliveries(ctx context.Context, before time.Time, size int) (*[]WebhookDelivery, error) {
+	start := time.Now()
+	res, err := d.db.GetDueWebhookDeliveries(ctx, before, size)
+	d.metrics.observeDb("GetDueWebhookDeliveries", start, err)
+	return res, err
+}
+
+func (d *metricsDb) SaveWebhookDelivery(ctx context.Context, delivery WebhookDelivery) error {
+	start := time.Now()
+	err := d.db.SaveWebhookDelivery(ctx, delivery)
+	d.metrics.observeDb("SaveWebhookDelivery", start, err)
+	return err
+}
+
+func (d *metricsDb) GetWebhookDeliveries(ctx context.Context, subscriptionID ID) (*[]WebhookDelivery, error) {
+	start := time.Now()
+	res, err := d.db.GetWebhookDeliveries(ctx, subscriptionID)
+	d.metrics.observeDb("GetWebhookDeliveries", start, err)
+	return res, err
+}
+
+func (d *metricsDb) Connect(ctx context.Context) error {
+	start := time.Now()
+	err := d.db.Connect(ctx)
+	d.metrics.observeDb("Connect", start, err)
+	return err
+}
+
+func (d *metricsDb) Ping(ctx context.Context) error {
+	start := time.Now()
+	err := d.db.Ping(ctx)
+	d.metrics.observeDb("Ping", start, err)
+	return err
+}
+
+func (d *metricsDb) Close(ctx context.Context) error {
+	start := time.Now()
+	err := d.db.Close(ctx)
+	d.metrics.observeDb("Close", start, err)
+	return err
+}
@@ -0,0 +1,79 @@
+package main_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+
+	. "./"
+	"github.com/go-chi/chi"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Metrics", func() {
+	var metrics *Metrics
+	var handler http.Handler
+
+	BeforeEach(func() {
+		metrics = NewMetrics()
+		r := chi.NewRouter()
+		r.Use(metrics.Middleware)
+		r.Handle("/metrics", metrics.Handler())
+		r.Mount("/", RootRoute())
+		handler = r
+	})
+
+	request := func(ctx context.Context, method, path string) int {
+		req := httptest.NewRequest(method, path, nil)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req.WithContext(ctx))
+		return w.Code
+	}
+	scrape := func() string {
+		req := httptest.NewRequest("GET", "/metrics", nil)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		Expect(w.Code).To(Equal(http.StatusOK))
+		body, _ := ioutil.ReadAll(w.Body)
+		return string(body)
+	}
+
+	It("should count requests by route pattern and status", func() {
+		ctx := context.WithValue(testCtx, ContextDb, metrics.InstrumentDb(mockDb{Payments: []Payment{paymentSample}}))
+		Expect(request(ctx, "GET", "/v1/payments/5cdd382e9549af35c3b94301")).To(Equal(http.StatusOK))
+		Expect(request(ctx, "GET", "/v1/payments/5cdd382e9549af35c3b94301")).To(Equal(http.StatusOK))
+		Expect(request(ctx, "GET", "/v1/payments/5cdd382e9549af35c3b94301/unknown")).To(Equal(http.StatusNotFound))
+		body := scrape()
+		Expect(body).To(ContainSubstring(
+			`http_requests_total{method="GET",route="/v1/payments/{paymentID}/",status="200"} 2`))
+		Expect(body).To(ContainSubstring(
+			`http_request_duration_seconds_count{method="GET",route="/v1/payments/{paymentID}/",status="200"} 2`))
+		Expect(body).To(ContainSubstring(`http_requests_total{method="GET",route="unmatched",status="404"} 1`))
+		Expect(body).ToNot(ContainSubstring("5cdd382e9549af35c3b94301"))
+		// Only the scrape itself is in flight
+		Expect(body).To(ContainSubstring("http_requests_in_flight 1"))
+	})
+
+	It("should label requests of non-standard methods as other", func() {
+		Expect(request(testCtx, "FOO", "/v1/payments/")).To(Equal(http.StatusMethodNotAllowed))
+		Expect(request(testCtx, "BAR", "/v1/payments/")).To(Equal(http.StatusMethodNotAllowed))
+		body := scrape()
+		Expect(body).To(MatchRegexp(`http_requests_total{method="OTHER",route="[^"]*",status="405"} 2`))
+		Expect(body).ToNot(ContainSubstring("FOO"))
+	})
+
+	It("should record the latency and errors of database operations", func() {
+		db := mockDb{Payments: []Payment{paymentSample}, error: errors.New("unavailable")}
+		ctx := context.WithValue(testCtx, ContextDb, metrics.InstrumentDb(db))
+		Expect(request(ctx, "GET", "/v1/payments/5cdd382e9549af35c3b94301/versions")).
+			To(Equal(http.StatusInternalServerError))
+		body := scrape()
+		Expect(body).To(ContainSubstring(`db_operation_duration_seconds_count{operation="GetPaymentByID"} 1`))
+		Expect(body).ToNot(ContainSubstring(`db_operation_errors_total{operation="GetPaymentByID"}`))
+		Expect(body).To(ContainSubstring(`db_operation_duration_seconds_count{operation="GetPaymentVersions"} 1`))
+		Expect(body).To(ContainSubstring(`db_operation_errors_total{operation="GetPaymentVersions"} 1`))
+	})
+})
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Publisher publishes payment events to downstream systems. Events are
+// delivered at least once, so subscribers should deduplicate them by payment
+// id and version.
+type Publisher interface {
+	Publish(ctx context.Context, event PaymentVersion) error
+}
+
+// NewPublisher constructs the publisher of the configuration, or nil when
+// events should not be published
+func NewPublisher(config *Config, db Db) (Publisher, error) {
+	switch config.EventPublisher {
+	case EventPublisherNone:
+		return nil, nil
+	case EventPublisherFile:
+		return NewFilePublisher(config, config.EventFile), nil
+	case EventPublisherWebhook:
+		return NewWebhookPublisher(config, db), nil
+	}
+	return nil, fmt.Errorf("unknown event publisher %q", config.EventPublisher)
+}
+
+// MemoryPublisher keeps published events in memory. It is safe for
+// concurrent use.
+type MemoryPublisher struct {
+	mutex  sync.Mutex
+	events []PaymentVersion
+}
+
+// NewMemoryPublisher constructs a new empty in-memory publisher
+func NewMemoryPublisher() *MemoryPublisher {
+	return &MemoryPublisher{}
+}
+
+// Publish stores the event
+func (p *MemoryPublisher) Publish(ctx context.Context, event PaymentVersion) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.events = append(p.events, event)
+	return nil
+}
+
+// Events returns the events published so far
+func (p *MemoryPublisher) Events() []PaymentVersion {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return append([]PaymentVersion{}, p.events...)
+}
+
+// filePublisher appends events as lines of JSON to a file
+type filePublisher struct {
+	config *Config
+	path   string
+	mutex  sync.Mutex
+}
+
+// NewFilePublisher constructs a publisher appending events to the file at the
+// path
+func NewFilePublisher(config *Config, path string) Publisher {
+	return &filePublisher{config: config, path: path}
+}
+
+func (p *filePublisher) Publish(ctx context.Context, event PaymentVersion) error {
+	line, err := json.Marshal(paymentVersionToRest(p.config, event))
+	if err != nil {
+		return err
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	f, err := os.OpenFile(p.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	// The event must be stored before it is marked as published
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Dispatcher publishes the events of the outbox. An event is marked as
+// published only after it has been published, so events are published again
+// if marking fails.
+type Dispatcher struct {
+	Db        Db
+	Publisher Publisher
+	Interval  time.Duration
+	BatchSize int
+}
+
+// NewDispatcher constructs a dispatcher publishing the events of the db
+func NewDispatcher(config *Config, db Db, publisher Publisher) *Dispatcher {
+	return &Dispatcher{Db: db, Publisher: publisher, Interval: config.EventDispatchInterval, BatchSize: 100}
+}
+
+// Dispatch publishes all pending events and returns how many were published.
+// Dispatching stops at the first failure, such that events of a payment are
+// published in order.
+func (d *Dispatcher) Dispatch(ctx context.Context) (int, error) {
+	n := 0
+	for {
+		events, err := d.Db.GetUnpublishedPaymentVersions(ctx, d.BatchSize)
+		if err != nil {
+			return n, err
+		}
+		for _, event := range *events {
+			if err = d.Publisher.Publish(ctx, event); err != nil {
+				return n, err
+			}
+			if err = d.Db.MarkPaymentVersionPublished(ctx, event.Payment.ID, event.Version); err != nil {
+				return n, err
+			}
+			n++
+		}
+		if len(*events) < d.BatchSize {
+			return n, nil
+		}
+	}
+}
+
+// Run dispatches events every interval until the context is done
+func (d *Dispatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(d.Interval)
+	defer ticker.Stop()
+	for {
+		if _, err := d.Dispatch(ctx); err != nil {
+			contextLogger(ctx).Error("failed to dispatch payment events", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
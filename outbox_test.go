@@ -0,0 +1,124 @@
+package main_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "./"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// failingPublisher fails after publishing the given number of events
+type failingPublisher struct {
+	*MemoryPublisher
+	remaining int
+}
+
+func (p *failingPublisher) Publish(ctx context.Context, event PaymentVersion) error {
+	if p.remaining == 0 {
+		return errors.New("unavailable")
+	}
+	p.remaining--
+	return p.MemoryPublisher.Publish(ctx, event)
+}
+
+var _ = Describe("Outbox", func() {
+	var memDb Db
+	var publisher *MemoryPublisher
+	var dispatcher *Dispatcher
+
+	BeforeEach(func() {
+		memDb = NewMemoryDb()
+		publisher = NewMemoryPublisher()
+		dispatcher = NewDispatcher(&testConfig, memDb, publisher)
+		dispatcher.BatchSize = 2
+	})
+
+	events := func(versions []PaymentVersion) []string {
+		var res []string
+		for _, v := range versions {
+			res = append(res, v.Event)
+		}
+		return res
+	}
+
+	It("should publish every modification once", func() {
+		id, _ := memDb.CreatePayment(testCtx, paymentSample.OrganisationID, paymentSample.Attributes)
+		Expect(memDb.UpdatePayment(testCtx, *id, "org", 0, paymentSample.Attributes)).To(Succeed())
+		Expect(memDb.DeletePayment(testCtx, *id)).To(Succeed())
+		n, err := dispatcher.Dispatch(testCtx)
+		Expect(err).To(BeNil())
+		Expect(n).To(Equal(3))
+		Expect(events(publisher.Events())).To(Equal([]string{
+			PaymentEventCreated, PaymentEventUpdated, PaymentEventDeleted}))
+		Expect(publisher.Events()[1].Payment.OrganisationID).To(Equal("org"))
+		n, err = dispatcher.Dispatch(testCtx)
+		Expect(err).To(BeNil())
+		Expect(n).To(Equal(0))
+		Expect(publisher.Events()).To(HaveLen(3))
+	})
+
+	It("should retry events which failed to publish", func() {
+		failing := &failingPublisher{MemoryPublisher: publisher, remaining: 1}
+		dispatcher.Publisher = failing
+		id, _ := memDb.CreatePayment(testCtx, paymentSample.OrganisationID, paymentSample.Attributes)
+		Expect(memDb.UpdatePayment(testCtx, *id, "org", 0, paymentSample.Attributes)).To(Succeed())
+		n, err := dispatcher.Dispatch(testCtx)
+		Expect(err).To(MatchError("unavailable"))
+		Expect(n).To(Equal(1))
+		failing.remaining = -1
+		n, err = dispatcher.Dispatch(testCtx)
+		Expect(err).To(BeNil())
+		Expect(n).To(Equal(1))
+		Expect(events(publisher.Events())).To(Equal([]string{PaymentEventCreated, PaymentEventUpdated}))
+	})
+
+	It("should not publish failed modifications", func() {
+		id, _ := memDb.CreatePayment(testCtx, paymentSample.OrganisationID, paymentSample.Attributes)
+		Expect(memDb.UpdatePayment(testCtx, *id, "org", 1, paymentSample.Attributes)).ToNot(Succeed())
+		n, _ := dispatcher.Dispatch(testCtx)
+		Expect(n).To(Equal(1))
+	})
+
+	It("should append events to a file", func() {
+		dir, err := ioutil.TempDir("", "events")
+		Expect(err).To(BeNil())
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "events.jsonl")
+		dispatcher.Publisher = NewFilePublisher(&testConfig, path)
+		id, _ := memDb.CreatePayment(testCtx, paymentSample.OrganisationID, paymentSample.Attributes)
+		Expect(memDb.UpdatePaymentStatus(testCtx, *id, 0, PaymentStatusCancelled)).To(Succeed())
+		_, err = dispatcher.Dispatch(testCtx)
+		Expect(err).To(BeNil())
+		raw, _ := ioutil.ReadFile(path)
+		lines := strings.Split(strings.TrimSpace(string(raw)), "\n")
+		Expect(lines).To(HaveLen(2))
+		var event struct {
+			Version int    `json:"version"`
+			Event   string `json:"event"`
+			Payment struct {
+				ID     string `json:"id"`
+				Status string `json:"status"`
+			} `json:"payment"`
+		}
+		Expect(json.Unmarshal([]byte(lines[1]), &event)).To(Succeed())
+		Expect(event.Version).To(Equal(1))
+		Expect(event.Event).To(Equal(PaymentEventStatusChanged))
+		Expect(event.Payment.ID).To(Equal(IDToString(*id)))
+		Expect(event.Payment.Status).To(Equal(PaymentStatusCancelled))
+	})
+
+	It("should construct publishers of the configuration", func() {
+		publisher, err := NewPublisher(&Config{EventPublisher: EventPublisherNone}, memDb)
+		Expect(err).To(BeNil())
+		Expect(publisher).To(BeNil())
+		_, err = NewPublisher(&Config{EventPublisher: "kafka"}, memDb)
+		Expect(err).To(MatchError(`unknown event publisher "kafka"`))
+	})
+})
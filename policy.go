@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+// Actions a role can be allowed to perform
+const (
+	ActionPaymentsRead        = "payments:read"
+	ActionPaymentsCreate      = "payments:create"
+	ActionPaymentsUpdate      = "payments:update"
+	ActionPaymentsDelete      = "payments:delete"
+	ActionPaymentsReadDeleted = "payments:read_deleted"
+	ActionSubscriptionsRead   = "subscriptions:read"
+	ActionSubscriptionsWrite  = "subscriptions:write"
+)
+
+var policyActions = map[string]bool{
+	ActionPaymentsRead:        true,
+	ActionPaymentsCreate:      true,
+	ActionPaymentsUpdate:      true,
+	ActionPaymentsDelete:      true,
+	ActionPaymentsReadDeleted: true,
+	ActionSubscriptionsRead:   true,
+	ActionSubscriptionsWrite:  true,
+}
+
+// Policy grants actions to roles and roles to principals
+type Policy struct {
+	// Roles maps the names of roles to the actions they are allowed
+	Roles map[string][]string `json:"roles"`
+	// Principals maps the names of API keys and the subjects of tokens to
+	// their roles, in addition to the roles claim of tokens
+	Principals map[string][]string `json:"principals"`
+}
+
+// LoadPolicy reads the JSON policy at the path
+func LoadPolicy(path string) (*Policy, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	policy := Policy{}
+	if err = json.Unmarshal(raw, &policy); err != nil {
+		return nil, fmt.Errorf("invalid policy %s: %v", path, err)
+	}
+	for role, actions := range policy.Roles {
+		for _, action := range actions {
+			if !policyActions[action] {
+				return nil, fmt.Errorf("invalid policy %s: unknown action %q of role %q", path, action, role)
+			}
+		}
+	}
+	return &policy, nil
+}
+
+// Allows returns whether any role of the principal is allowed the action
+func (p *Policy) Allows(principal *Principal, action string) bool {
+	roles := append(append([]string{}, principal.Roles...), p.Principals[principal.ID]...)
+	for _, role := range roles {
+		if containsString(p.Roles[role], action) {
+			return true
+		}
+	}
+	return false
+}
+
+// authorized returns whether the principal is allowed the action. Without a
+// policy, principals are only allowed actions while authentication is
+// disabled.
+func authorized(conf *Config, principal *Principal, action string) bool {
+	if conf.Policy == nil {
+		return conf.AuthDisabled
+	}
+	return conf.Policy.Allows(principal, action)
+}
+
+// authorize rejects requests of principals not allowed the action. Requests
+// without principal, which are only accepted while authentication is
+// disabled, are allowed.
+func authorize(action string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := r.Context()
+			conf := ctx.Value(ContextConfig).(*Config)
+			principal := contextPrincipal(ctx)
+			if principal != nil && !authorized(conf, principal, action) {
+				renderError(w, r, http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// authorizeIf authorizes the action for requests matching the condition, other
+// requests are passed on
+func authorizeIf(action string, condition func(r *http.Request) bool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		authorized := authorize(action)(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if condition(r) {
+				authorized.ServeHTTP(w, r)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,166 @@
+package main_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "./"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Policy", func() {
+	policy := &Policy{
+		Roles: map[string][]string{
+			"viewer":   {ActionPaymentsRead, ActionSubscriptionsRead},
+			"operator": {ActionPaymentsRead, ActionPaymentsCreate, ActionPaymentsUpdate, ActionSubscriptionsRead},
+			"admin": {ActionPaymentsRead, ActionPaymentsCreate, ActionPaymentsUpdate, ActionPaymentsDelete,
+				ActionPaymentsReadDeleted, ActionSubscriptionsRead, ActionSubscriptionsWrite},
+		},
+		Principals: map[string][]string{"ledger": {"admin"}},
+	}
+	config := testConfig
+	config.Policy = policy
+
+	type route struct {
+		method string
+		path   string
+		body   string
+		action string
+	}
+	routes := []route{
+		{"GET", "/v1/payments/", "", ActionPaymentsRead},
+		{"POST", "/v1/payments", paymentRequestJSON, ActionPaymentsCreate},
+		{"GET", "/v1/payments/{payment}", "", ActionPaymentsRead},
+		{"PUT", "/v1/payments/{payment}", versionedPaymentRequestJSON(0), ActionPaymentsUpdate},
+		{"PUT", "/v1/payments/{payment}/status", `{"status": "cancelled", "version": 0}`, ActionPaymentsUpdate},
+		{"DELETE", "/v1/payments/{payment}", "", ActionPaymentsDelete},
+		{"POST", "/v1/payments/{payment}/restore", "", ActionPaymentsDelete},
+		{"GET", "/v1/payments/{payment}/versions", "", ActionPaymentsRead},
+		{"GET", "/v1/payments/{payment}/versions/0", "", ActionPaymentsRead},
+		{"GET", "/v1/subscriptions/", "", ActionSubscriptionsRead},
+		{"POST", "/v1/subscriptions", `{"organisation_id": "743d5b63-8e6f-432e-a8fa-c5d8d2ee5fcb", "url": "https://example.org",
+			"event_types": ["payment.created"]}`,
+			ActionSubscriptionsWrite},
+		{"GET", "/v1/subscriptions/{subscription}", "", ActionSubscriptionsRead},
+		{"DELETE", "/v1/subscriptions/{subscription}", "", ActionSubscriptionsWrite},
+		{"GET", "/v1/subscriptions/{subscription}/deliveries", "", ActionSubscriptionsRead},
+		{"GET", "/v1/payments/?include_deleted=true", "", ActionPaymentsReadDeleted},
+		{"GET", "/v1/payments/{payment}?include_deleted=true", "", ActionPaymentsReadDeleted},
+	}
+
+	// perform performs the request of the route as the principal on a new db
+	perform := func(principal *Principal, rt route) *http.Response {
+		memDb := NewMemoryDb()
+		id, _ := memDb.CreatePayment(testCtx, paymentSample.OrganisationID, paymentSample.Attributes)
+		subscription, _ := memDb.CreateSubscription(testCtx, "", "https://example.org",
+			[]string{"payment.created"}, "secret")
+		ctx := context.WithValue(testCtx, ContextConfig, &config)
+		ctx = context.WithValue(ctx, ContextDb, memDb)
+		ctx = context.WithValue(ctx, ContextPrincipal, principal)
+		path := strings.NewReplacer("{payment}", IDToString(*id),
+			"{subscription}", IDToString(subscription.ID)).Replace(rt.path)
+		return performRequestBody(ctx, rt.method, path, strings.NewReader(rt.body)).Result()
+	}
+
+	for _, role := range []string{"viewer", "operator", "admin", "unknown"} {
+		role := role
+		It(fmt.Sprintf("should only allow the actions of the %s role", role), func() {
+			principal := &Principal{ID: "alice", Roles: []string{role}}
+			for _, rt := range routes {
+				res := perform(principal, rt)
+				if containsAction(policy.Roles[role], rt.action) {
+					Expect(res.StatusCode).ToNot(Equal(http.StatusForbidden), rt.method+" "+rt.path)
+				} else {
+					Expect(res.StatusCode).To(Equal(http.StatusForbidden), rt.method+" "+rt.path)
+					body, _ := ioutil.ReadAll(res.Body)
+					Expect(body).To(MatchJSON(`{"code": "forbidden", "message": "Forbidden"}`))
+				}
+			}
+		})
+	}
+
+	It("should refuse deleted payments to readers which are no admins", func() {
+		principal := &Principal{ID: "alice", Roles: []string{"operator"}}
+		Expect(perform(principal, route{"GET", "/v1/payments/", "", ""}).StatusCode).To(Equal(http.StatusOK))
+		Expect(perform(principal, route{"GET", "/v1/payments/?include_deleted=true", "", ""}).StatusCode).
+			To(Equal(http.StatusForbidden))
+		Expect(perform(principal, route{"GET", "/v1/payments/{payment}?include_deleted=1", "", ""}).StatusCode).
+			To(Equal(http.StatusForbidden))
+		Expect(perform(&Principal{ID: "ledger"}, route{"GET", "/v1/payments/?include_deleted=true", "", ""}).
+			StatusCode).To(Equal(http.StatusOK))
+	})
+
+	It("should grant the roles of the principal", func() {
+		res := perform(&Principal{ID: "ledger"}, routes[5])
+		Expect(res.StatusCode).To(Equal(http.StatusNoContent))
+	})
+
+	It("should deny every request without policy", func() {
+		config := testConfig
+		config.AuthDisabled = false
+		config.APIKeys = map[string]APIKey{"ledger": {Key: "ledger-key"}}
+		ctx := context.WithValue(context.WithValue(testCtx, ContextConfig, &config), ContextDb, NewMemoryDb())
+		headers := map[string]string{"X-API-Key": "ledger-key"}
+		w := performRequestHeaders(ctx, "GET", "/v1/payments/", nil, headers)
+		Expect(w.Code).To(Equal(http.StatusForbidden))
+		w = performRequestHeaders(ctx, "POST", "/v1/payments", strings.NewReader(paymentRequestJSON), headers)
+		Expect(w.Code).To(Equal(http.StatusForbidden))
+	})
+
+	It("should allow every request without policy while authentication is disabled", func() {
+		config := testConfig
+		ctx := context.WithValue(context.WithValue(testCtx, ContextConfig, &config), ContextDb, NewMemoryDb())
+		ctx = context.WithValue(ctx, ContextPrincipal, &Principal{ID: "alice"})
+		Expect(performRequest(ctx, "GET", "/v1/payments/").Code).To(Equal(http.StatusOK))
+	})
+
+	Describe("LoadPolicy", func() {
+		var dir string
+		BeforeEach(func() {
+			dir, _ = ioutil.TempDir("", "policy")
+		})
+		AfterEach(func() {
+			os.RemoveAll(dir)
+		})
+		write := func(content string) string {
+			path := filepath.Join(dir, "policy.json")
+			Expect(ioutil.WriteFile(path, []byte(content), 0644)).To(Succeed())
+			return path
+		}
+
+		It("should load policies", func() {
+			res, err := LoadPolicy(write(`{"roles": {"viewer": ["payments:read"]}, "principals": {"ledger": ["viewer"]}}`))
+			Expect(err).To(BeNil())
+			Expect(res).To(Equal(&Policy{
+				Roles:      map[string][]string{"viewer": {ActionPaymentsRead}},
+				Principals: map[string][]string{"ledger": {"viewer"}},
+			}))
+		})
+		It("should reject unknown actions", func() {
+			path := write(`{"roles": {"viewer": ["payments:approve"]}}`)
+			_, err := LoadPolicy(path)
+			Expect(err).To(MatchError(fmt.Sprintf(`invalid policy %s: unknown action "payments:approve" of role "viewer"`, path)))
+		})
+		It("should reject invalid files", func() {
+			_, err := LoadPolicy(write(`roles`))
+			Expect(err).ToNot(BeNil())
+			_, err = LoadPolicy(filepath.Join(dir, "missing.json"))
+			Expect(err).ToNot(BeNil())
+		})
+	})
+})
+
+func containsAction(actions []string, action string) bool {
+	for _, a := range actions {
+		if a == action {
+			return true
+		}
+	}
+	return false
+}
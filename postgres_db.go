@@ -0,0 +1,785 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// postgresMigrations are the schema migrations of the PostgreSQL storage.
+// Migrations are applied in order and exactly once, so existing entries must
+// never be changed; append new ones instead.
+var postgresMigrations = []string{
+	`CREATE TABLE payments (
+		id CHAR(24) PRIMARY KEY,
+		organisation_id TEXT NOT NULL,
+		version INTEGER NOT NULL,
+		attributes JSONB NOT NULL
+	)`,
+	`CREATE INDEX payments_organisation_id ON payments (organisation_id, id);
+	CREATE INDEX payments_processing_date ON payments ((attributes->>'processing_date'), id)`,
+	`CREATE TABLE idempotency_keys (
+		organisation_id TEXT NOT NULL,
+		key TEXT NOT NULL,
+		request_hash TEXT NOT NULL,
+		status INTEGER NOT NULL,
+		body BYTEA,
+		expires_at TIMESTAMPTZ NOT NULL,
+		PRIMARY KEY (organisation_id, key)
+	);
+	CREATE INDEX idempotency_keys_expires_at ON idempotency_keys (expires_at)`,
+	`ALTER TABLE payments ADD COLUMN status TEXT NOT NULL DEFAULT 'created'`,
+	`ALTER TABLE payments ADD COLUMN deleted_at TIMESTAMPTZ;
+	ALTER TABLE payments ADD COLUMN deleted_by TEXT NOT NULL DEFAULT ''`,
+	`CREATE TABLE payment_versions (
+		payment_id CHAR(24) NOT NULL,
+		version INTEGER NOT NULL,
+		event TEXT NOT NULL,
+		actor TEXT NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL,
+		organisation_id TEXT NOT NULL,
+		status TEXT NOT NULL,
+		attributes JSONB NOT NULL,
+		deleted_at TIMESTAMPTZ,
+		deleted_by TEXT NOT NULL,
+		PRIMARY KEY (payment_id, version)
+	)`,
+	`ALTER TABLE payment_versions ADD COLUMN published BOOLEAN NOT NULL DEFAULT FALSE;
+	CREATE INDEX payment_versions_unpublished ON payment_versions (created_at, payment_id, version) WHERE NOT published`,
+	`CREATE TABLE subscriptions (
+		id CHAR(24) PRIMARY KEY,
+		url TEXT NOT NULL,
+		event_types TEXT[] NOT NULL,
+		secret TEXT NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL
+	);
+	CREATE TABLE webhook_deliveries (
+		id CHAR(24) PRIMARY KEY,
+		subscription_id CHAR(24) NOT NULL REFERENCES subscriptions ON DELETE CASCADE,
+		payment_id CHAR(24) NOT NULL,
+		version INTEGER NOT NULL,
+		event_type TEXT NOT NULL,
+		payload BYTEA NOT NULL,
+		status TEXT NOT NULL,
+		attempts JSONB NOT NULL,
+		next_attempt_at TIMESTAMPTZ NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL,
+		UNIQUE (subscription_id, payment_id, version)
+	);
+	CREATE INDEX webhook_deliveries_due ON webhook_deliveries (next_attempt_at) WHERE status = 'pending'`,
+	`ALTER TABLE subscriptions ADD COLUMN organisation_id TEXT NOT NULL DEFAULT ''`,
+}
+
+// postgresDb is a Db backed by PostgreSQL. Attributes are stored as JSONB
+// with the same field names as in MongoDB.
+type postgresDb struct {
+	DB *sql.DB
+}
+
+// NewPostgresDb constructs a new Db backed by PostgreSQL
+func NewPostgresDb(config *Config) (Db, error) {
+	sqlDb, err := sql.Open("postgres", config.PostgresURI)
+	return &postgresDb{DB: sqlDb}, err
+}
+
+// postgresError returns the error of the driver as an error of a kind, see
+// ErrorKind. Errors of no known kind are returned as they are.
+func postgresError(err error) error {
+	if err == nil || ErrorKind(err) != nil {
+		return err
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	var e *pq.Error
+	if errors.As(err, &e) {
+		switch e.Code.Class() {
+		// integrity constraint violation, transaction rollback
+		case "23", "40":
+			return &DbError{Kind: ErrConflict, Err: err}
+		// data exception
+		case "22":
+			return &DbError{Kind: ErrInvalid, Err: err}
+		// connection exception, insufficient resources, operator intervention
+		case "08", "53", "57":
+			return &DbError{Kind: ErrUnavailable, Err: err}
+		}
+		return err
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) || errors.Is(err, driver.ErrBadConn) || errors.Is(err, sql.ErrConnDone) ||
+		errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return &DbError{Kind: ErrUnavailable, Err: err}
+	}
+	return err
+}
+
+// migrate applies all pending schema migrations. The migrations table is
+// locked while migrating, so concurrently starting instances wait for each
+// other.
+func (db *postgresDb) migrate(ctx context.Context) error {
+	_, err := db.DB.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`)
+	if err != nil {
+		return err
+	}
+	tx, err := db.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err = tx.ExecContext(ctx, "LOCK TABLE schema_migrations IN EXCLUSIVE MODE"); err != nil {
+		return err
+	}
+	var current int
+	if err = tx.QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&current); err != nil {
+		return err
+	}
+	for i := current; i < len(postgresMigrations); i++ {
+		if _, err = tx.ExecContext(ctx, postgresMigrations[i]); err != nil {
+			return err
+		}
+		if _, err = tx.ExecContext(ctx, "INSERT INTO schema_migrations (version) VALUES ($1)", i+1); err != nil {
+			return err
+		}
+		contextLogger(ctx).With("version", i+1).Info("applied migration")
+	}
+	return tx.Commit()
+}
+
+func (db *postgresDb) Connect(ctx context.Context) error {
+	if err := db.DB.PingContext(ctx); err != nil {
+		return postgresError(err)
+	}
+	return db.migrate(ctx)
+}
+
+func (db *postgresDb) Ping(ctx context.Context) error {
+	return postgresError(db.DB.PingContext(ctx))
+}
+
+func (db *postgresDb) Close(ctx context.Context) error {
+	return db.DB.Close()
+}
+
+func (db *postgresDb) Drop(ctx context.Context) error {
+	_, err := db.DB.ExecContext(ctx, "TRUNCATE payments, payment_versions, idempotency_keys, subscriptions, webhook_deliveries")
+	return postgresError(err)
+}
+
+// postgresSortExpressions maps sort fields to SQL expressions
+var postgresSortExpressions = map[string]string{
+	PaymentSortID:             "id",
+	PaymentSortProcessingDate: "attributes->>'processing_date'",
+	PaymentSortAmount:         "(attributes->>'amount')::numeric",
+}
+
+// postgresQuery builds a parameterised SQL condition
+type postgresQuery struct {
+	conditions []string
+	args       []interface{}
+}
+
+// arg adds an argument and returns its placeholder
+func (q *postgresQuery) arg(value interface{}) string {
+	q.args = append(q.args, value)
+	return fmt.Sprintf("$%d", len(q.args))
+}
+
+func (q *postgresQuery) where(condition string, value string) {
+	if value != "" {
+		q.conditions = append(q.conditions, fmt.Sprintf(condition, q.arg(value)))
+	}
+}
+
+func (q *postgresQuery) sql() string {
+	if len(q.conditions) == 0 {
+		return "TRUE"
+	}
+	return strings.Join(q.conditions, " AND ")
+}
+
+// postgresProjection returns the select list retrieving the queried fields,
+// with empty values for the remaining fields
+func postgresProjection(query PaymentQuery, q *postgresQuery) string {
+	organisationID, version, status, attributes := "''", "0", "''", "'{}'::jsonb"
+	deletedAt, deletedBy := "NULL::timestamptz", "''"
+	if query.hasField(PaymentFieldOrganisationID) {
+		organisationID = "organisation_id"
+	}
+	if query.hasField(PaymentFieldVersion) {
+		version = "version"
+	}
+	if query.hasField(PaymentFieldStatus) {
+		status = "status"
+	}
+	if query.hasField(PaymentFieldDeletedAt) {
+		deletedAt = "deleted_at"
+	}
+	if query.hasField(PaymentFieldDeletedBy) {
+		deletedBy = "deleted_by"
+	}
+	all, names := query.attributeFields()
+	if all {
+		attributes = "attributes"
+	} else if len(names) > 0 {
+		pairs := make([]string, len(names))
+		for i, name := range names {
+			n := q.arg(name)
+			pairs[i] = fmt.Sprintf("%s::text, attributes->%s", n, n)
+		}
+		attributes = fmt.Sprintf("jsonb_strip_nulls(jsonb_build_object(%s))", strings.Join(pairs, ", "))
+	}
+	return fmt.Sprintf("id, %s, %s, %s, %s, %s, %s",
+		organisationID, version, status, attributes, deletedAt, deletedBy)
+}
+
+func (db *postgresDb) GetPayments(ctx context.Context, query PaymentQuery) (*[]Payment, error) {
+	f, ok := scopePaymentFilter(ctx, query.Filter)
+	if !ok {
+		return &[]Payment{}, nil
+	}
+	q := postgresQuery{}
+	if !query.IncludeDeleted {
+		q.conditions = append(q.conditions, "deleted_at IS NULL")
+	}
+	q.where("organisation_id = %s", f.OrganisationID)
+	q.where("status = %s", f.Status)
+	q.where("attributes->>'currency' = %s", f.Currency)
+	q.where("attributes->>'payment_scheme' = %s", f.PaymentScheme)
+	q.where("attributes->>'payment_type' = %s", f.PaymentType)
+	q.where("attributes->'debtor_party'->>'account_number' = %s", f.DebtorAccountNumber)
+	q.where("attributes->'beneficiary_party'->>'account_number' = %s", f.BeneficiaryAccountNumber)
+	q.where("attributes->>'processing_date' >= %s", f.ProcessingDateFrom)
+	q.where("attributes->>'processing_date' <= %s", f.ProcessingDateTo)
+	q.where("(attributes->>'amount')::numeric >= %s::numeric", f.AmountMin)
+	q.where("(attributes->>'amount')::numeric <= %s::numeric", f.AmountMax)
+
+	sortExpr, ok := postgresSortExpressions[query.Sort]
+	if !ok {
+		sortExpr = "id"
+	}
+	op, direction := ">", "ASC"
+	if query.Descending {
+		op, direction = "<", "DESC"
+	}
+	order := "id " + direction
+	if sortExpr != "id" {
+		order = fmt.Sprintf("%s %s, %s", sortExpr, direction, order)
+	}
+	if query.After != nil && sortExpr == "id" {
+		q.where("id "+op+" %s", IDToString(*query.After))
+	} else if query.After != nil {
+		// Continue after the sort value of the last payment of the previous page
+		after, err := db.GetPaymentByID(ctx, *query.After, true)
+		if ErrorKind(err) == ErrNotFound {
+			return &[]Payment{}, nil
+		}
+		if err != nil {
+			return nil, postgresError(err)
+		}
+		cast := ""
+		if query.Sort == PaymentSortAmount {
+			cast = "::numeric"
+		}
+		q.conditions = append(q.conditions, fmt.Sprintf("(%s, id) %s (%s%s, %s)",
+			sortExpr, op, q.arg(query.sortValue(*after)), cast, q.arg(IDToString(after.ID))))
+	}
+
+	where := q.sql()
+	rows, err := db.DB.QueryContext(ctx,
+		fmt.Sprintf("SELECT %s FROM payments WHERE %s ORDER BY %s LIMIT %s",
+			postgresProjection(query, &q), where, order, q.arg(query.Size)),
+		q.args...)
+	if err != nil {
+		return nil, postgresError(err)
+	}
+	defer rows.Close()
+	var res []Payment
+	for rows.Next() {
+		payment, err := scanPostgresPayment(rows)
+		if err != nil {
+			return nil, postgresError(err)
+		}
+		res = append(res, *payment)
+	}
+	return &res, postgresError(rows.Err())
+}
+
+// postgresRow is either *sql.Row or *sql.Rows
+type postgresRow interface {
+	Scan(dest ...interface{}) error
+}
+
+// postgresPaymentColumns are the columns scanned by scanPostgresPayment
+const postgresPaymentColumns = "id, organisation_id, version, status, attributes, deleted_at, deleted_by"
+
+// scanPostgresPayment scans a row of postgresPaymentColumns followed by the
+// columns of dest
+func scanPostgresPayment(row postgresRow, dest ...interface{}) (*Payment, error) {
+	var idStr string
+	var attributes []byte
+	payment := Payment{}
+	err := row.Scan(append([]interface{}{&idStr, &payment.OrganisationID, &payment.Version, &payment.Status,
+		&attributes, &payment.DeletedAt, &payment.DeletedBy}, dest...)...)
+	if err != nil {
+		return nil, err
+	}
+	if payment.DeletedAt != nil {
+		deletedAt := payment.DeletedAt.UTC()
+		payment.DeletedAt = &deletedAt
+	}
+	id, err := StringToID(idStr)
+	if err != nil {
+		return nil, err
+	}
+	payment.ID = *id
+	if err = bson.UnmarshalExtJSON(attributes, false, &payment.Attributes); err != nil {
+		return nil, err
+	}
+	return &payment, nil
+}
+
+func (db *postgresDb) GetPaymentByID(ctx context.Context, id ID, includeDeleted bool) (*Payment, error) {
+	payment, err := scanPostgresPayment(db.DB.QueryRowContext(ctx,
+		`SELECT `+postgresPaymentColumns+` FROM payments
+		WHERE id = $1 AND ($2 OR deleted_at IS NULL) AND ($3 = '' OR organisation_id = $3)`,
+		IDToString(id), includeDeleted, contextOrganisation(ctx)))
+	if err != nil {
+		return nil, postgresError(err)
+	}
+	return payment, nil
+}
+
+func (db *postgresDb) CreatePayment(ctx context.Context, organizationID string, attributes PaymentAttributes) (*ID, error) {
+	a, err := bson.MarshalExtJSON(attributes, false, false)
+	if err != nil {
+		return nil, postgresError(err)
+	}
+	id := primitive.NewObjectID()
+	tx, err := db.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, postgresError(err)
+	}
+	defer tx.Rollback()
+	payment, err := scanPostgresPayment(tx.QueryRowContext(ctx,
+		`INSERT INTO payments (id, organisation_id, version, status, attributes) VALUES ($1, $2, 0, $3, $4)
+		RETURNING `+postgresPaymentColumns,
+		IDToString(id), organizationID, PaymentStatusCreated, string(a)))
+	if err != nil {
+		return nil, postgresError(err)
+	}
+	if err = insertPostgresPaymentVersion(ctx, tx, PaymentEventCreated, *payment); err != nil {
+		return nil, postgresError(err)
+	}
+	return &id, postgresError(tx.Commit())
+}
+
+// postgresPaymentVersionColumns are the columns of a payment version
+// following the columns of its payment
+const postgresPaymentVersionColumns = `payment_id, organisation_id, version, status, attributes, deleted_at, deleted_by,
+	event, actor, created_at`
+
+// insertPostgresPaymentVersion records the event leading to the payment
+func insertPostgresPaymentVersion(ctx context.Context, tx *sql.Tx, event string, payment Payment) error {
+	a, err := bson.MarshalExtJSON(payment.Attributes, false, false)
+	if err != nil {
+		return err
+	}
+	v := newPaymentVersion(ctx, event, payment)
+	_, err = tx.ExecContext(ctx,
+		"INSERT INTO payment_versions ("+postgresPaymentVersionColumns+") VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)",
+		IDToString(payment.ID), payment.OrganisationID, payment.Version, payment.Status, string(a),
+		payment.DeletedAt, payment.DeletedBy, v.Event, v.Actor, v.Timestamp)
+	return err
+}
+
+// scanPostgresPaymentVersion scans a row of postgresPaymentVersionColumns
+func scanPostgresPaymentVersion(row postgresRow) (*PaymentVersion, error) {
+	v := PaymentVersion{}
+	payment, err := scanPostgresPayment(row, &v.Event, &v.Actor, &v.Timestamp)
+	if err != nil {
+		return nil, err
+	}
+	v.Version = payment.Version
+	v.Timestamp = v.Timestamp.UTC()
+	v.Payment = *payment
+	return &v, nil
+}
+
+// postgresPaymentInScope matches the payment $1, also when deleted, if the
+// organisation $2 of the context may access it
+const postgresPaymentInScope = "EXISTS (SELECT 1 FROM payments WHERE id = $1 AND ($2 = '' OR organisation_id = $2))"
+
+func (db *postgresDb) GetPaymentVersions(ctx context.Context, id ID) (*[]PaymentVersion, error) {
+	rows, err := db.DB.QueryContext(ctx,
+		"SELECT "+postgresPaymentVersionColumns+" FROM payment_versions WHERE payment_id = $1 AND "+
+			postgresPaymentInScope+" ORDER BY version",
+		IDToString(id), contextOrganisation(ctx))
+	if err != nil {
+		return nil, postgresError(err)
+	}
+	defer rows.Close()
+	res := []PaymentVersion{}
+	for rows.Next() {
+		v, err := scanPostgresPaymentVersion(rows)
+		if err != nil {
+			return nil, postgresError(err)
+		}
+		res = append(res, *v)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, postgresError(err)
+	}
+	// Every payment has the version of its creation
+	if len(res) == 0 {
+		return nil, ErrNotFound
+	}
+	return &res, nil
+}
+
+func (db *postgresDb) GetUnpublishedPaymentVersions(ctx context.Context, size int) (*[]PaymentVersion, error) {
+	rows, err := db.DB.QueryContext(ctx,
+		"SELECT "+postgresPaymentVersionColumns+` FROM payment_versions WHERE NOT published
+		ORDER BY created_at, payment_id, version LIMIT $1`,
+		size)
+	if err != nil {
+		return nil, postgresError(err)
+	}
+	defer rows.Close()
+	res := []PaymentVersion{}
+	for rows.Next() {
+		v, err := scanPostgresPaymentVersion(rows)
+		if err != nil {
+			return nil, postgresError(err)
+		}
+		res = append(res, *v)
+	}
+	return &res, postgresError(rows.Err())
+}
+
+func (db *postgresDb) MarkPaymentVersionPublished(ctx context.Context, id ID, version int) error {
+	_, err := db.DB.ExecContext(ctx,
+		"UPDATE payment_versions SET published = TRUE WHERE payment_id = $1 AND version = $2",
+		IDToString(id), version)
+	return postgresError(err)
+}
+
+func (db *postgresDb) GetPaymentVersion(ctx context.Context, id ID, version int) (*PaymentVersion, error) {
+	v, err := scanPostgresPaymentVersion(db.DB.QueryRowContext(ctx,
+		"SELECT "+postgresPaymentVersionColumns+" FROM payment_versions WHERE payment_id = $1 AND version = $3 AND "+
+			postgresPaymentInScope,
+		IDToString(id), contextOrganisation(ctx), version))
+	if err != nil {
+		return nil, postgresError(err)
+	}
+	return v, nil
+}
+
+func (db *postgresDb) UpdatePayment(ctx context.Context, id ID, organizationID string, version int, attributes PaymentAttributes) error {
+	a, err := bson.MarshalExtJSON(attributes, false, false)
+	if err != nil {
+		return postgresError(err)
+	}
+	return db.modifyPayment(ctx, id, PaymentEventUpdated, func(payment Payment) error {
+		return checkPaymentUpdate(payment, version)
+	}, `UPDATE payments SET organisation_id = $2, attributes = $3, version = version + 1
+		WHERE id = $1 AND version = $4 AND status = ANY($5) AND deleted_at IS NULL`,
+		IDToString(id), organizationID, string(a), version, pq.Array(paymentUpdatableStatuses))
+}
+
+func (db *postgresDb) UpdatePaymentStatus(ctx context.Context, id ID, version int, status string) error {
+	return db.modifyPayment(ctx, id, PaymentEventStatusChanged, func(payment Payment) error {
+		return checkPaymentTransition(payment, version, status)
+	}, `UPDATE payments SET status = $2, version = version + 1
+		WHERE id = $1 AND version = $3 AND status = ANY($4) AND deleted_at IS NULL`,
+		IDToString(id), status, version, pq.Array(paymentTransitionSources(status)))
+}
+
+// modifyPayment runs the conditional update of the payment, restricted to
+// the organisation of the context, and records the event. If nothing was
+// modified, the error of the check is returned.
+func (db *postgresDb) modifyPayment(ctx context.Context, id ID, event string, check func(Payment) error, update string, args ...interface{}) error {
+	tx, err := db.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return postgresError(err)
+	}
+	defer tx.Rollback()
+	n := len(args) + 1
+	update += fmt.Sprintf(" AND ($%d = '' OR organisation_id = $%d) RETURNING %s", n, n, postgresPaymentColumns)
+	args = append(args, contextOrganisation(ctx))
+	payment, err := scanPostgresPayment(tx.QueryRowContext(ctx, update, args...))
+	if err == sql.ErrNoRows {
+		return db.checkNotModified(ctx, id, check)
+	}
+	if err != nil {
+		return postgresError(err)
+	}
+	if err = insertPostgresPaymentVersion(ctx, tx, event, *payment); err != nil {
+		return postgresError(err)
+	}
+	return postgresError(tx.Commit())
+}
+
+// checkNotModified returns the error of a conditional modification of the
+// payment which did not match
+func (db *postgresDb) checkNotModified(ctx context.Context, id ID, check func(Payment) error) error {
+	// Either the payment is gone or the check fails
+	payment, err := db.GetPaymentByID(ctx, id, true)
+	if err != nil {
+		return postgresError(err)
+	}
+	if err = check(*payment); err == errNothingToDo {
+		return nil
+	} else if err != nil {
+		return postgresError(err)
+	}
+	// Modified in the meantime
+	return &VersionConflictError{Version: payment.Version}
+}
+
+func (db *postgresDb) DeletePayment(ctx context.Context, id ID) error {
+	return db.modifyPayment(ctx, id, PaymentEventDeleted, checkPaymentDelete,
+		`UPDATE payments SET deleted_at = $2, deleted_by = $3, version = version + 1
+		WHERE id = $1 AND status = ANY($4) AND deleted_at IS NULL`,
+		IDToString(id), now(), contextActor(ctx), pq.Array(paymentDeletableStatuses))
+}
+
+func (db *postgresDb) RestorePayment(ctx context.Context, id ID) error {
+	return db.modifyPayment(ctx, id, PaymentEventRestored, checkPaymentRestore,
+		`UPDATE payments SET deleted_at = NULL, deleted_by = '', version = version + 1
+		WHERE id = $1 AND deleted_at IS NOT NULL`,
+		IDToString(id))
+}
+
+func (db *postgresDb) ReserveIdempotencyKey(ctx context.Context, record IdempotencyRecord) (*IdempotencyRecord, error) {
+	now := time.Now()
+	if _, err := db.DB.ExecContext(ctx, "DELETE FROM idempotency_keys WHERE expires_at <= $1", now); err != nil {
+		return nil, postgresError(err)
+	}
+	res, err := db.DB.ExecContext(ctx,
+		`INSERT INTO idempotency_keys (organisation_id, key, request_hash, status, body, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6) ON CONFLICT DO NOTHING`,
+		record.ID.OrganisationID, record.ID.Key, record.RequestHash, record.Status, record.Body, record.ExpiresAt)
+	if err != nil {
+		return nil, postgresError(err)
+	}
+	if n, err := res.RowsAffected(); err != nil || n > 0 {
+		return nil, postgresError(err)
+	}
+	existing := IdempotencyRecord{ID: record.ID}
+	err = db.DB.QueryRowContext(ctx,
+		"SELECT request_hash, status, body, expires_at FROM idempotency_keys WHERE organisation_id = $1 AND key = $2",
+		record.ID.OrganisationID, record.ID.Key).
+		Scan(&existing.RequestHash, &existing.Status, &existing.Body, &existing.ExpiresAt)
+	if err == sql.ErrNoRows {
+		// Released in the meantime
+		return db.ReserveIdempotencyKey(ctx, record)
+	}
+	if err != nil {
+		return nil, postgresError(err)
+	}
+	return &existing, nil
+}
+
+func (db *postgresDb) SaveIdempotencyKey(ctx context.Context, record IdempotencyRecord) error {
+	_, err := db.DB.ExecContext(ctx,
+		"UPDATE idempotency_keys SET status = $3, body = $4, expires_at = $5 WHERE organisation_id = $1 AND key = $2",
+		record.ID.OrganisationID, record.ID.Key, record.Status, record.Body, record.ExpiresAt)
+	return postgresError(err)
+}
+
+func (db *postgresDb) ReleaseIdempotencyKey(ctx context.Context, key IdempotencyKey) error {
+	_, err := db.DB.ExecContext(ctx,
+		"DELETE FROM idempotency_keys WHERE organisation_id = $1 AND key = $2", key.OrganisationID, key.Key)
+	return postgresError(err)
+}
+
+// postgresSubscriptionColumns are the columns scanned by
+// scanPostgresSubscription
+const postgresSubscriptionColumns = "id, organisation_id, url, event_types, secret, created_at"
+
+func scanPostgresSubscription(row postgresRow) (*Subscription, error) {
+	var idStr string
+	subscription := Subscription{}
+	err := row.Scan(&idStr, &subscription.OrganisationID, &subscription.URL, pq.Array(&subscription.EventTypes),
+		&subscription.Secret, &subscription.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	id, err := StringToID(idStr)
+	if err != nil {
+		return nil, err
+	}
+	subscription.ID = *id
+	subscription.CreatedAt = subscription.CreatedAt.UTC()
+	return &subscription, nil
+}
+
+func (db *postgresDb) CreateSubscription(ctx context.Context, organisationID string, url string, eventTypes []string, secret string) (*Subscription, error) {
+	subscription := Subscription{
+		ID:             primitive.NewObjectID(),
+		OrganisationID: organisationID,
+		URL:            url,
+		EventTypes:     eventTypes,
+		Secret:         secret,
+		CreatedAt:      now(),
+	}
+	_, err := db.DB.ExecContext(ctx,
+		"INSERT INTO subscriptions ("+postgresSubscriptionColumns+") VALUES ($1, $2, $3, $4, $5, $6)",
+		IDToString(subscription.ID), organisationID, url, pq.Array(eventTypes), secret, subscription.CreatedAt)
+	if err != nil {
+		return nil, postgresError(err)
+	}
+	return &subscription, nil
+}
+
+func (db *postgresDb) GetSubscriptions(ctx context.Context) (*[]Subscription, error) {
+	rows, err := db.DB.QueryContext(ctx, "SELECT "+postgresSubscriptionColumns+
+		" FROM subscriptions WHERE $1 = '' OR organisation_id = $1 ORDER BY id", contextOrganisation(ctx))
+	if err != nil {
+		return nil, postgresError(err)
+	}
+	defer rows.Close()
+	res := []Subscription{}
+	for rows.Next() {
+		subscription, err := scanPostgresSubscription(rows)
+		if err != nil {
+			return nil, postgresError(err)
+		}
+		res = append(res, *subscription)
+	}
+	return &res, postgresError(rows.Err())
+}
+
+func (db *postgresDb) GetSubscriptionByID(ctx context.Context, id ID) (*Subscription, error) {
+	subscription, err := scanPostgresSubscription(db.DB.QueryRowContext(ctx,
+		"SELECT "+postgresSubscriptionColumns+" FROM subscriptions WHERE id = $1 AND ($2 = '' OR organisation_id = $2)",
+		IDToString(id), contextOrganisation(ctx)))
+	if err != nil {
+		return nil, postgresError(err)
+	}
+	return subscription, nil
+}
+
+func (db *postgresDb) DeleteSubscription(ctx context.Context, id ID) error {
+	res, err := db.DB.ExecContext(ctx, "DELETE FROM subscriptions WHERE id = $1 AND ($2 = '' OR organisation_id = $2)",
+		IDToString(id), contextOrganisation(ctx))
+	if err != nil {
+		return postgresError(err)
+	}
+	if n, err := res.RowsAffected(); err != nil || n > 0 {
+		return postgresError(err)
+	}
+	return ErrNotFound
+}
+
+// postgresWebhookDeliveryColumns are the columns scanned by
+// scanPostgresWebhookDelivery
+const postgresWebhookDeliveryColumns = `id, subscription_id, payment_id, version, event_type, payload, status, attempts,
+	next_attempt_at, created_at`
+
+func scanPostgresWebhookDelivery(row postgresRow) (*WebhookDelivery, error) {
+	var idStr, subscriptionIDStr, paymentIDStr string
+	var attempts []byte
+	delivery := WebhookDelivery{}
+	err := row.Scan(&idStr, &subscriptionIDStr, &paymentIDStr, &delivery.Version, &delivery.EventType,
+		&delivery.Payload, &delivery.Status, &attempts, &delivery.NextAttemptAt, &delivery.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range []struct {
+		str string
+		id  *ID
+	}{{idStr, &delivery.ID}, {subscriptionIDStr, &delivery.SubscriptionID}, {paymentIDStr, &delivery.PaymentID}} {
+		id, err := StringToID(v.str)
+		if err != nil {
+			return nil, err
+		}
+		*v.id = *id
+	}
+	if err = json.Unmarshal(attempts, &delivery.Attempts); err != nil {
+		return nil, err
+	}
+	for i := range delivery.Attempts {
+		delivery.Attempts[i].Timestamp = delivery.Attempts[i].Timestamp.UTC()
+	}
+	delivery.NextAttemptAt = delivery.NextAttemptAt.UTC()
+	delivery.CreatedAt = delivery.CreatedAt.UTC()
+	return &delivery, nil
+}
+
+// postgresWebhookAttempts encodes the attempts of a delivery
+func postgresWebhookAttempts(attempts []WebhookAttempt) (string, error) {
+	if attempts == nil {
+		attempts = []WebhookAttempt{}
+	}
+	raw, err := json.Marshal(attempts)
+	return string(raw), err
+}
+
+func (db *postgresDb) CreateWebhookDelivery(ctx context.Context, delivery WebhookDelivery) error {
+	attempts, err := postgresWebhookAttempts(delivery.Attempts)
+	if err != nil {
+		return postgresError(err)
+	}
+	_, err = db.DB.ExecContext(ctx,
+		"INSERT INTO webhook_deliveries ("+postgresWebhookDeliveryColumns+`)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) ON CONFLICT (subscription_id, payment_id, version) DO NOTHING`,
+		IDToString(primitive.NewObjectID()), IDToString(delivery.SubscriptionID), IDToString(delivery.PaymentID),
+		delivery.Version, delivery.EventType, delivery.Payload, delivery.Status, attempts,
+		delivery.NextAttemptAt, delivery.CreatedAt)
+	return postgresError(err)
+}
+
+func (db *postgresDb) queryWebhookDeliveries(ctx context.Context, query string, args ...interface{}) (*[]WebhookDelivery, error) {
+	rows, err := db.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, postgresError(err)
+	}
+	defer rows.Close()
+	res := []WebhookDelivery{}
+	for rows.Next() {
+		delivery, err := scanPostgresWebhookDelivery(rows)
+		if err != nil {
+			return nil, postgresError(err)
+		}
+		res = append(res, *delivery)
+	}
+	return &res, postgresError(rows.Err())
+}
+
+func (db *postgresDb) GetDueWebhookDeliveries(ctx context.Context, before time.Time, size int) (*[]WebhookDelivery, error) {
+	return db.queryWebhookDeliveries(ctx, "SELECT "+postgresWebhookDeliveryColumns+` FROM webhook_deliveries
+		WHERE status = $1 AND next_attempt_at <= $2 ORDER BY next_attempt_at, id LIMIT $3`,
+		WebhookDeliveryPending, before, size)
+}
+
+func (db *postgresDb) SaveWebhookDelivery(ctx context.Context, delivery WebhookDelivery) error {
+	attempts, err := postgresWebhookAttempts(delivery.Attempts)
+	if err != nil {
+		return postgresError(err)
+	}
+	_, err = db.DB.ExecContext(ctx,
+		"UPDATE webhook_deliveries SET status = $2, attempts = $3, next_attempt_at = $4 WHERE id = $1",
+		IDToString(delivery.ID), delivery.Status, attempts, delivery.NextAttemptAt)
+	return postgresError(err)
+}
+
+func (db *postgresDb) GetWebhookDeliveries(ctx context.Context, subscriptionID ID) (*[]WebhookDelivery, error) {
+	return db.queryWebhookDeliveries(ctx, "SELECT "+postgresWebhookDeliveryColumns+`
+		FROM webhook_deliveries WHERE subscription_id = $1 ORDER BY id`,
+		IDToString(subscriptionID))
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ConfigStore holds the configuration of the server, replaced atomically on
+// reload such that every request sees the configuration current when it
+// started. Reloading applies the log level, API keys, JWT secret, policy and
+// idempotency key TTL. The server has no rate limits, CORS origins or feature
+// toggles to reload, and other settings require a restart.
+type ConfigStore struct {
+	current atomic.Value
+	// mutex serializes reloads
+	mutex   sync.Mutex
+	load    func() (*Config, error)
+	log     *Logger
+	metrics *Metrics
+}
+
+// NewConfigStore constructs a store of the configuration, reloaded by load.
+// The level of the logger follows the log level of the configuration.
+func NewConfigStore(c *Config, load func() (*Config, error), log *Logger, metrics *Metrics) *ConfigStore {
+	s := &ConfigStore{load: load, log: log, metrics: metrics}
+	s.current.Store(c)
+	return s
+}
+
+// Config returns the current configuration, which must not be modified
+func (s *ConfigStore) Config() *Config {
+	return s.current.Load().(*Config)
+}
+
+// Middleware stores the current configuration in the context of requests
+func (s *ConfigStore) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), ContextConfig, s.Config())))
+	})
+}
+
+// Reload loads the configuration and applies its reloadable settings. The
+// current configuration is kept if the loaded configuration is invalid or
+// changes settings requiring a restart.
+func (s *ConfigStore) Reload() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	err := s.reload()
+	s.metrics.observeConfigReload(err)
+	if err != nil {
+		s.log.Error("failed to reload configuration", err)
+		return err
+	}
+	s.log.Info("configuration reloaded")
+	return nil
+}
+
+func (s *ConfigStore) reload() error {
+	next, err := s.load()
+	if err != nil {
+		return err
+	}
+	if err = next.Validate(); err != nil {
+		return err
+	}
+	if next.PolicyFile != "" {
+		if next.Policy, err = LoadPolicy(next.PolicyFile); err != nil {
+			return fmt.Errorf("failed to load policy: %v", err)
+		}
+	}
+	c := *s.Config()
+	c.LogLevel = next.LogLevel
+	c.APIKeys = next.APIKeys
+	c.JWTSecret = next.JWTSecret
+	c.PolicyFile = next.PolicyFile
+	c.Policy = next.Policy
+	c.IdempotencyKeyTTL = next.IdempotencyKeyTTL
+	if rejected := changedSettings(&c, next); len(rejected) > 0 {
+		s.log.With("settings", rejected).Warn("rejected changes of settings requiring a restart", nil)
+		problems := make([]string, len(rejected))
+		for i, key := range rejected {
+			problems[i] = fmt.Sprintf("%s can not be changed without a restart", key)
+		}
+		return &ConfigError{Problems: problems}
+	}
+	if err = s.log.SetLevel(c.LogLevel); err != nil {
+		return err
+	}
+	s.current.Store(&c)
+	return nil
+}
+
+// changedSettings returns the keys of the settings differing between the
+// configurations
+func changedSettings(a *Config, b *Config) []string {
+	var changed []string
+	settings := configFlags(b)
+	configFlags(a).VisitAll(func(f *flag.Flag) {
+		if !reflect.DeepEqual(f.Value.(flag.Getter).Get(), settings.Lookup(f.Name).Value.(flag.Getter).Get()) {
+			changed = append(changed, settingKey(f.Name))
+		}
+	})
+	return changed
+}
+
+// Run reloads the configuration on every signal received, and when the
+// configuration or policy file is modified, checked every
+// ConfigReloadInterval, until the context is done
+func (s *ConfigStore) Run(ctx context.Context, signals <-chan os.Signal) {
+	var tick <-chan time.Time
+	if interval := s.Config().ConfigReloadInterval; interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	modified := s.modified()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-signals:
+		case <-tick:
+			if m := s.modified(); m.Equal(modified) {
+				continue
+			}
+		}
+		_ = s.Reload()
+		modified = s.modified()
+	}
+}
+
+// modified returns the latest modification time of the configuration and
+// policy files
+func (s *ConfigStore) modified() time.Time {
+	c := s.Config()
+	var latest time.Time
+	for _, path := range []string{c.ConfigFile, c.PolicyFile} {
+		if path == "" {
+			continue
+		}
+		if info, err := os.Stat(path); err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest
+}
@@ -0,0 +1,163 @@
+package main_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "./"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ConfigStore", func() {
+	var dir string
+	var path string
+	var logs *bytes.Buffer
+	var log *Logger
+	var metrics *Metrics
+	var store *ConfigStore
+
+	load := func() (*Config, error) {
+		c, _, err := LoadConfig([]string{"-config", path}, func(string) (string, bool) { return "", false })
+		return c, err
+	}
+	var policy string
+	// writeConfig writes the configuration file with the policy file
+	writeConfig := func(content string) {
+		content += "policy_file: " + policy + "\n"
+		Expect(ioutil.WriteFile(path, []byte(content), 0600)).To(Succeed())
+	}
+	writePolicy := func(content string) {
+		Expect(ioutil.WriteFile(policy, []byte(content), 0600)).To(Succeed())
+	}
+	scrape := func() string {
+		w := httptest.NewRecorder()
+		metrics.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+		body, _ := ioutil.ReadAll(w.Body)
+		return string(body)
+	}
+
+	BeforeEach(func() {
+		dir, _ = ioutil.TempDir("", "reload")
+		path = filepath.Join(dir, "config.yaml")
+		policy = filepath.Join(dir, "policy.json")
+		writePolicy(`{"roles": {}}`)
+		writeConfig("storage_driver: memory\napi_keys: ledger:secret1\n")
+		logs = &bytes.Buffer{}
+		log, _ = NewLogger(logs, LogLevelInfo)
+		metrics = NewMetrics()
+		c, err := load()
+		Expect(err).To(BeNil())
+		store = NewConfigStore(c, load, log, metrics)
+	})
+
+	AfterEach(func() {
+		_ = os.RemoveAll(dir)
+	})
+
+	It("should apply reloadable settings to a new configuration", func() {
+		before := store.Config()
+		writeConfig("storage_driver: memory\napi_keys: ledger:secret2\nlog_level: warn\nidempotency_key_ttl: 1h\n")
+		Expect(store.Reload()).To(Succeed())
+		Expect(store.Config().APIKeys).To(Equal(map[string]APIKey{"ledger": {Key: "secret2"}}))
+		Expect(store.Config().IdempotencyKeyTTL).To(Equal(time.Hour))
+		Expect(store.Config().LogLevel).To(Equal(LogLevelWarn))
+		Expect(before.APIKeys).To(Equal(map[string]APIKey{"ledger": {Key: "secret1"}}))
+		Expect(scrape()).To(ContainSubstring(`config_reloads_total{result="success"} 1`))
+		// The logger follows the level
+		Expect(logs.String()).ToNot(ContainSubstring("configuration reloaded"))
+	})
+
+	It("should keep the configuration when the loaded configuration is invalid", func() {
+		before := store.Config()
+		writeConfig("storage_driver: memory\nlog_level: verbose\n")
+		err := store.Reload()
+		Expect(err).To(BeAssignableToTypeOf(&ConfigError{}))
+		Expect(store.Config()).To(BeIdenticalTo(before))
+		Expect(logs.String()).To(ContainSubstring(`"msg":"failed to reload configuration"`))
+		Expect(scrape()).To(ContainSubstring(`config_reloads_total{result="failure"} 1`))
+	})
+
+	It("should reject changes of settings requiring a restart", func() {
+		before := store.Config()
+		writeConfig("storage_driver: memory\napi_keys: ledger:secret2\nport: 9090\nread_timeout: 1s\n")
+		err := store.Reload()
+		Expect(err).To(BeAssignableToTypeOf(&ConfigError{}))
+		Expect(err.(*ConfigError).Problems).To(Equal([]string{
+			"port can not be changed without a restart",
+			"read_timeout can not be changed without a restart",
+		}))
+		Expect(store.Config()).To(BeIdenticalTo(before))
+		Expect(store.Config().APIKeys["ledger"].Key).To(Equal("secret1"))
+		Expect(logs.String()).To(ContainSubstring(`"settings":["port","read_timeout"]`))
+		Expect(scrape()).To(ContainSubstring(`config_reloads_total{result="failure"} 1`))
+	})
+
+	It("should load the policy of the policy file", func() {
+		writePolicy(`{"roles": {"reader": ["payments:read"]}}`)
+		Expect(store.Reload()).To(Succeed())
+		Expect(store.Config().Policy.Roles).To(HaveKey("reader"))
+		writePolicy(`{"roles": {"reader": ["payments:steal"]}}`)
+		Expect(store.Reload()).To(MatchError(ContainSubstring(`unknown action "payments:steal"`)))
+		Expect(store.Config().Policy.Roles).To(HaveKey("reader"))
+	})
+
+	It("should store the configuration current when requests start", func() {
+		var seen *Config
+		handler := store.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			seen = r.Context().Value(ContextConfig).(*Config)
+		}))
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		Expect(seen).To(BeIdenticalTo(store.Config()))
+	})
+
+	Describe("Run", func() {
+		var cancel context.CancelFunc
+		var signals chan os.Signal
+
+		BeforeEach(func() {
+			writeConfig("storage_driver: memory\napi_keys: ledger:secret1\nconfig_reload_interval: 10ms\n")
+			c, _ := load()
+			store = NewConfigStore(c, load, log, metrics)
+			var ctx context.Context
+			ctx, cancel = context.WithCancel(context.Background())
+			signals = make(chan os.Signal, 1)
+			go store.Run(ctx, signals)
+		})
+
+		AfterEach(func() {
+			cancel()
+		})
+
+		keyOf := func() string {
+			return store.Config().APIKeys["ledger"].Key
+		}
+
+		It("should reload on signals", func() {
+			// The modification time is unchanged, such that only the signal
+			// reloads the configuration
+			info, _ := os.Stat(path)
+			writeConfig("storage_driver: memory\napi_keys: ledger:secret2\nconfig_reload_interval: 10ms\n")
+			Expect(os.Chtimes(path, info.ModTime(), info.ModTime())).To(Succeed())
+			Consistently(keyOf, 50*time.Millisecond).Should(Equal("secret1"))
+			signals <- os.Interrupt
+			Eventually(keyOf).Should(Equal("secret2"))
+		})
+
+		It("should reload when the configuration file is modified", func() {
+			// Modification times are compared with those of the last reload
+			signals <- os.Interrupt
+			Eventually(scrape).Should(ContainSubstring(`config_reloads_total{result="success"} 1`))
+			writeConfig("storage_driver: memory\napi_keys: ledger:secret2\nconfig_reload_interval: 10ms\n")
+			modified := time.Now().Add(time.Minute)
+			Expect(os.Chtimes(path, modified, modified)).To(Succeed())
+			Eventually(keyOf).Should(Equal("secret2"))
+		})
+	})
+})
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	"github.com/go-chi/render"
+)
+
+// Error codes used in error responses
+const (
+	errorCodeBadRequest           = "bad_request"
+	errorCodeUnauthorized         = "unauthorized"
+	errorCodeForbidden            = "forbidden"
+	errorCodeNotFound             = "not_found"
+	errorCodeMethodNotAllowed     = "method_not_allowed"
+	errorCodeConflict             = "conflict"
+	errorCodeVersionConflict      = "version_conflict"
+	errorCodeInvalidTransition    = "invalid_transition"
+	errorCodePaymentLocked        = "payment_locked"
+	errorCodePreconditionRequired = "precondition_required"
+	errorCodeValidationFailed     = "validation_failed"
+	errorCodeIdempotencyKeyReused = "idempotency_key_reused"
+	errorCodeIdempotencyKeyInUse  = "idempotency_key_in_use"
+	errorCodeInternal             = "internal_error"
+	errorCodeUnavailable          = "unavailable"
+)
+
+var statusErrorCodes = map[int]string{
+	http.StatusBadRequest:           errorCodeBadRequest,
+	http.StatusUnauthorized:         errorCodeUnauthorized,
+	http.StatusForbidden:            errorCodeForbidden,
+	http.StatusNotFound:             errorCodeNotFound,
+	http.StatusMethodNotAllowed:     errorCodeMethodNotAllowed,
+	http.StatusConflict:             errorCodeConflict,
+	http.StatusPreconditionRequired: errorCodePreconditionRequired,
+	http.StatusUnprocessableEntity:  errorCodeValidationFailed,
+	http.StatusInternalServerError:  errorCodeInternal,
+	http.StatusServiceUnavailable:   errorCodeUnavailable,
+}
+
+// errorRest is the envelope of every error response
+type errorRest struct {
+	Code      string           `json:"code"`
+	Message   string           `json:"message"`
+	RequestID string           `json:"request_id,omitempty"`
+	TraceID   string           `json:"trace_id,omitempty"`
+	Errors    []fieldErrorRest `json:"errors,omitempty"`
+	Version   *int             `json:"version,omitempty"`
+}
+
+// renderError writes an error response with the default code and message of
+// the status.
+func renderError(w http.ResponseWriter, r *http.Request, status int) {
+	renderErrorRest(w, r, status, errorRest{})
+}
+
+// renderErrorRest writes the given error response. Missing code and message
+// are derived from the status.
+func renderErrorRest(w http.ResponseWriter, r *http.Request, status int, e errorRest) {
+	if e.Code == "" {
+		e.Code = statusErrorCodes[status]
+	}
+	if e.Message == "" {
+		e.Message = http.StatusText(status)
+	}
+	e.RequestID = middleware.GetReqID(r.Context())
+	e.TraceID = contextTraceID(r.Context())
+	render.Status(r, status)
+	render.JSON(w, r, e)
+}
+
+func renderValidationError(w http.ResponseWriter, r *http.Request, err *ValidationError) {
+	mapped := make([]fieldErrorRest, len(err.Errors))
+	for i, v := range err.Errors {
+		mapped[i] = fieldErrorRest{
+			Field:   v.Field,
+			Message: v.Message,
+		}
+	}
+	renderErrorRest(w, r, http.StatusUnprocessableEntity, errorRest{Errors: mapped})
+}
+
+func renderVersionConflict(w http.ResponseWriter, r *http.Request, err *VersionConflictError) {
+	version := err.Version
+	w.Header().Set("ETag", versionToETag(version))
+	renderErrorRest(w, r, http.StatusConflict, errorRest{Code: errorCodeVersionConflict, Version: &version})
+}
+
+// renderModificationError writes the error response of a rejected
+// modification of a payment, also when wrapped. False is returned for other
+// errors.
+func renderModificationError(w http.ResponseWriter, r *http.Request, err error) bool {
+	var versionConflict *VersionConflictError
+	var invalidTransition *InvalidTransitionError
+	var paymentLocked *PaymentLockedError
+	switch {
+	case errors.As(err, &versionConflict):
+		renderVersionConflict(w, r, versionConflict)
+	case errors.As(err, &invalidTransition):
+		renderErrorRest(w, r, http.StatusConflict, errorRest{
+			Code:    errorCodeInvalidTransition,
+			Message: fmt.Sprintf("Payment can not transition from %s to %s", invalidTransition.From, invalidTransition.To),
+		})
+	case errors.As(err, &paymentLocked):
+		renderErrorRest(w, r, http.StatusConflict, errorRest{
+			Code:    errorCodePaymentLocked,
+			Message: fmt.Sprintf("Payment can not be modified when %s", paymentLocked.Status),
+		})
+	default:
+		return false
+	}
+	return true
+}
+
+// renderDbError writes the error response of a failed database operation by
+// the kind of the error. Unavailable databases and errors of no known kind
+// are logged with the message.
+func renderDbError(w http.ResponseWriter, r *http.Request, msg string, err error) {
+	if renderModificationError(w, r, err) {
+		return
+	}
+	switch ErrorKind(err) {
+	case ErrNotFound:
+		renderError(w, r, http.StatusNotFound)
+	case ErrConflict:
+		renderErrorRest(w, r, http.StatusConflict, errorRest{
+			Code:    errorCodeConflict,
+			Message: "Request conflicts with the current state",
+		})
+	case ErrInvalid:
+		renderError(w, r, http.StatusBadRequest)
+	case ErrUnavailable:
+		contextLogger(r.Context()).Error(msg, err)
+		renderError(w, r, http.StatusServiceUnavailable)
+	default:
+		contextLogger(r.Context()).Error(msg, err)
+		renderError(w, r, http.StatusInternalServerError)
+	}
+}
+
+func notFoundEndpoint(w http.ResponseWriter, r *http.Request) {
+	renderError(w, r, http.StatusNotFound)
+}
+
+func methodNotAllowedEndpoint(w http.ResponseWriter, r *http.Request) {
+	renderError(w, r, http.StatusMethodNotAllowed)
+}
+
+// newRouter constructs a router responding with error responses on unknown
+// routes and methods.
+func newRouter() *chi.Mux {
+	r := chi.NewRouter()
+	r.NotFound(notFoundEndpoint)
+	r.MethodNotAllowed(methodNotAllowedEndpoint)
+	return r
+}
+
+// recoverer recovers from panics and responds with an internal server error.
+func recoverer(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if rvr := recover(); rvr != nil {
+				if rvr == http.ErrAbortHandler {
+					panic(rvr)
+				}
+				contextLogger(r.Context()).With("stack", string(debug.Stack())).
+					Error("panic while serving request", fmt.Errorf("%v", rvr))
+				renderError(w, r, http.StatusInternalServerError)
+			}
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
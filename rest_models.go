@@ -1,6 +1,12 @@
 package main
 
-import "fmt"
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+)
 
 type selfLinksRest struct {
 	Self string `json:"self"`
@@ -71,9 +77,12 @@ type paymentRest struct {
 	ID             string                `json:"id"`
 	OrganisationID string                `json:"organisation_id"`
 	Version        int                   `json:"version"`
+	Status         string                `json:"status"`
 	Attributes     paymentAttributesRest `json:"attributes"`
 	Links          selfLinksRest         `json:"links"`
 	Type           string                `json:"type"`
+	DeletedAt      *string               `json:"deleted_at,omitempty"`
+	DeletedBy      string                `json:"deleted_by,omitempty"`
 }
 
 type pageLinksRest struct {
@@ -81,14 +90,96 @@ type pageLinksRest struct {
 	Next *string `json:"next"`
 }
 
+type fieldErrorRest struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
 type paymentsDataRest struct {
-	Data  []paymentSummaryRest `json:"data"`
-	Links pageLinksRest        `json:"links"`
+	// Data holds either summaries, payments or sparse payments
+	Data  []interface{} `json:"data"`
+	Links pageLinksRest `json:"links"`
+}
+
+type paymentVersionRest struct {
+	Version   int           `json:"version"`
+	Event     string        `json:"event"`
+	Actor     string        `json:"actor"`
+	Timestamp string        `json:"timestamp"`
+	Payment   paymentRest   `json:"payment"`
+	Links     selfLinksRest `json:"links"`
+}
+
+type paymentVersionsDataRest struct {
+	Data  []paymentVersionRest `json:"data"`
+	Links selfLinksRest        `json:"links"`
+}
+
+type webhookEventRest struct {
+	ID        string             `json:"id"`
+	Type      string             `json:"type"`
+	CreatedAt string             `json:"created_at"`
+	Data      paymentVersionRest `json:"data"`
+}
+
+type subscriptionRest struct {
+	ID             string   `json:"id"`
+	OrganisationID string   `json:"organisation_id"`
+	URL            string   `json:"url"`
+	EventTypes     []string `json:"event_types"`
+	// Secret is only returned when the subscription is created
+	Secret    string        `json:"secret,omitempty"`
+	CreatedAt string        `json:"created_at"`
+	Links     selfLinksRest `json:"links"`
+}
+
+type subscriptionsDataRest struct {
+	Data  []subscriptionRest `json:"data"`
+	Links selfLinksRest      `json:"links"`
+}
+
+type webhookAttemptRest struct {
+	Timestamp  string `json:"timestamp"`
+	StatusCode int    `json:"status_code,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+type webhookDeliveryRest struct {
+	ID            string               `json:"id"`
+	EventType     string               `json:"event_type"`
+	PaymentID     string               `json:"payment_id"`
+	Version       int                  `json:"version"`
+	Status        string               `json:"status"`
+	Attempts      []webhookAttemptRest `json:"attempts"`
+	NextAttemptAt *string              `json:"next_attempt_at,omitempty"`
+	CreatedAt     string               `json:"created_at"`
 }
 
-func summaryToRest(config *Config, summary PaymentSummary) paymentSummaryRest {
-	id := summary.ID
-	return summaryIDToRest(config, id)
+type webhookDeliveriesDataRest struct {
+	Data  []webhookDeliveryRest `json:"data"`
+	Links selfLinksRest         `json:"links"`
+}
+
+// healthRest is the status of the service and, for readiness, of its
+// dependencies
+type healthRest struct {
+	Status string                     `json:"status"`
+	Checks map[string]healthCheckRest `json:"checks,omitempty"`
+}
+
+type healthCheckRest struct {
+	Status    string  `json:"status"`
+	LatencyMs float64 `json:"latency_ms"`
+}
+
+// jsonFieldNames returns the JSON names of the fields of the struct
+func jsonFieldNames(v interface{}) []string {
+	t := reflect.TypeOf(v)
+	names := make([]string, t.NumField())
+	for i := range names {
+		names[i] = strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+	}
+	return names
 }
 
 func summaryIDToRest(config *Config, id ID) paymentSummaryRest {
@@ -220,6 +311,15 @@ func paymentAttributesFromRest(attributes paymentAttributesRest) PaymentAttribut
 	}
 }
 
+// timeToRest formats a time as RFC 3339 in UTC
+func timeToRest(t *time.Time) *string {
+	if t == nil {
+		return nil
+	}
+	s := t.UTC().Format(time.RFC3339Nano)
+	return &s
+}
+
 func paymentToRest(config *Config, payment Payment) paymentRest {
 	id := payment.ID
 	return paymentRest{
@@ -227,6 +327,9 @@ func paymentToRest(config *Config, payment Payment) paymentRest {
 		OrganisationID: payment.OrganisationID,
 		Attributes:     paymentAttributesToRest(payment.Attributes),
 		Version:        payment.Version,
+		Status:         payment.Status,
+		DeletedAt:      timeToRest(payment.DeletedAt),
+		DeletedBy:      payment.DeletedBy,
 		Type:           "Payment",
 		Links: selfLinksRest{
 			Self: fmt.Sprintf("%s/v1/payments/%s/", config.Host, IDToString(id)),
@@ -234,3 +337,121 @@ func paymentToRest(config *Config, payment Payment) paymentRest {
 	}
 
 }
+
+func paymentVersionsLink(config *Config, id ID) string {
+	return fmt.Sprintf("%s/v1/payments/%s/versions/", config.Host, IDToString(id))
+}
+
+func paymentVersionToRest(config *Config, version PaymentVersion) paymentVersionRest {
+	return paymentVersionRest{
+		Version:   version.Version,
+		Event:     version.Event,
+		Actor:     version.Actor,
+		Timestamp: *timeToRest(&version.Timestamp),
+		Payment:   paymentToRest(config, version.Payment),
+		Links: selfLinksRest{
+			Self: fmt.Sprintf("%s%d/", paymentVersionsLink(config, version.Payment.ID), version.Version),
+		},
+	}
+}
+
+// webhookEventToRest maps an event to the payload of its notifications. The
+// id is the same for every delivery of the event.
+func webhookEventToRest(config *Config, eventType string, version PaymentVersion) webhookEventRest {
+	return webhookEventRest{
+		ID:        fmt.Sprintf("%s-%d", IDToString(version.Payment.ID), version.Version),
+		Type:      eventType,
+		CreatedAt: *timeToRest(&version.Timestamp),
+		Data:      paymentVersionToRest(config, version),
+	}
+}
+
+func subscriptionLink(config *Config, id ID) string {
+	return fmt.Sprintf("%s/v1/subscriptions/%s/", config.Host, IDToString(id))
+}
+
+func subscriptionToRest(config *Config, subscription Subscription) subscriptionRest {
+	return subscriptionRest{
+		ID:             IDToString(subscription.ID),
+		OrganisationID: subscription.OrganisationID,
+		URL:            subscription.URL,
+		EventTypes:     subscription.EventTypes,
+		CreatedAt:      *timeToRest(&subscription.CreatedAt),
+		Links:          selfLinksRest{Self: subscriptionLink(config, subscription.ID)},
+	}
+}
+
+func webhookDeliveryToRest(delivery WebhookDelivery) webhookDeliveryRest {
+	attempts := make([]webhookAttemptRest, len(delivery.Attempts))
+	for i, a := range delivery.Attempts {
+		attempts[i] = webhookAttemptRest{
+			Timestamp:  *timeToRest(&a.Timestamp),
+			StatusCode: a.StatusCode,
+			Error:      a.Error,
+		}
+	}
+	res := webhookDeliveryRest{
+		ID:        IDToString(delivery.ID),
+		EventType: delivery.EventType,
+		PaymentID: IDToString(delivery.PaymentID),
+		Version:   delivery.Version,
+		Status:    delivery.Status,
+		Attempts:  attempts,
+		CreatedAt: *timeToRest(&delivery.CreatedAt),
+	}
+	if delivery.Status == WebhookDeliveryPending {
+		res.NextAttemptAt = timeToRest(&delivery.NextAttemptAt)
+	}
+	return res
+}
+
+func versionToETag(version int) string {
+	return fmt.Sprintf(`"%d"`, version)
+}
+
+// paymentFieldsToRest maps a payment listed with the given fields. Payments
+// listed without fields are mapped to summaries, and payments with only some
+// fields are mapped to sparse payments.
+func paymentFieldsToRest(config *Config, payment Payment, fields []string) interface{} {
+	if len(fields) == 0 {
+		return summaryIDToRest(config, payment.ID)
+	}
+	full := paymentToRest(config, payment)
+	query := PaymentQuery{Fields: fields}
+	all, names := query.attributeFields()
+	if all {
+		return full
+	}
+	sparse := map[string]interface{}{
+		"id":    full.ID,
+		"type":  full.Type,
+		"links": full.Links,
+	}
+	if query.hasField(PaymentFieldOrganisationID) {
+		sparse["organisation_id"] = full.OrganisationID
+	}
+	if query.hasField(PaymentFieldVersion) {
+		sparse["version"] = full.Version
+	}
+	if query.hasField(PaymentFieldStatus) {
+		sparse["status"] = full.Status
+	}
+	if query.hasField(PaymentFieldDeletedAt) && full.DeletedAt != nil {
+		sparse["deleted_at"] = full.DeletedAt
+	}
+	if query.hasField(PaymentFieldDeletedBy) && full.DeletedBy != "" {
+		sparse["deleted_by"] = full.DeletedBy
+	}
+	if len(names) > 0 {
+		raw, _ := json.Marshal(full.Attributes)
+		attributes := map[string]json.RawMessage{}
+		_ = json.Unmarshal(raw, &attributes)
+		for name := range attributes {
+			if !containsString(names, name) {
+				delete(attributes, name)
+			}
+		}
+		sparse["attributes"] = attributes
+	}
+	return sparse
+}
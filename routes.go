@@ -4,63 +4,190 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 
 	"github.com/go-chi/chi"
 	"github.com/go-chi/render"
-	"github.com/google/logger"
 )
 
 func getPaymentEndpoint(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	conf := ctx.Value(ContextConfig).(*Config)
 	payment := ctx.Value(ContextPayment).(*Payment)
+	w.Header().Set("ETag", versionToETag(payment.Version))
 	render.JSON(w, r, paymentToRest(conf, *payment))
 }
 
+// queryParam is a query parameter bound to a field
+type queryParam struct {
+	Name  string
+	Value *string
+}
+
+// paymentFilterParams returns the query parameters of the filter in the
+// order they appear in links
+func paymentFilterParams(f *PaymentFilter) []queryParam {
+	return []queryParam{
+		{"organisation_id", &f.OrganisationID},
+		{"status", &f.Status},
+		{"currency", &f.Currency},
+		{"payment_scheme", &f.PaymentScheme},
+		{"payment_type", &f.PaymentType},
+		{"processing_date_from", &f.ProcessingDateFrom},
+		{"processing_date_to", &f.ProcessingDateTo},
+		{"amount_min", &f.AmountMin},
+		{"amount_max", &f.AmountMax},
+		{"debtor_account_number", &f.DebtorAccountNumber},
+		{"beneficiary_account_number", &f.BeneficiaryAccountNumber},
+	}
+}
+
+// paymentsLinkParams are the query parameters besides count and after kept
+// in links to pages of payments, in link order
+var paymentsLinkParams = func() []string {
+	var names []string
+	for _, p := range paymentFilterParams(&PaymentFilter{}) {
+		names = append(names, p.Name)
+	}
+	return append(names, "sort", "fields", "expand", "include_deleted")
+}()
+
+// paymentFieldsFromRest maps the fields and expand query parameters to the
+// fields to retrieve
+func paymentFieldsFromRest(fields string, expand string) []string {
+	if expand == "attributes" {
+		return []string{PaymentFieldOrganisationID, PaymentFieldVersion, PaymentFieldStatus,
+			PaymentFieldAttributes, PaymentFieldDeletedAt, PaymentFieldDeletedBy}
+	}
+	if fields == "" {
+		return nil
+	}
+	var res []string
+	for _, f := range strings.Split(fields, ",") {
+		if paymentTopLevelFields[f] {
+			res = append(res, f)
+		} else {
+			res = append(res, PaymentFieldAttributePrefix+f)
+		}
+	}
+	return res
+}
+
+// paymentQueryFromRequest extracts the filter, sort and fields of the query
+// parameters
+func paymentQueryFromRequest(r *http.Request) (PaymentQuery, error) {
+	values := r.URL.Query()
+	query := PaymentQuery{}
+	if err := validatePaymentListParams(values); err != nil {
+		return query, err
+	}
+	for _, p := range paymentFilterParams(&query.Filter) {
+		*p.Value = values.Get(p.Name)
+	}
+	sort := values.Get("sort")
+	query.Descending = strings.HasPrefix(sort, "-")
+	query.Sort = strings.TrimPrefix(sort, "-")
+	query.Fields = paymentFieldsFromRest(values.Get("fields"), values.Get("expand"))
+	query.IncludeDeleted = includeDeleted(values)
+	return query, nil
+}
+
+// includeDeleted returns whether the include_deleted query parameter is set
+func includeDeleted(values url.Values) bool {
+	v, _ := strconv.ParseBool(values.Get("include_deleted"))
+	return v
+}
+
+// requestsDeleted returns whether the request includes deleted payments
+func requestsDeleted(r *http.Request) bool {
+	return includeDeleted(r.URL.Query())
+}
+
+// requestActor identifies who performs the request, which is the
+// authenticated principal unless authentication is disabled
+func requestActor(r *http.Request) string {
+	if principal := contextPrincipal(r.Context()); principal != nil {
+		return principal.ID
+	}
+	return StringOrDefault(r.Header.Get("X-Actor"), "anonymous")
+}
+
+// actorCtx stores who performs the request, such that modifications are
+// recorded with the actor
+func actorCtx(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), ContextActor, requestActor(r))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// paymentsMaxCount is the largest page of payments listed, larger counts are
+// reduced to it
+const paymentsMaxCount = 100
+
+// paymentsLink creates a link to a page of payments
+func paymentsLink(config *Config, values url.Values, size int, after *ID) string {
+	link := fmt.Sprintf("%s/v1/payments/?count=%d", config.Host, size)
+	for _, name := range paymentsLinkParams {
+		if v := values.Get(name); v != "" {
+			link += fmt.Sprintf("&%s=%s", name, url.QueryEscape(v))
+		}
+	}
+	if after != nil {
+		link += fmt.Sprintf("&after=%s", IDToString(*after))
+	}
+	return link
+}
+
 func listPaymentsEndpoint(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	config := ctx.Value(ContextConfig).(*Config)
 	db := ctx.Value(ContextDb).(Db)
+	// Extract filter and sort
+	query, err := paymentQueryFromRequest(r)
+	if verr, ok := err.(*ValidationError); ok {
+		renderValidationError(w, r, verr)
+		return
+	}
 	// Extract size, default 10
 	size := SafeStringToInt(r.URL.Query().Get("count"), 10)
 	if size <= 0 {
 		size = 10
 	}
+	size = IntMin(size, paymentsMaxCount)
 	// Extract after
-	var after *ID
 	if v, err := StringToID(r.URL.Query().Get("after")); err == nil {
-		after = v
+		query.After = v
 	}
 
-	// Fetch summaries
-	summaries, err := db.GetPayments(ctx, size+1, after)
+	// Fetch payments
+	query.Size = size + 1
+	payments, err := db.GetPayments(ctx, query)
 	if err != nil {
-		render.Status(r, http.StatusInternalServerError)
-		logger.Error("failed to list payments: ", err)
+		renderDbError(w, r, "failed to list payments", err)
 		return
 	}
 
-	// Transform summaries
-	resultLen := IntMin(size, len(*summaries))
-	mapped := make([]paymentSummaryRest, resultLen)
-	for i, v := range *summaries {
+	// Transform payments
+	resultLen := IntMin(size, len(*payments))
+	mapped := make([]interface{}, resultLen)
+	for i, v := range *payments {
 		if i >= resultLen {
 			break
 		}
-		mapped[i] = summaryToRest(config, v)
+		mapped[i] = paymentFieldsToRest(config, v, query.Fields)
 	}
 
 	// Create self link
-	var afterStr = ""
-	if after != nil {
-		afterStr = fmt.Sprintf("&after=%s", IDToString(*after))
-	}
-	var selfLink = fmt.Sprintf("%s/v1/payments/?count=%d%s", config.Host, size, afterStr)
+	values := r.URL.Query()
+	var selfLink = paymentsLink(config, values, size, query.After)
 
 	// Create next link
 	var nextLink *string
-	if len(*summaries) > size {
-		n := fmt.Sprintf("%s/v1/payments/?count=%d&after=%s", config.Host, size, mapped[len(mapped)-1].ID)
+	if len(*payments) > size {
+		n := paymentsLink(config, values, size, &(*payments)[resultLen-1].ID)
 		nextLink = &n
 	}
 	render.JSON(w, r, paymentsDataRest{
@@ -72,26 +199,39 @@ func listPaymentsEndpoint(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// paymentCtx loads the payment of the route. Deleted payments are loaded with
+// the include_deleted query parameter.
 func paymentCtx(next http.Handler) http.Handler {
+	return loadPaymentCtx(next, false)
+}
+
+// deletedPaymentCtx loads the payment of the route, deleted or not
+func deletedPaymentCtx(next http.Handler) http.Handler {
+	return loadPaymentCtx(next, true)
+}
+
+func loadPaymentCtx(next http.Handler, alwaysIncludeDeleted bool) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
 		db := ctx.Value(ContextDb).(Db)
+		values := r.URL.Query()
+		if err := validatePaymentParams(values); err != nil {
+			renderValidationError(w, r, err.(*ValidationError))
+			return
+		}
 		queryID := chi.URLParam(r, "paymentID")
 		cID, err := StringToID(queryID)
 		if err != nil {
-			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			renderError(w, r, http.StatusNotFound)
 			return
 		}
-		payment, err := db.GetPaymentByID(ctx, *cID)
+		payment, err := db.GetPaymentByID(ctx, *cID, alwaysIncludeDeleted || includeDeleted(values))
 		if err != nil {
-			render.Status(r, http.StatusInternalServerError)
-			logger.Error("failed to fetch payment: ", err)
-			return
-		}
-		if payment == nil {
-			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			renderDbError(w, r, "failed to fetch payment", err)
 			return
 		}
+		setLogField(ctx, "payment_id", IDToString(payment.ID))
+		setLogField(ctx, "organisation_id", payment.OrganisationID)
 		ctx = context.WithValue(r.Context(), ContextPayment, payment)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
@@ -100,50 +240,188 @@ func paymentCtx(next http.Handler) http.Handler {
 type paymentRequest struct {
 	Attributes     paymentAttributesRest `json:"attributes"`
 	OrganisationID string                `json:"organisation_id"`
+	Version        *int                  `json:"version"`
 }
 
 func (u *paymentRequest) Bind(r *http.Request) error {
-	// TODO create custom validation logic
-	return nil
+	return validatePaymentRequest(u, contextOrganisation(r.Context()))
 }
 
-func updatePaymentEndpoint(w http.ResponseWriter, r *http.Request) {
+type paymentStatusRequest struct {
+	Status  string `json:"status"`
+	Version *int   `json:"version"`
+}
+
+func (u *paymentStatusRequest) Bind(r *http.Request) error {
+	return validatePaymentStatusRequest(u)
+}
+
+// bindRequest decodes and validates the request body. On failure an error
+// response is written and false is returned.
+func bindRequest(w http.ResponseWriter, r *http.Request, data render.Binder) bool {
+	_, span := startChildSpan(r.Context(), "bind")
+	err := render.Bind(r, data)
+	span.Finish(err)
+	if verr, ok := err.(*ValidationError); ok {
+		renderValidationError(w, r, verr)
+		return false
+	}
+	if err != nil {
+		renderError(w, r, http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// bindPaymentRequest decodes and validates the payment in the request body.
+// On failure an error response is written and false is returned.
+func bindPaymentRequest(w http.ResponseWriter, r *http.Request) (*paymentRequest, bool) {
 	data := &paymentRequest{}
-	if err := render.Bind(r, data); err != nil {
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+	return data, bindRequest(w, r, data)
+}
+
+// expectedVersion extracts the version the caller expects to modify. The
+// If-Match header takes precedence over the version in the request body.
+func expectedVersion(r *http.Request, bodyVersion *int) (*int, error) {
+	h := r.Header.Get("If-Match")
+	if h == "" {
+		return bodyVersion, nil
+	}
+	v, err := strconv.Atoi(strings.Trim(strings.TrimPrefix(h, "W/"), `"`))
+	if err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+func updatePaymentEndpoint(w http.ResponseWriter, r *http.Request) {
+	data, ok := bindPaymentRequest(w, r)
+	if !ok {
+		return
+	}
+	version, ok := requireVersion(w, r, data.Version)
+	if !ok {
 		return
 	}
 	ctx := r.Context()
 	payment := ctx.Value(ContextPayment).(*Payment)
 	db := ctx.Value(ContextDb).(Db)
-	err := db.UpdatePayment(ctx, payment.ID, data.OrganisationID, paymentAttributesFromRest(data.Attributes))
+	err := db.UpdatePayment(ctx, payment.ID, data.OrganisationID, version, paymentAttributesFromRest(data.Attributes))
 	if err != nil {
-		logger.Error("failed to update payment: ", err)
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		renderDbError(w, r, "failed to update payment", err)
 		return
 	}
+	w.Header().Set("ETag", versionToETag(version+1))
 	render.NoContent(w, r)
 
 }
 
+// requireVersion extracts the version the caller expects to modify. If it is
+// missing or invalid an error response is written and false is returned.
+func requireVersion(w http.ResponseWriter, r *http.Request, bodyVersion *int) (int, bool) {
+	version, err := expectedVersion(r, bodyVersion)
+	if err != nil {
+		renderError(w, r, http.StatusBadRequest)
+		return 0, false
+	}
+	if version == nil {
+		renderError(w, r, http.StatusPreconditionRequired)
+		return 0, false
+	}
+	return *version, true
+}
+
+func updatePaymentStatusEndpoint(w http.ResponseWriter, r *http.Request) {
+	data := &paymentStatusRequest{}
+	if !bindRequest(w, r, data) {
+		return
+	}
+	version, ok := requireVersion(w, r, data.Version)
+	if !ok {
+		return
+	}
+	ctx := r.Context()
+	payment := ctx.Value(ContextPayment).(*Payment)
+	db := ctx.Value(ContextDb).(Db)
+	err := db.UpdatePaymentStatus(ctx, payment.ID, version, data.Status)
+	if err != nil {
+		renderDbError(w, r, "failed to update payment status", err)
+		return
+	}
+	w.Header().Set("ETag", versionToETag(version+1))
+	render.NoContent(w, r)
+}
+
 func deletePaymentEndpoint(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	payment := ctx.Value(ContextPayment).(*Payment)
 	db := ctx.Value(ContextDb).(Db)
 	err := db.DeletePayment(ctx, payment.ID)
 	if err != nil {
-		logger.Error("failed to delete payment: ", err)
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		renderDbError(w, r, "failed to delete payment", err)
 		return
 	}
 	render.NoContent(w, r)
 
 }
 
+func restorePaymentEndpoint(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	payment := ctx.Value(ContextPayment).(*Payment)
+	db := ctx.Value(ContextDb).(Db)
+	err := db.RestorePayment(ctx, payment.ID)
+	if err != nil {
+		renderDbError(w, r, "failed to restore payment", err)
+		return
+	}
+	render.NoContent(w, r)
+}
+
+func listPaymentVersionsEndpoint(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	conf := ctx.Value(ContextConfig).(*Config)
+	payment := ctx.Value(ContextPayment).(*Payment)
+	db := ctx.Value(ContextDb).(Db)
+	versions, err := db.GetPaymentVersions(ctx, payment.ID)
+	if err != nil {
+		renderDbError(w, r, "failed to fetch payment versions", err)
+		return
+	}
+	data := []paymentVersionRest{}
+	for _, v := range *versions {
+		data = append(data, paymentVersionToRest(conf, v))
+	}
+	render.JSON(w, r, paymentVersionsDataRest{
+		Data:  data,
+		Links: selfLinksRest{Self: paymentVersionsLink(conf, payment.ID)},
+	})
+}
+
+func getPaymentVersionEndpoint(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	conf := ctx.Value(ContextConfig).(*Config)
+	payment := ctx.Value(ContextPayment).(*Payment)
+	db := ctx.Value(ContextDb).(Db)
+	n, err := strconv.Atoi(chi.URLParam(r, "version"))
+	if err != nil {
+		renderError(w, r, http.StatusNotFound)
+		return
+	}
+	version, err := db.GetPaymentVersion(ctx, payment.ID, n)
+	if err != nil {
+		renderDbError(w, r, "failed to fetch payment version", err)
+		return
+	}
+	render.JSON(w, r, paymentVersionToRest(conf, *version))
+}
+
 func createPaymentEndpoint(w http.ResponseWriter, r *http.Request) {
-	data := &paymentRequest{}
-	if err := render.Bind(r, data); err != nil {
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+	data, ok := bindPaymentRequest(w, r)
+	if !ok {
+		return
+	}
+	idempotent, ok := beginIdempotentRequest(w, r, data.OrganisationID, data)
+	if !ok {
 		return
 	}
 	ctx := r.Context()
@@ -151,34 +429,173 @@ func createPaymentEndpoint(w http.ResponseWriter, r *http.Request) {
 	db := ctx.Value(ContextDb).(Db)
 	id, err := db.CreatePayment(ctx, data.OrganisationID, paymentAttributesFromRest(data.Attributes))
 	if err != nil {
-		logger.Error("failed to create payment: ", err)
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		idempotent.abort(w, r, "failed to create payment", err)
 		return
 	}
-	render.Status(r, http.StatusCreated)
-	render.JSON(w, r, summaryIDToRest(c, *id))
+	idempotent.respond(w, r, http.StatusCreated, summaryIDToRest(c, *id))
 }
 
 func paymentRoute() http.Handler {
-	r := chi.NewRouter()
-	r.Use(paymentCtx)
-	r.Get("/", getPaymentEndpoint)
-	r.Put("/", updatePaymentEndpoint)
-	r.Delete("/", deletePaymentEndpoint)
+	r := newRouter()
+	read := authorize(ActionPaymentsRead)
+	update := authorize(ActionPaymentsUpdate)
+	remove := authorize(ActionPaymentsDelete)
+	r.Use(authorizeIf(ActionPaymentsReadDeleted, requestsDeleted))
+	r.With(remove, deletedPaymentCtx).Post("/restore", restorePaymentEndpoint)
+	// The history of deleted payments remains available
+	r.With(read, deletedPaymentCtx).Get("/versions", listPaymentVersionsEndpoint)
+	r.With(read, deletedPaymentCtx).Get("/versions/{version}", getPaymentVersionEndpoint)
+	r.With(read, paymentCtx).Get("/", getPaymentEndpoint)
+	r.With(update, paymentCtx).Put("/", updatePaymentEndpoint)
+	r.With(remove, paymentCtx).Delete("/", deletePaymentEndpoint)
+	r.With(update, paymentCtx).Put("/status", updatePaymentStatusEndpoint)
 	return r
 }
 
 func paymentsRoute() http.Handler {
-	r := chi.NewRouter()
-	r.Get("/", listPaymentsEndpoint)
-	r.Post("/", createPaymentEndpoint)
+	r := newRouter()
+	r.Use(authorizeIf(ActionPaymentsReadDeleted, requestsDeleted))
+	r.With(authorize(ActionPaymentsRead)).Get("/", listPaymentsEndpoint)
+	r.With(authorize(ActionPaymentsCreate)).Post("/", createPaymentEndpoint)
+	return r
+}
+
+type subscriptionRequest struct {
+	// OrganisationID defaults to the organisation of the caller
+	OrganisationID string   `json:"organisation_id"`
+	URL            string   `json:"url"`
+	EventTypes     []string `json:"event_types"`
+}
+
+func (u *subscriptionRequest) Bind(r *http.Request) error {
+	return validateSubscriptionRequest(r.Context(), u, contextOrganisation(r.Context()))
+}
+
+func createSubscriptionEndpoint(w http.ResponseWriter, r *http.Request) {
+	data := &subscriptionRequest{}
+	if !bindRequest(w, r, data) {
+		return
+	}
+	ctx := r.Context()
+	conf := ctx.Value(ContextConfig).(*Config)
+	db := ctx.Value(ContextDb).(Db)
+	secret, err := newWebhookSecret()
+	if err != nil {
+		contextLogger(r.Context()).Error("failed to generate webhook secret", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+	subscription, err := db.CreateSubscription(ctx, data.OrganisationID, data.URL, data.EventTypes, secret)
+	if err != nil {
+		renderDbError(w, r, "failed to create subscription", err)
+		return
+	}
+	res := subscriptionToRest(conf, *subscription)
+	res.Secret = subscription.Secret
+	render.Status(r, http.StatusCreated)
+	render.JSON(w, r, res)
+}
+
+func listSubscriptionsEndpoint(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	conf := ctx.Value(ContextConfig).(*Config)
+	db := ctx.Value(ContextDb).(Db)
+	subscriptions, err := db.GetSubscriptions(ctx)
+	if err != nil {
+		renderDbError(w, r, "failed to fetch subscriptions", err)
+		return
+	}
+	data := []subscriptionRest{}
+	for _, s := range *subscriptions {
+		data = append(data, subscriptionToRest(conf, s))
+	}
+	render.JSON(w, r, subscriptionsDataRest{
+		Data:  data,
+		Links: selfLinksRest{Self: fmt.Sprintf("%s/v1/subscriptions/", conf.Host)},
+	})
+}
+
+// subscriptionCtx loads the subscription of the route
+func subscriptionCtx(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		db := ctx.Value(ContextDb).(Db)
+		id, err := StringToID(chi.URLParam(r, "subscriptionID"))
+		if err != nil {
+			renderError(w, r, http.StatusNotFound)
+			return
+		}
+		subscription, err := db.GetSubscriptionByID(ctx, *id)
+		if err != nil {
+			renderDbError(w, r, "failed to fetch subscription", err)
+			return
+		}
+		ctx = context.WithValue(ctx, ContextSubscription, subscription)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func getSubscriptionEndpoint(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	conf := ctx.Value(ContextConfig).(*Config)
+	subscription := ctx.Value(ContextSubscription).(*Subscription)
+	render.JSON(w, r, subscriptionToRest(conf, *subscription))
+}
+
+func deleteSubscriptionEndpoint(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	subscription := ctx.Value(ContextSubscription).(*Subscription)
+	db := ctx.Value(ContextDb).(Db)
+	if err := db.DeleteSubscription(ctx, subscription.ID); err != nil {
+		renderDbError(w, r, "failed to delete subscription", err)
+		return
+	}
+	render.NoContent(w, r)
+}
+
+func listWebhookDeliveriesEndpoint(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	conf := ctx.Value(ContextConfig).(*Config)
+	subscription := ctx.Value(ContextSubscription).(*Subscription)
+	db := ctx.Value(ContextDb).(Db)
+	deliveries, err := db.GetWebhookDeliveries(ctx, subscription.ID)
+	if err != nil {
+		renderDbError(w, r, "failed to fetch webhook deliveries", err)
+		return
+	}
+	data := []webhookDeliveryRest{}
+	for _, d := range *deliveries {
+		data = append(data, webhookDeliveryToRest(d))
+	}
+	render.JSON(w, r, webhookDeliveriesDataRest{
+		Data:  data,
+		Links: selfLinksRest{Self: subscriptionLink(conf, subscription.ID) + "deliveries/"},
+	})
+}
+
+func subscriptionRoute() http.Handler {
+	r := newRouter()
+	read := authorize(ActionSubscriptionsRead)
+	write := authorize(ActionSubscriptionsWrite)
+	r.With(read, subscriptionCtx).Get("/", getSubscriptionEndpoint)
+	r.With(write, subscriptionCtx).Delete("/", deleteSubscriptionEndpoint)
+	r.With(read, subscriptionCtx).Get("/deliveries", listWebhookDeliveriesEndpoint)
+	return r
+}
+
+func subscriptionsRoute() http.Handler {
+	r := newRouter()
+	r.With(authorize(ActionSubscriptionsRead)).Get("/", listSubscriptionsEndpoint)
+	r.With(authorize(ActionSubscriptionsWrite)).Post("/", createSubscriptionEndpoint)
 	return r
 }
 
 func v1Route() http.Handler {
-	r := chi.NewRouter()
+	r := newRouter()
 	r.Mount("/v1/payments", paymentsRoute())
 	r.Mount("/v1/payments/{paymentID}", paymentRoute())
+	r.Mount("/v1/subscriptions", subscriptionsRoute())
+	r.Mount("/v1/subscriptions/{subscriptionID}", subscriptionRoute())
 	return r
 }
 
@@ -188,8 +605,14 @@ func okEndpoint(w http.ResponseWriter, r *http.Request) {
 
 // RootRoute construcs a route for the API
 func RootRoute() http.Handler {
-	r := chi.NewRouter()
+	r := newRouter()
 	r.Get("/", okEndpoint)
-	r.Mount("/", v1Route())
+	r.Get("/healthz", healthzEndpoint)
+	r.Get("/readyz", readyzEndpoint)
+	r.Group(func(r chi.Router) {
+		r.Use(authenticate)
+		r.Use(actorCtx)
+		r.Mount("/", v1Route())
+	})
 	return r
 }
@@ -2,13 +2,18 @@ package main_test
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"strings"
+	"time"
 
 	. "./"
 	"github.com/gin-gonic/gin"
+	"github.com/go-chi/chi/middleware"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 )
@@ -30,6 +35,49 @@ var _ = Describe("Routes", func() {
 			It("should fail with invalid method", func() {
 				w := performRequest(ctx, "POST", "/")
 				Expect(w.Code).To(Equal(http.StatusMethodNotAllowed))
+				r, _ := ioutil.ReadAll(w.Body)
+				Expect(r).To(MatchJSON(`{"code": "method_not_allowed", "message": "Method Not Allowed"}`))
+			})
+		})
+		Describe("Errors", func() {
+			It("should respond with error envelope on unknown route", func() {
+				w := performRequest(ctx, "GET", "/v2/foo")
+				Expect(w.Code).To(Equal(http.StatusNotFound))
+				Expect(w.Header().Get("content-type")).To(ContainSubstring("application/json"))
+				r, _ := ioutil.ReadAll(w.Body)
+				Expect(r).To(MatchJSON(`{"code": "not_found", "message": "Not Found"}`))
+			})
+			It("should respond with error envelope on invalid method on nested route", func() {
+				w := performRequest(ctx, "PATCH", "/v1/payments/")
+				Expect(w.Code).To(Equal(http.StatusMethodNotAllowed))
+				r, _ := ioutil.ReadAll(w.Body)
+				Expect(r).To(MatchJSON(`{"code": "method_not_allowed", "message": "Method Not Allowed"}`))
+			})
+			It("should include the request id", func() {
+				req := httptest.NewRequest("GET", "/v1/payments/non-existing-id", nil)
+				w := httptest.NewRecorder()
+				middleware.RequestID(RootRoute()).ServeHTTP(w, req.WithContext(ctx))
+				Expect(w.Code).To(Equal(http.StatusNotFound))
+				var res struct {
+					RequestID string `json:"request_id"`
+				}
+				_ = json.NewDecoder(w.Body).Decode(&res)
+				Expect(res.RequestID).ToNot(BeEmpty())
+			})
+			It("should respond with error envelope on internal server error", func() {
+				c := context.WithValue(ctx, ContextDb, mockDb{
+					error: errors.New("noooo"),
+				})
+				w := performRequestBody(c, "POST", "/v1/payments", strings.NewReader(paymentRequestJSON))
+				Expect(w.Code).To(Equal(http.StatusInternalServerError))
+				r, _ := ioutil.ReadAll(w.Body)
+				Expect(r).To(MatchJSON(`{"code": "internal_error", "message": "Internal Server Error"}`))
+			})
+			It("should respond with error envelope on invalid body", func() {
+				w := performRequestBody(ctx, "POST", "/v1/payments", strings.NewReader("{"))
+				Expect(w.Code).To(Equal(http.StatusBadRequest))
+				r, _ := ioutil.ReadAll(w.Body)
+				Expect(r).To(MatchJSON(`{"code": "bad_request", "message": "Bad Request"}`))
 			})
 		})
 		Describe("GET /v1/payments/", func() {
@@ -93,6 +141,118 @@ var _ = Describe("Routes", func() {
 			})
 		})
 
+		Describe("GET /v1/payments/ with filter and sort", func() {
+			It("should keep filter and sort in links", func() {
+				memDb := NewMemoryDb()
+				small := paymentSample.Attributes
+				small.Amount = "9.99"
+				id1, _ := memDb.CreatePayment(testCtx, paymentSample.OrganisationID, paymentSample.Attributes)
+				_, _ = memDb.CreatePayment(testCtx, paymentSample.OrganisationID, small)
+				id3, _ := memDb.CreatePayment(testCtx, paymentSample.OrganisationID, small)
+				c := context.WithValue(ctx, ContextDb, memDb)
+				w := performRequest(c, "GET", "/v1/payments/?count=1&sort=-amount&currency=GBP&processing_date_from=2017-01-01")
+				Expect(w.Code).To(Equal(http.StatusOK))
+				r, _ := ioutil.ReadAll(w.Body)
+				Expect(r).To(MatchJSON(fmt.Sprintf(`{
+					"data": [
+						{"id": "%[1]s", "links": {"self": "http://example.com/v1/payments/%[1]s/"}}],
+					"links": {
+						"self": "http://example.com/v1/payments/?count=1&currency=GBP&processing_date_from=2017-01-01&sort=-amount",
+						"next": "http://example.com/v1/payments/?count=1&currency=GBP&processing_date_from=2017-01-01&sort=-amount&after=%[1]s"}}`,
+					IDToString(*id1))))
+				w = performRequest(c, "GET", fmt.Sprintf("/v1/payments/?count=1&sort=-amount&currency=GBP&processing_date_from=2017-01-01&after=%s", IDToString(*id1)))
+				Expect(w.Code).To(Equal(http.StatusOK))
+				var res struct {
+					Data []struct {
+						ID string `json:"id"`
+					} `json:"data"`
+				}
+				_ = json.NewDecoder(w.Body).Decode(&res)
+				Expect(res.Data).To(HaveLen(1))
+				// Ties are sorted by id in the same direction
+				Expect(res.Data[0].ID).To(Equal(IDToString(*id3)))
+			})
+			It("should escape filter values in links", func() {
+				w := performRequest(ctx, "GET", "/v1/payments/?debtor_account_number=GB29%20XABC")
+				Expect(w.Code).To(Equal(http.StatusOK))
+				r, _ := ioutil.ReadAll(w.Body)
+				Expect(r).To(MatchJSON(`{"data": [], "links": {"self": "http://example.com/v1/payments/?count=10&debtor_account_number=GB29+XABC", "next": null}}`))
+			})
+			It("should list at most 100 payments", func() {
+				var query PaymentQuery
+				c := context.WithValue(ctx, ContextDb, queryRecordingDb{Db: mockDb{}, query: &query})
+				w := performRequest(c, "GET", "/v1/payments/?count=1000000")
+				Expect(w.Code).To(Equal(http.StatusOK))
+				Expect(query.Size).To(Equal(101))
+				Expect(w.Body.String()).To(ContainSubstring(`"self":"http://example.com/v1/payments/?count=100"`))
+			})
+
+			It("should return 422 on invalid filter and sort", func() {
+				w := performRequest(ctx, "GET", "/v1/payments/?processing_date_to=yesterday&amount_min=ten&sort=name")
+				Expect(w.Code).To(Equal(http.StatusUnprocessableEntity))
+				r, _ := ioutil.ReadAll(w.Body)
+				Expect(r).To(MatchJSON(`{
+					"code": "validation_failed",
+					"message": "Unprocessable Entity",
+					"errors": [
+						{"field": "processing_date_to", "message": "must be a date formatted as YYYY-MM-DD"},
+						{"field": "amount_min", "message": "must be a decimal number"},
+						{"field": "sort", "message": "must be one of id, processing_date or amount optionally prefixed with -"}
+					]}`))
+			})
+		})
+
+		Describe("GET /v1/payments/ with fields and expand", func() {
+			var c context.Context
+			BeforeEach(func() {
+				c = context.WithValue(ctx, ContextDb, mockDb{Payments: []Payment{paymentSample}})
+			})
+			It("should return full payments when expanding attributes", func() {
+				w := performRequest(c, "GET", "/v1/payments/?expand=attributes")
+				Expect(w.Code).To(Equal(http.StatusOK))
+				r, _ := ioutil.ReadAll(w.Body)
+				Expect(r).To(MatchJSON(fmt.Sprintf(`{
+					"data": [{
+						"type": "Payment",
+						"id": "5cdd382e9549af35c3b94301",
+						"version": 0,
+						"status": "created",
+						"organisation_id": "743d5b63-8e6f-432e-a8fa-c5d8d2ee5fcb",
+						"attributes": %s,
+						"links": {"self": "http://example.com/v1/payments/5cdd382e9549af35c3b94301/"}}],
+					"links": {
+						"self": "http://example.com/v1/payments/?count=10&expand=attributes",
+						"next": null}}`, paymentSampleAttributesJSON)))
+			})
+			It("should return sparse payments with fields", func() {
+				w := performRequest(c, "GET", "/v1/payments/?fields=amount,currency,version")
+				Expect(w.Code).To(Equal(http.StatusOK))
+				r, _ := ioutil.ReadAll(w.Body)
+				Expect(r).To(MatchJSON(`{
+					"data": [{
+						"type": "Payment",
+						"id": "5cdd382e9549af35c3b94301",
+						"version": 0,
+						"attributes": {"amount": "100.21", "currency": "GBP"},
+						"links": {"self": "http://example.com/v1/payments/5cdd382e9549af35c3b94301/"}}],
+					"links": {
+						"self": "http://example.com/v1/payments/?count=10&fields=amount%2Ccurrency%2Cversion",
+						"next": null}}`))
+			})
+			It("should return 422 on invalid fields and expand", func() {
+				w := performRequest(ctx, "GET", "/v1/payments/?fields=amount,colour&expand=everything")
+				Expect(w.Code).To(Equal(http.StatusUnprocessableEntity))
+				r, _ := ioutil.ReadAll(w.Body)
+				Expect(r).To(MatchJSON(`{
+					"code": "validation_failed",
+					"message": "Unprocessable Entity",
+					"errors": [
+						{"field": "fields", "message": "\"colour\" is not a payment field"},
+						{"field": "expand", "message": "must be attributes"}
+					]}`))
+			})
+		})
+
 		Describe("GET /v1/payments/{id}", func() {
 			It("should return 404 on not found payment", func() {
 				w := performRequest(ctx, "GET", "/v1/payments/non-existing-id")
@@ -107,12 +267,14 @@ var _ = Describe("Routes", func() {
 					}})
 				w := performRequest(c, "GET", "/v1/payments/5cdd382e9549af35c3b94301")
 				Expect(w.Code).To(Equal(http.StatusOK))
+				Expect(w.Header().Get("etag")).To(Equal(`"0"`))
 				r, _ := ioutil.ReadAll(w.Body)
 				Expect(string(r)).To(MatchJSON(`
 				{
 					"type": "Payment",
 				  	"id": "5cdd382e9549af35c3b94301",
 				  	"version": 0,
+				  	"status": "created",
 				  	"organisation_id": "743d5b63-8e6f-432e-a8fa-c5d8d2ee5fcb",
 					"attributes": {
 						"amount": "100.21",
@@ -199,8 +361,56 @@ var _ = Describe("Routes", func() {
 					Payments: []Payment{
 						paymentSample,
 					}})
-				w := performRequestBody(c, "PUT", "/v1/payments/5cdd382e9549af35c3b94301", strings.NewReader("{}"))
+				w := performRequestBody(c, "PUT", "/v1/payments/5cdd382e9549af35c3b94301", strings.NewReader(versionedPaymentRequestJSON(0)))
 				Expect(w.Code).To(Equal(http.StatusNoContent))
+				Expect(w.Header().Get("etag")).To(Equal(`"1"`))
+			})
+			It("should accept the version from the If-Match header", func() {
+				c := context.WithValue(ctx, ContextDb, mockDb{
+					Payments: []Payment{
+						paymentSample,
+					}})
+				w := performRequestHeaders(c, "PUT", "/v1/payments/5cdd382e9549af35c3b94301", strings.NewReader(paymentRequestJSON), map[string]string{
+					"If-Match": `"0"`,
+				})
+				Expect(w.Code).To(Equal(http.StatusNoContent))
+			})
+			It("should return 400 on invalid If-Match header", func() {
+				c := context.WithValue(ctx, ContextDb, mockDb{
+					Payments: []Payment{
+						paymentSample,
+					}})
+				w := performRequestHeaders(c, "PUT", "/v1/payments/5cdd382e9549af35c3b94301", strings.NewReader(paymentRequestJSON), map[string]string{
+					"If-Match": "*",
+				})
+				Expect(w.Code).To(Equal(http.StatusBadRequest))
+			})
+			It("should return 422 on invalid payment", func() {
+				c := context.WithValue(ctx, ContextDb, mockDb{
+					Payments: []Payment{
+						paymentSample,
+					}})
+				w := performRequestBody(c, "PUT", "/v1/payments/5cdd382e9549af35c3b94301", strings.NewReader(`{"version": 0}`))
+				Expect(w.Code).To(Equal(http.StatusUnprocessableEntity))
+			})
+			It("should return 428 when no version is given", func() {
+				c := context.WithValue(ctx, ContextDb, mockDb{
+					Payments: []Payment{
+						paymentSample,
+					}})
+				w := performRequestBody(c, "PUT", "/v1/payments/5cdd382e9549af35c3b94301", strings.NewReader(paymentRequestJSON))
+				Expect(w.Code).To(Equal(http.StatusPreconditionRequired))
+			})
+			It("should return 409 with current version on version conflict", func() {
+				c := context.WithValue(ctx, ContextDb, mockDb{
+					Payments: []Payment{
+						paymentSample,
+					}})
+				w := performRequestBody(c, "PUT", "/v1/payments/5cdd382e9549af35c3b94301", strings.NewReader(versionedPaymentRequestJSON(3)))
+				Expect(w.Code).To(Equal(http.StatusConflict))
+				Expect(w.Header().Get("etag")).To(Equal(`"0"`))
+				r, _ := ioutil.ReadAll(w.Body)
+				Expect(r).To(MatchJSON(`{"code": "version_conflict", "message": "Conflict", "version": 0}`))
 			})
 			It("should return 500 on internal server error", func() {
 				c := context.WithValue(ctx, ContextDb, mockDb{
@@ -208,7 +418,7 @@ var _ = Describe("Routes", func() {
 					Payments: []Payment{
 						paymentSample,
 					}})
-				w := performRequestBody(c, "PUT", "/v1/payments/5cdd382e9549af35c3b94301", strings.NewReader("{}"))
+				w := performRequestBody(c, "PUT", "/v1/payments/5cdd382e9549af35c3b94301", strings.NewReader(versionedPaymentRequestJSON(0)))
 				Expect(w.Code).To(Equal(http.StatusInternalServerError))
 				r, _ := ioutil.ReadAll(w.Body)
 				Expect(string(r)).ToNot(ContainSubstring("noooo"))
@@ -253,12 +463,31 @@ var _ = Describe("Routes", func() {
 				w := performRequestBody(c, "POST", "/v1/payments", strings.NewReader("{"))
 				Expect(w.Code).To(Equal(http.StatusBadRequest))
 			})
+			It("should return 422 with field errors on invalid payment", func() {
+				w := performRequestBody(ctx, "POST", "/v1/payments", strings.NewReader("{}"))
+				Expect(w.Code).To(Equal(http.StatusUnprocessableEntity))
+				Expect(w.Header().Get("content-type")).To(ContainSubstring("application/json"))
+				r, _ := ioutil.ReadAll(w.Body)
+				Expect(r).To(MatchJSON(`{
+					"code": "validation_failed",
+					"message": "Unprocessable Entity",
+					"errors": [
+						{"field": "organisation_id", "message": "is required"},
+						{"field": "attributes.amount", "message": "is required"},
+						{"field": "attributes.currency", "message": "is required"},
+						{"field": "attributes.processing_date", "message": "is required"},
+						{"field": "attributes.beneficiary_party.account_number", "message": "is required"},
+						{"field": "attributes.beneficiary_party.bank_id", "message": "is required"},
+						{"field": "attributes.debtor_party.account_number", "message": "is required"},
+						{"field": "attributes.debtor_party.bank_id", "message": "is required"}
+					]}`))
+			})
 			It("should return 200 on success", func() {
 				c := context.WithValue(ctx, ContextDb, mockDb{
 					Payments: []Payment{
 						paymentSample,
 					}})
-				w := performRequestBody(c, "POST", "/v1/payments", strings.NewReader("{}"))
+				w := performRequestBody(c, "POST", "/v1/payments", strings.NewReader(paymentRequestJSON))
 				Expect(w.Code).To(Equal(http.StatusCreated))
 				r, _ := ioutil.ReadAll(w.Body)
 				Expect(string(r)).To(MatchJSON(`
@@ -271,7 +500,7 @@ var _ = Describe("Routes", func() {
 					Payments: []Payment{
 						paymentSample,
 					}})
-				w := performRequestBody(c, "POST", "/v1/payments", strings.NewReader("{}"))
+				w := performRequestBody(c, "POST", "/v1/payments", strings.NewReader(paymentRequestJSON))
 				Expect(w.Code).To(Equal(http.StatusInternalServerError))
 				r, _ := ioutil.ReadAll(w.Body)
 				Expect(string(r)).ToNot(ContainSubstring("noooo"))
@@ -279,5 +508,427 @@ var _ = Describe("Routes", func() {
 			})
 		})
 
+		Describe("PUT /v1/payments/{id}/status", func() {
+			var c context.Context
+			var memDb Db
+			var path string
+			BeforeEach(func() {
+				memDb = NewMemoryDb()
+				c = context.WithValue(ctx, ContextDb, memDb)
+				id, _ := memDb.CreatePayment(testCtx, paymentSample.OrganisationID, paymentSample.Attributes)
+				path = fmt.Sprintf("/v1/payments/%s", IDToString(*id))
+			})
+			transition := func(status string, version int) *httptest.ResponseRecorder {
+				return performRequestBody(c, "PUT", path+"/status",
+					strings.NewReader(fmt.Sprintf(`{"status": "%s", "version": %d}`, status, version)))
+			}
+			It("should transition the payment", func() {
+				w := transition("pending_submission", 0)
+				Expect(w.Code).To(Equal(http.StatusNoContent))
+				Expect(w.Header().Get("etag")).To(Equal(`"1"`))
+				w = performRequest(c, "GET", path)
+				var res struct {
+					Status string `json:"status"`
+				}
+				_ = json.NewDecoder(w.Body).Decode(&res)
+				Expect(res.Status).To(Equal("pending_submission"))
+			})
+			It("should return 409 on invalid transition", func() {
+				w := transition("accepted", 0)
+				Expect(w.Code).To(Equal(http.StatusConflict))
+				r, _ := ioutil.ReadAll(w.Body)
+				Expect(r).To(MatchJSON(`{
+					"code": "invalid_transition",
+					"message": "Payment can not transition from created to accepted"}`))
+			})
+			It("should return 422 on unknown status", func() {
+				w := transition("paid", 0)
+				Expect(w.Code).To(Equal(http.StatusUnprocessableEntity))
+				r, _ := ioutil.ReadAll(w.Body)
+				Expect(r).To(MatchJSON(`{
+					"code": "validation_failed",
+					"message": "Unprocessable Entity",
+					"errors": [{"field": "status", "message": "is not a payment status"}]}`))
+			})
+			It("should return 428 without version", func() {
+				w := performRequestBody(c, "PUT", path+"/status", strings.NewReader(`{"status": "cancelled"}`))
+				Expect(w.Code).To(Equal(http.StatusPreconditionRequired))
+			})
+			It("should reject updates and deletes once submitted", func() {
+				Expect(transition("pending_submission", 0).Code).To(Equal(http.StatusNoContent))
+				Expect(transition("submitted", 1).Code).To(Equal(http.StatusNoContent))
+				w := performRequestBody(c, "PUT", path, strings.NewReader(versionedPaymentRequestJSON(2)))
+				Expect(w.Code).To(Equal(http.StatusConflict))
+				r, _ := ioutil.ReadAll(w.Body)
+				Expect(r).To(MatchJSON(`{
+					"code": "payment_locked",
+					"message": "Payment can not be modified when submitted"}`))
+				w = performRequest(c, "DELETE", path)
+				Expect(w.Code).To(Equal(http.StatusConflict))
+			})
+		})
+
+		Describe("DELETE /v1/payments/{id} and restore", func() {
+			var c context.Context
+			var path string
+			BeforeEach(func() {
+				memDb := NewMemoryDb()
+				c = context.WithValue(ctx, ContextDb, memDb)
+				id, _ := memDb.CreatePayment(testCtx, paymentSample.OrganisationID, paymentSample.Attributes)
+				path = fmt.Sprintf("/v1/payments/%s", IDToString(*id))
+				w := performRequestHeaders(c, "DELETE", path, nil, map[string]string{"X-Actor": "auditor"})
+				Expect(w.Code).To(Equal(http.StatusNoContent))
+			})
+			It("should hide deleted payments", func() {
+				Expect(performRequest(c, "GET", path).Code).To(Equal(http.StatusNotFound))
+				w := performRequest(c, "GET", "/v1/payments/")
+				r, _ := ioutil.ReadAll(w.Body)
+				Expect(r).To(MatchJSON(`{"data": [], "links": {"self": "http://example.com/v1/payments/?count=10", "next": null}}`))
+			})
+			It("should include deleted payments on request", func() {
+				w := performRequest(c, "GET", path+"?include_deleted=true")
+				Expect(w.Code).To(Equal(http.StatusOK))
+				var res struct {
+					Version   int    `json:"version"`
+					DeletedAt string `json:"deleted_at"`
+					DeletedBy string `json:"deleted_by"`
+				}
+				_ = json.NewDecoder(w.Body).Decode(&res)
+				Expect(res.Version).To(Equal(1))
+				Expect(res.DeletedBy).To(Equal("auditor"))
+				deletedAt, err := time.Parse(time.RFC3339, res.DeletedAt)
+				Expect(err).To(BeNil())
+				Expect(deletedAt).To(BeTemporally("~", time.Now(), time.Minute))
+				w = performRequest(c, "GET", "/v1/payments/?include_deleted=true&fields=deleted_by")
+				r, _ := ioutil.ReadAll(w.Body)
+				Expect(r).To(MatchJSON(fmt.Sprintf(`{
+					"data": [{
+						"type": "Payment",
+						"id": "%[1]s",
+						"deleted_by": "auditor",
+						"links": {"self": "http://example.com%[2]s/"}}],
+					"links": {
+						"self": "http://example.com/v1/payments/?count=10&fields=deleted_by&include_deleted=true",
+						"next": null}}`, strings.TrimPrefix(path, "/v1/payments/"), path)))
+			})
+			It("should return 422 on invalid include_deleted", func() {
+				w := performRequest(c, "GET", path+"?include_deleted=maybe")
+				Expect(w.Code).To(Equal(http.StatusUnprocessableEntity))
+			})
+			It("should reject updates of deleted payments", func() {
+				w := performRequestBody(c, "PUT", path+"?include_deleted=true", strings.NewReader(versionedPaymentRequestJSON(1)))
+				Expect(w.Code).To(Equal(http.StatusConflict))
+				r, _ := ioutil.ReadAll(w.Body)
+				Expect(r).To(MatchJSON(`{
+					"code": "payment_locked",
+					"message": "Payment can not be modified when deleted"}`))
+			})
+			It("should restore deleted payments", func() {
+				Expect(performRequest(c, "POST", path+"/restore").Code).To(Equal(http.StatusNoContent))
+				w := performRequest(c, "GET", path)
+				Expect(w.Code).To(Equal(http.StatusOK))
+				r, _ := ioutil.ReadAll(w.Body)
+				Expect(string(r)).ToNot(ContainSubstring("deleted"))
+			})
+			It("should respond with error envelope on invalid method", func() {
+				w := performRequest(c, "PATCH", path)
+				Expect(w.Code).To(Equal(http.StatusMethodNotAllowed))
+				r, _ := ioutil.ReadAll(w.Body)
+				Expect(r).To(MatchJSON(`{"code": "method_not_allowed", "message": "Method Not Allowed"}`))
+			})
+		})
+
+		Describe("GET /v1/payments/{id}/versions", func() {
+			var c context.Context
+			var path string
+			BeforeEach(func() {
+				memDb := NewMemoryDb()
+				c = context.WithValue(ctx, ContextDb, memDb)
+				id, _ := memDb.CreatePayment(testCtx, paymentSample.OrganisationID, paymentSample.Attributes)
+				path = fmt.Sprintf("/v1/payments/%s", IDToString(*id))
+				w := performRequestHeaders(c, "PUT", path, strings.NewReader(versionedPaymentRequestJSON(0)),
+					map[string]string{"X-Actor": "auditor"})
+				Expect(w.Code).To(Equal(http.StatusNoContent))
+			})
+			It("should list the history of the payment", func() {
+				w := performRequest(c, "GET", path+"/versions")
+				Expect(w.Code).To(Equal(http.StatusOK))
+				var res struct {
+					Data []struct {
+						Version   int    `json:"version"`
+						Event     string `json:"event"`
+						Actor     string `json:"actor"`
+						Timestamp string `json:"timestamp"`
+						Payment   struct {
+							Version int `json:"version"`
+						} `json:"payment"`
+						Links struct {
+							Self string `json:"self"`
+						} `json:"links"`
+					} `json:"data"`
+					Links struct {
+						Self string `json:"self"`
+					} `json:"links"`
+				}
+				Expect(json.NewDecoder(w.Body).Decode(&res)).To(Succeed())
+				Expect(res.Links.Self).To(Equal("http://example.com" + path + "/versions/"))
+				Expect(res.Data).To(HaveLen(2))
+				Expect(res.Data[0].Event).To(Equal("created"))
+				Expect(res.Data[0].Actor).To(Equal("system"))
+				Expect(res.Data[1].Version).To(Equal(1))
+				Expect(res.Data[1].Event).To(Equal("updated"))
+				Expect(res.Data[1].Actor).To(Equal("auditor"))
+				Expect(res.Data[1].Payment.Version).To(Equal(1))
+				Expect(res.Data[1].Links.Self).To(Equal("http://example.com" + path + "/versions/1/"))
+				timestamp, err := time.Parse(time.RFC3339, res.Data[1].Timestamp)
+				Expect(err).To(BeNil())
+				Expect(timestamp).To(BeTemporally("~", time.Now(), time.Minute))
+			})
+			It("should get a single version", func() {
+				w := performRequest(c, "GET", path+"/versions/0")
+				Expect(w.Code).To(Equal(http.StatusOK))
+				var res struct {
+					Version int `json:"version"`
+					Payment struct {
+						Version int `json:"version"`
+					} `json:"payment"`
+				}
+				Expect(json.NewDecoder(w.Body).Decode(&res)).To(Succeed())
+				Expect(res.Version).To(Equal(0))
+				Expect(res.Payment.Version).To(Equal(0))
+			})
+			It("should return 404 on unknown versions", func() {
+				Expect(performRequest(c, "GET", path+"/versions/2").Code).To(Equal(http.StatusNotFound))
+				Expect(performRequest(c, "GET", path+"/versions/latest").Code).To(Equal(http.StatusNotFound))
+			})
+			It("should keep the history of deleted payments", func() {
+				Expect(performRequest(c, "DELETE", path).Code).To(Equal(http.StatusNoContent))
+				w := performRequest(c, "GET", path+"/versions/2")
+				Expect(w.Code).To(Equal(http.StatusOK))
+				r, _ := ioutil.ReadAll(w.Body)
+				Expect(string(r)).To(ContainSubstring(`"event":"deleted"`))
+			})
+		})
+
+		Describe("/v1/subscriptions", func() {
+			var c context.Context
+			var memDb Db
+			BeforeEach(func() {
+				memDb = NewMemoryDb()
+				c = context.WithValue(ctx, ContextDb, memDb)
+			})
+			create := func() (string, string) {
+				w := performRequestBody(c, "POST", "/v1/subscriptions", strings.NewReader(
+					`{"organisation_id": "743d5b63-8e6f-432e-a8fa-c5d8d2ee5fcb", "url": "https://example.org/hook",
+					"event_types": ["payment.created"]}`))
+				Expect(w.Code).To(Equal(http.StatusCreated))
+				var res struct {
+					ID     string `json:"id"`
+					Secret string `json:"secret"`
+				}
+				Expect(json.NewDecoder(w.Body).Decode(&res)).To(Succeed())
+				return res.ID, res.Secret
+			}
+			It("should create subscriptions with a secret", func() {
+				id, secret := create()
+				Expect(secret).To(HaveLen(64))
+				subscription, _ := StringToID(id)
+				stored, _ := memDb.GetSubscriptionByID(testCtx, *subscription)
+				Expect(stored.Secret).To(Equal(secret))
+				Expect(stored.URL).To(Equal("https://example.org/hook"))
+			})
+			It("should list and get subscriptions without the secret", func() {
+				id, _ := create()
+				w := performRequest(c, "GET", "/v1/subscriptions")
+				Expect(w.Code).To(Equal(http.StatusOK))
+				r, _ := ioutil.ReadAll(w.Body)
+				Expect(string(r)).ToNot(ContainSubstring("secret"))
+				Expect(string(r)).To(ContainSubstring(`"self":"http://example.com/v1/subscriptions/"`))
+				w = performRequest(c, "GET", "/v1/subscriptions/"+id)
+				Expect(w.Code).To(Equal(http.StatusOK))
+				var res struct {
+					ID         string   `json:"id"`
+					URL        string   `json:"url"`
+					EventTypes []string `json:"event_types"`
+					Secret     string   `json:"secret"`
+				}
+				Expect(json.NewDecoder(w.Body).Decode(&res)).To(Succeed())
+				Expect(res.ID).To(Equal(id))
+				Expect(res.EventTypes).To(Equal([]string{"payment.created"}))
+				Expect(res.Secret).To(BeEmpty())
+			})
+			It("should create subscriptions of all organisations for callers of any organisation", func() {
+				w := performRequestBody(c, "POST", "/v1/subscriptions", strings.NewReader(
+					`{"url": "https://example.org/hook", "event_types": ["payment.created"]}`))
+				Expect(w.Code).To(Equal(http.StatusCreated))
+				all, _ := memDb.GetSubscriptions(testCtx)
+				Expect(*all).To(HaveLen(1))
+				Expect((*all)[0].OrganisationID).To(BeEmpty())
+			})
+			It("should delete subscriptions", func() {
+				id, _ := create()
+				Expect(performRequest(c, "DELETE", "/v1/subscriptions/"+id).Code).To(Equal(http.StatusNoContent))
+				Expect(performRequest(c, "GET", "/v1/subscriptions/"+id).Code).To(Equal(http.StatusNotFound))
+			})
+			It("should return 404 on unknown subscriptions", func() {
+				Expect(performRequest(c, "GET", "/v1/subscriptions/foo").Code).To(Equal(http.StatusNotFound))
+				Expect(performRequest(c, "GET", "/v1/subscriptions/"+IDToString(*id)).Code).To(Equal(http.StatusNotFound))
+			})
+			It("should return 422 on invalid subscriptions", func() {
+				w := performRequestBody(c, "POST", "/v1/subscriptions", strings.NewReader(
+					`{"url": "http://example.org", "event_types": ["payment.created", "payment.paid"]}`))
+				Expect(w.Code).To(Equal(http.StatusUnprocessableEntity))
+				r, _ := ioutil.ReadAll(w.Body)
+				Expect(r).To(MatchJSON(`{
+					"code": "validation_failed",
+					"message": "Unprocessable Entity",
+					"errors": [
+						{"field": "url", "message": "must be an absolute https URL"},
+						{"field": "event_types[1]", "message": "is not an event type"}]}`))
+			})
+			It("should return 422 on subscriptions to loopback, private or link-local addresses", func() {
+				for _, u := range []string{"https://127.0.0.1/hook", "https://localhost:8443", "https://10.1.2.3",
+					"https://169.254.169.254/latest/meta-data", "https://[::1]/hook", "https://[fd00::1]"} {
+					w := performRequestBody(c, "POST", "/v1/subscriptions", strings.NewReader(fmt.Sprintf(
+						`{"organisation_id": "743d5b63-8e6f-432e-a8fa-c5d8d2ee5fcb", "url": %q,
+						"event_types": ["payment.created"]}`, u)))
+					Expect(w.Code).To(Equal(http.StatusUnprocessableEntity), u)
+					r, _ := ioutil.ReadAll(w.Body)
+					Expect(string(r)).To(ContainSubstring("must not target a loopback, private or link-local address"), u)
+				}
+			})
+			It("should list the deliveries of a subscription", func() {
+				id, _ := create()
+				_, _ = memDb.CreatePayment(testCtx, paymentSample.OrganisationID, paymentSample.Attributes)
+				_, err := NewDispatcher(&testConfig, memDb, NewWebhookPublisher(&testConfig, memDb)).Dispatch(testCtx)
+				Expect(err).To(BeNil())
+				w := performRequest(c, "GET", "/v1/subscriptions/"+id+"/deliveries")
+				Expect(w.Code).To(Equal(http.StatusOK))
+				var res struct {
+					Data []struct {
+						EventType     string   `json:"event_type"`
+						Status        string   `json:"status"`
+						Attempts      []string `json:"attempts"`
+						NextAttemptAt string   `json:"next_attempt_at"`
+					} `json:"data"`
+				}
+				Expect(json.NewDecoder(w.Body).Decode(&res)).To(Succeed())
+				Expect(res.Data).To(HaveLen(1))
+				Expect(res.Data[0].EventType).To(Equal("payment.created"))
+				Expect(res.Data[0].Status).To(Equal("pending"))
+				Expect(res.Data[0].Attempts).To(BeEmpty())
+				Expect(res.Data[0].NextAttemptAt).ToNot(BeEmpty())
+			})
+		})
+
+		Describe("POST /v1/payments/ with Idempotency-Key", func() {
+			var c context.Context
+			var memDb Db
+			BeforeEach(func() {
+				memDb = NewMemoryDb()
+				c = context.WithValue(ctx, ContextDb, memDb)
+			})
+			post := func(body string, key string) *httptest.ResponseRecorder {
+				return performRequestHeaders(c, "POST", "/v1/payments", strings.NewReader(body),
+					map[string]string{"Idempotency-Key": key})
+			}
+			It("should replay the response of the first request", func() {
+				w1 := post(paymentRequestJSON, "key-1")
+				Expect(w1.Code).To(Equal(http.StatusCreated))
+				Expect(w1.Header().Get("Idempotent-Replayed")).To(BeEmpty())
+				w2 := post(paymentRequestJSON, "key-1")
+				Expect(w2.Code).To(Equal(http.StatusCreated))
+				Expect(w2.Header().Get("Idempotent-Replayed")).To(Equal("true"))
+				Expect(w2.Body.String()).To(Equal(w1.Body.String()))
+				res, _ := memDb.GetPayments(ctx, PaymentQuery{Size: 10})
+				Expect(*res).To(HaveLen(1))
+			})
+			It("should ignore formatting of the request", func() {
+				Expect(post(paymentRequestJSON, "key-1").Code).To(Equal(http.StatusCreated))
+				var req interface{}
+				_ = json.Unmarshal([]byte(paymentRequestJSON), &req)
+				compact, _ := json.Marshal(req)
+				Expect(post(string(compact), "key-1").Header().Get("Idempotent-Replayed")).To(Equal("true"))
+			})
+			It("should create a payment per key", func() {
+				Expect(post(paymentRequestJSON, "key-1").Code).To(Equal(http.StatusCreated))
+				Expect(post(paymentRequestJSON, "key-2").Code).To(Equal(http.StatusCreated))
+				res, _ := memDb.GetPayments(ctx, PaymentQuery{Size: 10})
+				Expect(*res).To(HaveLen(2))
+			})
+			It("should return 422 when the key is reused with a different request", func() {
+				Expect(post(paymentRequestJSON, "key-1").Code).To(Equal(http.StatusCreated))
+				w := post(versionedPaymentRequestJSON(1), "key-1")
+				Expect(w.Code).To(Equal(http.StatusUnprocessableEntity))
+				r, _ := ioutil.ReadAll(w.Body)
+				Expect(r).To(MatchJSON(`{
+					"code": "idempotency_key_reused",
+					"message": "Idempotency-Key was used with a different request"}`))
+			})
+			It("should return 409 while the first request is in progress", func() {
+				_, _ = memDb.ReserveIdempotencyKey(ctx, IdempotencyRecord{
+					ID:        IdempotencyKey{OrganisationID: paymentSample.OrganisationID, Key: "key-1"},
+					ExpiresAt: time.Now().Add(time.Hour),
+				})
+				w := post(paymentRequestJSON, "key-1")
+				Expect(w.Code).To(Equal(http.StatusConflict))
+				r, _ := ioutil.ReadAll(w.Body)
+				Expect(r).To(MatchJSON(`{
+					"code": "idempotency_key_in_use",
+					"message": "a request with the same Idempotency-Key is in progress"}`))
+			})
+			It("should not replay expired keys", func() {
+				expired := testConfig
+				expired.IdempotencyKeyTTL = 0
+				c = context.WithValue(c, ContextConfig, &expired)
+				Expect(post(paymentRequestJSON, "key-1").Code).To(Equal(http.StatusCreated))
+				Expect(post(paymentRequestJSON, "key-1").Header().Get("Idempotent-Replayed")).To(BeEmpty())
+				res, _ := memDb.GetPayments(ctx, PaymentQuery{Size: 10})
+				Expect(*res).To(HaveLen(2))
+			})
+			It("should retry saving the response", func() {
+				failures := 2
+				c = context.WithValue(c, ContextDb, failingSaveDb{Db: memDb, failures: &failures})
+				Expect(post(paymentRequestJSON, "key-1").Code).To(Equal(http.StatusCreated))
+				Expect(post(paymentRequestJSON, "key-1").Header().Get("Idempotent-Replayed")).To(Equal("true"))
+			})
+			It("should not create a second payment when the response can not be saved", func() {
+				failures := 3
+				c = context.WithValue(c, ContextDb, failingSaveDb{Db: memDb, failures: &failures})
+				Expect(post(paymentRequestJSON, "key-1").Code).To(Equal(http.StatusCreated))
+				w := post(paymentRequestJSON, "key-1")
+				Expect(w.Code).To(Equal(http.StatusConflict))
+				res, _ := memDb.GetPayments(ctx, PaymentQuery{Size: 10})
+				Expect(*res).To(HaveLen(1))
+			})
+			It("should save the response when the request is cancelled", func() {
+				var cancel context.CancelFunc
+				c, cancel = context.WithCancel(c)
+				c = context.WithValue(c, ContextDb, cancellingCreateDb{Db: memDb, cancel: cancel})
+				w1 := post(paymentRequestJSON, "key-1")
+				Expect(w1.Code).To(Equal(http.StatusCreated))
+				c = context.WithValue(ctx, ContextDb, memDb)
+				w2 := post(paymentRequestJSON, "key-1")
+				Expect(w2.Header().Get("Idempotent-Replayed")).To(Equal("true"))
+				Expect(w2.Body.String()).To(Equal(w1.Body.String()))
+			})
+			It("should keep the key when the database is unavailable", func() {
+				c = context.WithValue(c, ContextDb, failingCreateDb{Db: memDb, err: ErrUnavailable})
+				Expect(post(paymentRequestJSON, "key-1").Code).To(Equal(http.StatusServiceUnavailable))
+				c = context.WithValue(c, ContextDb, memDb)
+				Expect(post(paymentRequestJSON, "key-1").Code).To(Equal(http.StatusConflict))
+			})
+			It("should release the key when the payment is rejected", func() {
+				c = context.WithValue(c, ContextDb, failingCreateDb{Db: memDb, err: ErrInvalid})
+				Expect(post(paymentRequestJSON, "key-1").Code).To(Equal(http.StatusBadRequest))
+				c = context.WithValue(c, ContextDb, memDb)
+				Expect(post(paymentRequestJSON, "key-1").Code).To(Equal(http.StatusCreated))
+			})
+			It("should return 400 on too long keys", func() {
+				w := post(paymentRequestJSON, strings.Repeat("k", 256))
+				Expect(w.Code).To(Equal(http.StatusBadRequest))
+			})
+		})
+
 	})
 })
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// NewServer constructs a server of the handler with the timeouts of the
+// configuration
+func NewServer(config *Config, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:         fmt.Sprintf(":%d", config.Port),
+		Handler:      handler,
+		ReadTimeout:  config.ReadTimeout,
+		WriteTimeout: config.WriteTimeout,
+		IdleTimeout:  config.IdleTimeout,
+	}
+}
+
+// RunServer serves the connections of the listener until the context is
+// done. The server then stops accepting connections and waits at most the
+// shutdown timeout for in-flight requests to complete.
+func RunServer(ctx context.Context, server *http.Server, listener net.Listener, shutdownTimeout time.Duration) error {
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.Serve(listener)
+	}()
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		// Close the connections of requests which did not complete in time
+		server.Close()
+		return err
+	}
+	return nil
+}
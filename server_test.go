@@ -0,0 +1,94 @@
+package main_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+
+	. "./"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Server", func() {
+	var listener net.Listener
+	var started chan bool
+	var release chan bool
+	var server *http.Server
+
+	BeforeEach(func() {
+		var err error
+		listener, err = net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).To(BeNil())
+		started = make(chan bool, 1)
+		release = make(chan bool)
+		server = NewServer(&testConfig, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			started <- true
+			<-release
+			_, _ = w.Write([]byte("done"))
+		}))
+	})
+
+	// run runs the server until the returned cancel is called
+	run := func(shutdownTimeout time.Duration) (context.CancelFunc, chan error) {
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error, 1)
+		go func() {
+			done <- RunServer(ctx, server, listener, shutdownTimeout)
+		}()
+		return cancel, done
+	}
+
+	get := func() chan string {
+		bodies := make(chan string, 1)
+		go func() {
+			defer GinkgoRecover()
+			res, err := http.Get("http://" + listener.Addr().String())
+			if err != nil {
+				bodies <- err.Error()
+				return
+			}
+			defer res.Body.Close()
+			body, _ := ioutil.ReadAll(res.Body)
+			bodies <- string(body)
+		}()
+		return bodies
+	}
+
+	It("should configure the timeouts", func() {
+		config := testConfig
+		config.Port = 8081
+		config.ReadTimeout = time.Second
+		config.WriteTimeout = 2 * time.Second
+		config.IdleTimeout = 3 * time.Second
+		s := NewServer(&config, nil)
+		Expect(s.Addr).To(Equal(":8081"))
+		Expect(s.ReadTimeout).To(Equal(time.Second))
+		Expect(s.WriteTimeout).To(Equal(2 * time.Second))
+		Expect(s.IdleTimeout).To(Equal(3 * time.Second))
+	})
+
+	It("should drain in-flight requests on shutdown", func() {
+		cancel, done := run(time.Minute)
+		bodies := get()
+		Eventually(started).Should(Receive())
+		cancel()
+		Consistently(done, 100*time.Millisecond).ShouldNot(Receive())
+		_, err := net.Dial("tcp", listener.Addr().String())
+		Expect(err).ToNot(BeNil())
+		close(release)
+		Eventually(bodies).Should(Receive(Equal("done")))
+		Eventually(done).Should(Receive(BeNil()))
+	})
+
+	It("should give up on requests exceeding the shutdown timeout", func() {
+		defer close(release)
+		cancel, done := run(50 * time.Millisecond)
+		get()
+		Eventually(started).Should(Receive())
+		cancel()
+		Eventually(done).Should(Receive(MatchError(context.DeadlineExceeded)))
+	})
+})
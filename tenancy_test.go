@@ -0,0 +1,73 @@
+package main_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	. "./"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Tenancy", func() {
+	other := "3e1f4f2b-1f3a-4a5e-9d4e-0c1d2e3f4a5b"
+	var memDb Db
+	var tenantCtx context.Context
+	var path string
+
+	BeforeEach(func() {
+		memDb = NewMemoryDb()
+		tenantCtx = context.WithValue(context.WithValue(testCtx, ContextDb, memDb),
+			ContextPrincipal, &Principal{ID: "tenant", OrganisationID: other})
+		id, _ := memDb.CreatePayment(testCtx, paymentSample.OrganisationID, paymentSample.Attributes)
+		path = fmt.Sprintf("/v1/payments/%s", IDToString(*id))
+	})
+
+	It("should return 404 on payments of other organisations", func() {
+		Expect(performRequest(tenantCtx, "GET", path).Code).To(Equal(http.StatusNotFound))
+		Expect(performRequest(tenantCtx, "GET", path+"/versions").Code).To(Equal(http.StatusNotFound))
+		w := performRequestBody(tenantCtx, "PUT", path, strings.NewReader(versionedPaymentRequestJSON(0)))
+		Expect(w.Code).To(Equal(http.StatusNotFound))
+		Expect(performRequest(tenantCtx, "DELETE", path).Code).To(Equal(http.StatusNotFound))
+		Expect(performRequest(tenantCtx, "POST", path+"/restore").Code).To(Equal(http.StatusNotFound))
+	})
+
+	It("should only list payments of the organisation", func() {
+		w := performRequest(tenantCtx, "GET", "/v1/payments/")
+		r, _ := ioutil.ReadAll(w.Body)
+		Expect(r).To(MatchJSON(`{"data": [], "links": {"self": "http://example.com/v1/payments/?count=10", "next": null}}`))
+	})
+
+	It("should reject payments of other organisations", func() {
+		w := performRequestBody(tenantCtx, "POST", "/v1/payments", strings.NewReader(paymentRequestJSON))
+		Expect(w.Code).To(Equal(http.StatusUnprocessableEntity))
+		r, _ := ioutil.ReadAll(w.Body)
+		Expect(r).To(MatchJSON(`{
+			"code": "validation_failed",
+			"message": "Unprocessable Entity",
+			"errors": [{"field": "organisation_id", "message": "must be the organisation of the caller"}]}`))
+	})
+
+	It("should scope subscriptions to the organisation", func() {
+		w := performRequestBody(tenantCtx, "POST", "/v1/subscriptions", strings.NewReader(
+			`{"url": "https://example.org/hook", "event_types": ["payment.created"]}`))
+		Expect(w.Code).To(Equal(http.StatusCreated))
+		subscriptions, _ := memDb.GetSubscriptions(testCtx)
+		Expect((*subscriptions)[0].OrganisationID).To(Equal(other))
+	})
+
+	It("should reject subscriptions of other organisations", func() {
+		w := performRequestBody(tenantCtx, "POST", "/v1/subscriptions", strings.NewReader(fmt.Sprintf(
+			`{"organisation_id": %q, "url": "https://example.org/hook", "event_types": ["payment.created"]}`,
+			paymentSample.OrganisationID)))
+		Expect(w.Code).To(Equal(http.StatusUnprocessableEntity))
+		r, _ := ioutil.ReadAll(w.Body)
+		Expect(r).To(MatchJSON(`{
+			"code": "validation_failed",
+			"message": "Unprocessable Entity",
+			"errors": [{"field": "organisation_id", "message": "must be the organisation of the caller"}]}`))
+	})
+})
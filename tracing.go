@@ -0,0 +1,409 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/middleware"
+)
+
+// Supported trace exporters
+const (
+	TraceExporterNone   = "none"
+	TraceExporterStdout = "stdout"
+)
+
+const traceparentHeader = "traceparent"
+
+// traceparentPattern matches W3C traceparent headers of version 00
+var traceparentPattern = regexp.MustCompile(`^00-([0-9a-f]{32})-([0-9a-f]{16})-[0-9a-f]{2}$`)
+
+// Span is a timed operation of a trace
+type Span struct {
+	TraceID      string            `json:"trace_id"`
+	SpanID       string            `json:"span_id"`
+	ParentSpanID string            `json:"parent_span_id,omitempty"`
+	Name         string            `json:"name"`
+	Start        time.Time         `json:"start"`
+	End          time.Time         `json:"end"`
+	Attributes   map[string]string `json:"attributes,omitempty"`
+	Error        string            `json:"error,omitempty"`
+	tracer       *Tracer
+}
+
+// SetAttribute annotates the span
+func (s *Span) SetAttribute(key string, value string) {
+	if s.Attributes == nil {
+		s.Attributes = map[string]string{}
+	}
+	s.Attributes[key] = value
+}
+
+// Finish ends the span, failed when the error is not nil, and exports it.
+// Finishing a nil span does nothing.
+func (s *Span) Finish(err error) {
+	if s == nil {
+		return
+	}
+	s.End = time.Now()
+	if err != nil {
+		s.Error = err.Error()
+	}
+	if s.tracer.Exporter == nil {
+		return
+	}
+	if err := s.tracer.Exporter.Export(*s); err != nil {
+		defaultLogger.Error("failed to export span", err)
+	}
+}
+
+// SpanExporter exports finished spans
+type SpanExporter interface {
+	Export(span Span) error
+}
+
+// MemoryExporter keeps exported spans in memory. It is safe for concurrent
+// use.
+type MemoryExporter struct {
+	mutex sync.Mutex
+	spans []Span
+}
+
+// NewMemoryExporter constructs a new empty in-memory exporter
+func NewMemoryExporter() *MemoryExporter {
+	return &MemoryExporter{}
+}
+
+// Export stores the span
+func (e *MemoryExporter) Export(span Span) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.spans = append(e.spans, span)
+	return nil
+}
+
+// Spans returns the spans exported so far
+func (e *MemoryExporter) Spans() []Span {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return append([]Span{}, e.spans...)
+}
+
+// writerExporter writes spans as lines of JSON
+type writerExporter struct {
+	mutex sync.Mutex
+	w     io.Writer
+}
+
+// NewWriterExporter constructs an exporter writing spans as lines of JSON to
+// the writer
+func NewWriterExporter(w io.Writer) SpanExporter {
+	return &writerExporter{w: w}
+}
+
+func (e *writerExporter) Export(span Span) error {
+	line, err := json.Marshal(span)
+	if err != nil {
+		return err
+	}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	_, err = e.w.Write(append(line, '\n'))
+	return err
+}
+
+// Tracer creates spans and exports them when finished. Spans are created
+// without exporter too, such that trace ids are available in logs and
+// errors.
+type Tracer struct {
+	Exporter SpanExporter
+}
+
+// NewTracer constructs a tracer with the exporter of the configuration
+func NewTracer(config *Config) (*Tracer, error) {
+	switch config.TraceExporter {
+	case TraceExporterNone:
+		return &Tracer{}, nil
+	case TraceExporterStdout:
+		return &Tracer{Exporter: NewWriterExporter(os.Stdout)}, nil
+	}
+	return nil, fmt.Errorf("unknown trace exporter %q", config.TraceExporter)
+}
+
+// newTraceID generates a random id of the given number of bytes
+func newTraceID(n int) string {
+	id := make([]byte, n)
+	_, _ = rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// Start starts a span, which is a child of the span of the context if any,
+// and returns the context of the span
+func (t *Tracer) Start(ctx context.Context, name string) (context.Context, *Span) {
+	span := &Span{SpanID: newTraceID(8), Name: name, Start: time.Now(), tracer: t}
+	if parent := contextSpan(ctx); parent != nil {
+		span.TraceID = parent.TraceID
+		span.ParentSpanID = parent.SpanID
+	} else {
+		span.TraceID = newTraceID(16)
+	}
+	return context.WithValue(ctx, ContextSpan, span), span
+}
+
+// Middleware starts a span per request, continuing the trace of a valid
+// traceparent header
+func (t *Tracer) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, span := t.Start(r.Context(), "HTTP "+r.Method)
+		if m := traceparentPattern.FindStringSubmatch(r.Header.Get(traceparentHeader)); m != nil &&
+			m[1] != "00000000000000000000000000000000" && m[2] != "0000000000000000" {
+			span.TraceID = m[1]
+			span.ParentSpanID = m[2]
+		}
+		span.SetAttribute("http.method", r.Method)
+		span.SetAttribute("http.target", r.URL.Path)
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		ww.Header().Set(traceparentHeader, fmt.Sprintf("00-%s-%s-01", span.TraceID, span.SpanID))
+		r = r.WithContext(ctx)
+		next.ServeHTTP(ww, r)
+		route := requestRoute(r)
+		status := responseStatus(ww)
+		span.Name = r.Method + " " + route
+		span.SetAttribute("http.route", route)
+		span.SetAttribute("http.status_code", strconv.Itoa(status))
+		var err error
+		if status >= http.StatusInternalServerError {
+			err = fmt.Errorf("%d %s", status, http.StatusText(status))
+		}
+		span.Finish(err)
+	})
+}
+
+// contextSpan returns the current span of the context, or nil
+func contextSpan(ctx context.Context) *Span {
+	span, _ := ctx.Value(ContextSpan).(*Span)
+	return span
+}
+
+// startChildSpan starts a child of the span of the context, or returns no
+// span when the context is not traced
+func startChildSpan(ctx context.Context, name string) (context.Context, *Span) {
+	parent := contextSpan(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+	return parent.tracer.Start(ctx, name)
+}
+
+// contextTraceID returns the trace id of the context, or an empty string
+func contextTraceID(ctx context.Context) string {
+	if span := contextSpan(ctx); span != nil {
+		return span.TraceID
+	}
+	return ""
+}
+
+// tracingDb creates child spans of the operations of a database. Operations
+// outside of a trace, e.g. of background workers, are not traced.
+type tracingDb struct {
+	db     Db
+	tracer *Tracer
+}
+
+// InstrumentDb decorates the database with spans of its operations
+func (t *Tracer) InstrumentDb(db Db) Db {
+	return &tracingDb{db: db, tracer: t}
+}
+
+// start starts the span of an operation when the context is traced
+func (d *tracingDb) start(ctx context.Context, operation string) (context.Context, *Span) {
+	if contextSpan(ctx) == nil {
+		return ctx, nil
+	}
+	return d.tracer.Start(ctx, "db."+operation)
+}
+
+func (d *tracingDb) GetPayments(ctx context.Context, query PaymentQuery) (*[]Payment, error) {
+	ctx, span := d.start(ctx, "GetPayments")
+	res, err := d.db.GetPayments(ctx, query)
+	span.Finish(err)
+	return res, err
+}
+
+func (d *tracingDb) GetPaymentByID(ctx context.Context, id ID, includeDeleted bool) (*Payment, error) {
+	ctx, span := d.start(ctx, "GetPaymentByID")
+	res, err := d.db.GetPaymentByID(ctx, id, includeDeleted)
+	span.Finish(err)
+	return res, err
+}
+
+func (d *tracingDb) CreatePayment(ctx context.Context, organizationID string, attributes PaymentAttributes) (*ID, error) {
+	ctx, span := d.start(ctx, "CreatePayment")
+	res, err := d.db.CreatePayment(ctx, organizationID, attributes)
+	span.Finish(err)
+	return res, err
+}
+
+func (d *tracingDb) UpdatePayment(ctx context.Context, ID ID, organizationID string, version int, attributes PaymentAttributes) error {
+	ctx, span := d.start(ctx, "UpdatePayment")
+	err := d.db.UpdatePayment(ctx, ID, organizationID, version, attributes)
+	span.Finish(err)
+	return err
+}
+
+func (d *tracingDb) UpdatePaymentStatus(ctx context.Context, ID ID, version int, status string) error {
+	ctx, span := d.start(ctx, "UpdatePaymentStatus")
+	err := d.db.UpdatePaymentStatus(ctx, ID, version, status)
+	span.Finish(err)
+	return err
+}
+
+func (d *tracingDb) DeletePayment(ctx context.Context, ID ID) error {
+	ctx, span := d.start(ctx, "DeletePayment")
+	err := d.db.DeletePayment(ctx, ID)
+	span.Finish(err)
+	return err
+}
+
+func (d *tracingDb) RestorePayment(ctx context.Context, ID ID) error {
+	ctx, span := d.start(ctx, "RestorePayment")
+	err := d.db.RestorePayment(ctx, ID)
+	span.Finish(err)
+	return err
+}
+
+func (d *tracingDb) GetPaymentVersions(ctx context.Context, ID ID) (*[]PaymentVersion, error) {
+	ctx, span := d.start(ctx, "GetPaymentVersions")
+	res, err := d.db.GetPaymentVersions(ctx, ID)
+	span.Finish(err)
+	return res, err
+}
+
+func (d *tracingDb) GetPaymentVersion(ctx context.Context, ID ID, version int) (*PaymentVersion, error) {
+	ctx, span := d.start(ctx, "GetPaymentVersion")
+	res, err := d.db.GetPaymentVersion(ctx, ID, version)
+	span.Finish(err)
+	return res, err
+}
+
+func (d *tracingDb) GetUnpublishedPaymentVersions(ctx context.Context, size int) (*[]PaymentVersion, error) {
+	ctx, span := d.start(ctx, "GetUnpublishedPaymentVersions")
+	res, err := d.db.GetUnpublishedPaymentVersions(ctx, size)
+	span.Finish(err)
+	return res, err
+}
+
+func (d *tracingDb) MarkPaymentVersionPublished(ctx context.Context, ID ID, version int) error {
+	ctx, span := d.start(ctx, "MarkPaymentVersionPublished")
+	err := d.db.MarkPaymentVersionPublished(ctx, ID, version)
+	span.Finish(err)
+	return err
+}
+
+func (d *tracingDb) ReserveIdempotencyKey(ctx context.Context, record IdempotencyRecord) (*IdempotencyRecord, error) {
+	ctx, span := d.start(ctx, "ReserveIdempotencyKey")
+	res, err := d.db.ReserveIdempotencyKey(ctx, record)
+	span.Finish(err)
+	return res, err
+}
+
+func (d *tracingDb) SaveIdempotencyKey(ctx context.Context, record IdempotencyRecord) error {
+	ctx, span := d.start(ctx, "SaveIdempotencyKey")
+	err := d.db.SaveIdempotencyKey(ctx, record)
+	span.Finish(err)
+	return err
+}
+
+func (d *tracingDb) ReleaseIdempotencyKey(ctx context.Context, key IdempotencyKey) error {
+	ctx, span := d.start(ctx, "ReleaseIdempotencyKey")
+	err := d.db.ReleaseIdempotencyKey(ctx, key)
+	span.Finish(err)
+	return err
+}
+
+func (d *tracingDb) CreateSubscription(ctx context.Context, organisationID string, url string, eventTypes []string, secret string) (*Subscription, error) {
+	ctx, span := d.start(ctx, "CreateSubscription")
+	res, err := d.db.CreateSubscription(ctx, organisationID, url, eventTypes, secret)
+	span.Finish(err)
+	return res, err
+}
+
+func (d *tracingDb) GetSubscriptions(ctx context.Context) (*[]Subscription, error) {
+	ctx, span := d.start(ctx, "GetSubscriptions")
+	res, err := d.db.GetSubscriptions(ctx)
+	span.Finish(err)
+	return res, err
+}
+
+func (d *tracingDb) GetSubscriptionByID(ctx context.Context, ID ID) (*Subscription, error) {
+	ctx, span := d.start(ctx, "GetSubscriptionByID")
+	res, err := d.db.GetSubscriptionByID(ctx, ID)
+	span.Finish(err)
+	return res, err
+}
+
+func (d *tracingDb) DeleteSubscription(ctx context.Context, ID ID) error {
+	ctx, span := d.start(ctx, "DeleteSubscription")
+	err := d.db.DeleteSubscription(ctx, ID)
+	span.Finish(err)
+	return err
+}
+
+func (d *tracingDb) CreateWebhookDelivery(ctx context.Context, delivery WebhookDelivery) error {
+	ctx, span := d.start(ctx, "CreateWebhookDelivery")
+	err := d.db.CreateWebhookDelivery(ctx, delivery)
+	span.Finish(err)
+	return err
+}
+
+func (d *tracingDb) GetDueWebhookDeliveries(ctx context.Context, before time.Time, size int) (*[]WebhookDelivery, error) {
+	ctx, span := d.start(ctx, "GetDueWebhookDeliveries")
+	res, err := d.db.GetDueWebhookDeliveries(ctx, before, size)
+	span.Finish(err)
+	return res, err
+}
+
+func (d *tracingDb) SaveWebhookDelivery(ctx context.Context, delivery WebhookDelivery) error {
+	ctx, span := d.start(ctx, "SaveWebhookDelivery")
+	err := d.db.SaveWebhookDelivery(ctx, delivery)
+	span.Finish(err)
+	return err
+}
+
+func (d *tracingDb) GetWebhookDeliveries(ctx context.Context, subscriptionID ID) (*[]WebhookDelivery, error) {
+	ctx, span := d.start(ctx, "GetWebhookDeliveries")
+	res, err := d.db.GetWebhookDeliveries(ctx, subscriptionID)
+	span.Finish(err)
+	return res, err
+}
+
+func (d *tracingDb) Connect(ctx context.Context) error {
+	ctx, span := d.start(ctx, "Connect")
+	err := d.db.Connect(ctx)
+	span.Finish(err)
+	return err
+}
+
+func (d *tracingDb) Ping(ctx context.Context) error {
+	ctx, span := d.start(ctx, "Ping")
+	err := d.db.Ping(ctx)
+	span.Finish(err)
+	return err
+}
+
+func (d *tracingDb) Close(ctx context.Context) error {
+	ctx, span := d.start(ctx, "Close")
+	err := d.db.Close(ctx)
+	span.Finish(err)
+	return err
+}
@@ -0,0 +1,132 @@
+package main_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	. "./"
+	"github.com/go-chi/chi"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Tracing", func() {
+	var exporter *MemoryExporter
+	var tracer *Tracer
+	var handler http.Handler
+
+	BeforeEach(func() {
+		exporter = NewMemoryExporter()
+		tracer = &Tracer{Exporter: exporter}
+		r := chi.NewRouter()
+		r.Use(tracer.Middleware)
+		r.Mount("/", RootRoute())
+		handler = r
+	})
+
+	request := func(db Db, method, path string, body string, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("content-type", "application/json")
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req.WithContext(context.WithValue(testCtx, ContextDb, tracer.InstrumentDb(db))))
+		return w
+	}
+	names := func(spans []Span) []string {
+		var res []string
+		for _, s := range spans {
+			res = append(res, s.Name)
+		}
+		return res
+	}
+
+	It("should create spans of requests, binding and database operations", func() {
+		w := request(mockDb{}, "POST", "/v1/payments", paymentRequestJSON, nil)
+		Expect(w.Code).To(Equal(http.StatusCreated))
+		spans := exporter.Spans()
+		Expect(names(spans)).To(Equal([]string{"bind", "db.CreatePayment", "POST /v1/payments/"}))
+		root := spans[2]
+		Expect(root.ParentSpanID).To(BeEmpty())
+		Expect(root.TraceID).To(HaveLen(32))
+		Expect(root.Attributes).To(HaveKeyWithValue("http.route", "/v1/payments/"))
+		Expect(root.Attributes).To(HaveKeyWithValue("http.status_code", "201"))
+		for _, child := range spans[:2] {
+			Expect(child.TraceID).To(Equal(root.TraceID))
+			Expect(child.ParentSpanID).To(Equal(root.SpanID))
+			Expect(child.End).ToNot(BeTemporally("<", child.Start))
+		}
+		Expect(w.Header().Get("traceparent")).To(Equal("00-" + root.TraceID + "-" + root.SpanID + "-01"))
+	})
+
+	It("should continue traces of traceparent headers", func() {
+		request(mockDb{}, "GET", "/v1/payments/", "", map[string]string{
+			"traceparent": "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"})
+		spans := exporter.Spans()
+		root := spans[len(spans)-1]
+		Expect(root.TraceID).To(Equal("4bf92f3577b34da6a3ce929d0e0e4736"))
+		Expect(root.ParentSpanID).To(Equal("00f067aa0ba902b7"))
+		Expect(spans[0].TraceID).To(Equal("4bf92f3577b34da6a3ce929d0e0e4736"))
+	})
+
+	It("should start new traces on invalid traceparent headers", func() {
+		for _, header := range []string{
+			"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+			"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+			"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		} {
+			request(mockDb{}, "GET", "/", "", map[string]string{"traceparent": header})
+			spans := exporter.Spans()
+			root := spans[len(spans)-1]
+			Expect(root.TraceID).ToNot(Equal("4bf92f3577b34da6a3ce929d0e0e4736"), header)
+			Expect(root.ParentSpanID).To(BeEmpty(), header)
+		}
+	})
+
+	It("should include the trace id in error responses", func() {
+		w := request(mockDb{error: errors.New("unavailable")}, "POST", "/v1/payments", paymentRequestJSON, nil)
+		Expect(w.Code).To(Equal(http.StatusInternalServerError))
+		var res struct {
+			TraceID string `json:"trace_id"`
+		}
+		body, _ := ioutil.ReadAll(w.Body)
+		Expect(json.Unmarshal(body, &res)).To(Succeed())
+		spans := exporter.Spans()
+		Expect(res.TraceID).To(Equal(spans[len(spans)-1].TraceID))
+		Expect(spans[1].Name).To(Equal("db.CreatePayment"))
+		Expect(spans[1].Error).To(Equal("unavailable"))
+		Expect(spans[len(spans)-1].Error).To(Equal("500 Internal Server Error"))
+	})
+
+	It("should not trace database operations outside of requests", func() {
+		db := tracer.InstrumentDb(NewMemoryDb())
+		_, err := db.GetPayments(testCtx, PaymentQuery{Size: 1})
+		Expect(err).To(BeNil())
+		Expect(exporter.Spans()).To(BeEmpty())
+	})
+
+	It("should write spans as lines of JSON", func() {
+		var buf bytes.Buffer
+		tracer.Exporter = NewWriterExporter(&buf)
+		request(mockDb{}, "GET", "/", "", nil)
+		var span struct {
+			TraceID string `json:"trace_id"`
+			Name    string `json:"name"`
+		}
+		Expect(json.Unmarshal(buf.Bytes(), &span)).To(Succeed())
+		Expect(span.Name).To(Equal("GET /"))
+		Expect(span.TraceID).To(HaveLen(32))
+	})
+
+	It("should construct tracers of the configuration", func() {
+		_, err := NewTracer(&Config{TraceExporter: "jaeger"})
+		Expect(err).To(MatchError(`unknown trace exporter "jaeger"`))
+	})
+})
@@ -11,6 +11,14 @@ func SafeStringToInt(s string, def int) int {
 	return v
 }
 
+// StringOrDefault returns `s` or `def` if `s` is empty
+func StringOrDefault(s string, def string) string {
+	if s == "" {
+		return def
+	}
+	return s
+}
+
 // IntMin returns the smallest integer
 func IntMin(i1 int, i2 int) int {
 	if i1 < i2 {
@@ -26,3 +34,13 @@ func IntMax(i1 int, i2 int) int {
 	}
 	return i2
 }
+
+// containsString returns whether the slice contains the string
+func containsString(slice []string, s string) bool {
+	for _, v := range slice {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
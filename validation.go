@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FieldError describes why a single field of a request is invalid
+type FieldError struct {
+	Field   string
+	Message string
+}
+
+// ValidationError is returned when a request contains one or more invalid
+// fields
+type ValidationError struct {
+	Errors []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	messages := make([]string, len(e.Errors))
+	for i, v := range e.Errors {
+		messages[i] = fmt.Sprintf("%s: %s", v.Field, v.Message)
+	}
+	return fmt.Sprintf("validation failed: %s", strings.Join(messages, ", "))
+}
+
+var (
+	decimalPattern = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?$`)
+	uuidPattern    = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+)
+
+// bankIDCodes are the supported bank identifier schemes
+var bankIDCodes = map[string]bool{
+	"GBDSC": true,
+	"SWBIC": true,
+	"USABA": true,
+	"DEBLZ": true,
+	"CACPA": true,
+	"AUBSB": true,
+}
+
+// accountNumberCodes are the supported account number schemes
+var accountNumberCodes = map[string]bool{
+	"BBAN": true,
+	"IBAN": true,
+}
+
+// currencyCodes are the active ISO 4217 currency codes
+var currencyCodes = map[string]bool{}
+
+func init() {
+	codes := "AED AFN ALL AMD ANG AOA ARS AUD AWG AZN BAM BBD BDT BGN BHD BIF BMD BND BOB BOV BRL BSD BTN " +
+		"BWP BYN BZD CAD CDF CHE CHF CHW CLF CLP CNY COP COU CRC CUC CUP CVE CZK DJF DKK DOP DZD EGP ERN " +
+		"ETB EUR FJD FKP GBP GEL GHS GIP GMD GNF GTQ GYD HKD HNL HRK HTG HUF IDR ILS INR IQD IRR ISK JMD " +
+		"JOD JPY KES KGS KHR KMF KPW KRW KWD KYD KZT LAK LBP LKR LRD LSL LYD MAD MDL MGA MKD MMK MNT MOP " +
+		"MRU MUR MVR MWK MXN MXV MYR MZN NAD NGN NIO NOK NPR NZD OMR PAB PEN PGK PHP PKR PLN PYG QAR RON " +
+		"RSD RUB RWF SAR SBD SCR SDG SEK SGD SHP SLL SOS SRD SSP STN SVC SYP SZL THB TJS TMT TND TOP TRY " +
+		"TTD TWD TZS UAH UGX USD USN UYI UYU UYW UZS VES VND VUV WST XAF XCD XOF XPF YER ZAR ZMW ZWL"
+	for _, c := range strings.Fields(codes) {
+		currencyCodes[c] = true
+	}
+}
+
+// validator collects field errors
+type validator struct {
+	errors []FieldError
+}
+
+func (v *validator) add(field, message string) {
+	v.errors = append(v.errors, FieldError{Field: field, Message: message})
+}
+
+func (v *validator) required(field, value string) bool {
+	if value == "" {
+		v.add(field, "is required")
+		return false
+	}
+	return true
+}
+
+func (v *validator) decimal(field, value string) {
+	if !decimalPattern.MatchString(value) {
+		v.add(field, "must be a decimal number")
+	}
+}
+
+func (v *validator) positiveDecimal(field, value string) {
+	if !decimalPattern.MatchString(value) || strings.Trim(value, "0.") == "" {
+		v.add(field, "must be a positive decimal number")
+	}
+}
+
+func (v *validator) currency(field, value string) {
+	if !currencyCodes[value] {
+		v.add(field, "must be an ISO 4217 currency code")
+	}
+}
+
+func (v *validator) date(field, value string) {
+	if _, err := time.Parse("2006-01-02", value); err != nil {
+		v.add(field, "must be a date formatted as YYYY-MM-DD")
+	}
+}
+
+func (v *validator) uuid(field, value string) {
+	if !uuidPattern.MatchString(value) {
+		v.add(field, "must be a UUID")
+	}
+}
+
+func (v *validator) oneOf(field, value string, allowed map[string]bool) {
+	if !allowed[value] {
+		v.add(field, "is not a supported code")
+	}
+}
+
+func (v *validator) err() error {
+	if len(v.errors) == 0 {
+		return nil
+	}
+	return &ValidationError{Errors: v.errors}
+}
+
+func (v *validator) party(field string, party paymentPartyRest) {
+	if v.required(field+".account_number", party.AccountNumber) && v.required(field+".account_number_code", party.AccountNumberCode) {
+		v.oneOf(field+".account_number_code", party.AccountNumberCode, accountNumberCodes)
+	}
+	if v.required(field+".bank_id", party.BankID) && v.required(field+".bank_id_code", party.BankIDCode) {
+		v.oneOf(field+".bank_id_code", party.BankIDCode, bankIDCodes)
+	}
+}
+
+func (v *validator) chargesInformation(field string, info paymentChargesInformationRest) {
+	for i, c := range info.SenderCharges {
+		f := fmt.Sprintf("%s.sender_charges[%d]", field, i)
+		v.decimal(f+".amount", c.Amount)
+		v.currency(f+".currency", c.Currency)
+	}
+	if info.ReceiverChargesAmount != "" || info.ReceiverChargesCurrency != "" {
+		v.decimal(field+".receiver_charges_amount", info.ReceiverChargesAmount)
+		v.currency(field+".receiver_charges_currency", info.ReceiverChargesCurrency)
+	}
+}
+
+func (v *validator) fx(field string, fx paymentFxRest, currency string) {
+	if fx == (paymentFxRest{}) {
+		return
+	}
+	v.positiveDecimal(field+".exchange_rate", fx.ExchangeRate)
+	v.positiveDecimal(field+".original_amount", fx.OriginalAmount)
+	if !currencyCodes[fx.OriginalCurrency] {
+		v.currency(field+".original_currency", fx.OriginalCurrency)
+	} else if fx.OriginalCurrency == currency {
+		v.add(field+".original_currency", "must differ from the payment currency")
+	}
+}
+
+// validatePaymentRequest validates a payment of the organisation the caller
+// is restricted to, which is empty for callers of any organisation
+func validatePaymentRequest(data *paymentRequest, organisationID string) error {
+	v := validator{}
+	if v.required("organisation_id", data.OrganisationID) {
+		v.uuid("organisation_id", data.OrganisationID)
+		if organisationID != "" && data.OrganisationID != organisationID {
+			v.add("organisation_id", "must be the organisation of the caller")
+		}
+	}
+	if data.Version != nil && *data.Version < 0 {
+		v.add("version", "must not be negative")
+	}
+	a := data.Attributes
+	if v.required("attributes.amount", a.Amount) {
+		v.positiveDecimal("attributes.amount", a.Amount)
+	}
+	if v.required("attributes.currency", a.Currency) {
+		v.currency("attributes.currency", a.Currency)
+	}
+	if v.required("attributes.processing_date", a.ProcessingDate) {
+		v.date("attributes.processing_date", a.ProcessingDate)
+	}
+	v.party("attributes.beneficiary_party", a.BeneficiaryParty)
+	v.party("attributes.debtor_party", a.DebtorParty)
+	if a.SponsorParty.BankIDCode != "" {
+		v.oneOf("attributes.sponsor_party.bank_id_code", a.SponsorParty.BankIDCode, bankIDCodes)
+	}
+	v.chargesInformation("attributes.charges_information", a.ChargesInformation)
+	v.fx("attributes.fx", a.Fx, a.Currency)
+	return v.err()
+}
+
+func validatePaymentStatusRequest(data *paymentStatusRequest) error {
+	v := validator{}
+	if v.required("status", data.Status) && !IsPaymentStatus(data.Status) {
+		v.add("status", "is not a payment status")
+	}
+	if data.Version != nil && *data.Version < 0 {
+		v.add("version", "must not be negative")
+	}
+	return v.err()
+}
+
+// validateSubscriptionRequest validates a subscription of the organisation
+// the caller is restricted to, which is empty for callers of any organisation.
+// Such callers may subscribe to the events of all organisations by leaving the
+// organisation of the subscription empty.
+func validateSubscriptionRequest(ctx context.Context, data *subscriptionRequest, organisationID string) error {
+	v := validator{}
+	if v.required("url", data.URL) {
+		u, err := url.Parse(data.URL)
+		if err != nil || checkWebhookURL(u) != nil || u.Host == "" {
+			v.add("url", "must be an absolute https URL")
+		} else if checkWebhookHost(ctx, u.Hostname()) != nil {
+			v.add("url", "must not target a loopback, private or link-local address")
+		}
+	}
+	if data.OrganisationID == "" {
+		data.OrganisationID = organisationID
+	}
+	if data.OrganisationID != "" {
+		v.uuid("organisation_id", data.OrganisationID)
+		if organisationID != "" && data.OrganisationID != organisationID {
+			v.add("organisation_id", "must be the organisation of the caller")
+		}
+	}
+	if len(data.EventTypes) == 0 {
+		v.add("event_types", "is required")
+	}
+	for i, t := range data.EventTypes {
+		if !webhookEventTypes[t] {
+			v.add(fmt.Sprintf("event_types[%d]", i), "is not an event type")
+		}
+	}
+	return v.err()
+}
+
+var paymentSorts = map[string]bool{
+	"":                        true,
+	PaymentSortID:             true,
+	PaymentSortProcessingDate: true,
+	PaymentSortAmount:         true,
+}
+
+// paymentTopLevelFields are the fields besides attributes which can be
+// selected when listing payments
+var paymentTopLevelFields = map[string]bool{
+	PaymentFieldOrganisationID: true,
+	PaymentFieldVersion:        true,
+	PaymentFieldStatus:         true,
+	PaymentFieldDeletedAt:      true,
+	PaymentFieldDeletedBy:      true,
+}
+
+// paymentListFields are the fields which can be selected when listing
+// payments
+var paymentListFields = func() map[string]bool {
+	fields := map[string]bool{}
+	for name := range paymentTopLevelFields {
+		fields[name] = true
+	}
+	for _, name := range jsonFieldNames(paymentAttributesRest{}) {
+		fields[name] = true
+	}
+	return fields
+}()
+
+// paymentParams validates the query parameters of a single payment
+func (v *validator) paymentParams(values url.Values) {
+	if value := values.Get("include_deleted"); value != "" {
+		if _, err := strconv.ParseBool(value); err != nil {
+			v.add("include_deleted", "must be true or false")
+		}
+	}
+}
+
+func validatePaymentParams(values url.Values) error {
+	v := validator{}
+	v.paymentParams(values)
+	return v.err()
+}
+
+func validatePaymentListParams(values url.Values) error {
+	v := validator{}
+	v.paymentParams(values)
+	date := func(name string) {
+		if value := values.Get(name); value != "" {
+			v.date(name, value)
+		}
+	}
+	decimal := func(name string) {
+		if value := values.Get(name); value != "" {
+			v.decimal(name, value)
+		}
+	}
+	if status := values.Get("status"); status != "" && !IsPaymentStatus(status) {
+		v.add("status", "is not a payment status")
+	}
+	date("processing_date_from")
+	date("processing_date_to")
+	decimal("amount_min")
+	decimal("amount_max")
+	if !paymentSorts[strings.TrimPrefix(values.Get("sort"), "-")] {
+		v.add("sort", "must be one of id, processing_date or amount optionally prefixed with -")
+	}
+	if fields := values.Get("fields"); fields != "" {
+		for _, f := range strings.Split(fields, ",") {
+			if !paymentListFields[f] {
+				v.add("fields", fmt.Sprintf("%q is not a payment field", f))
+			}
+		}
+	}
+	if expand := values.Get("expand"); expand != "" && expand != "attributes" {
+		v.add("expand", "must be attributes")
+	}
+	return v.err()
+}
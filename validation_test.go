@@ -0,0 +1,70 @@
+package main_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	. "./"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Validation", func() {
+	var db Db = mockDb{}
+	ctx := context.WithValue(testCtx, ContextDb, db)
+
+	// modifiedPaymentRequest returns the sample payment request with the
+	// value at the given path replaced.
+	modifiedPaymentRequest := func(path string, value interface{}) string {
+		var req map[string]interface{}
+		_ = json.Unmarshal([]byte(paymentRequestJSON), &req)
+		keys := strings.Split(path, ".")
+		m := req
+		for _, k := range keys[:len(keys)-1] {
+			m = m[k].(map[string]interface{})
+		}
+		m[keys[len(keys)-1]] = value
+		res, _ := json.Marshal(req)
+		return string(res)
+	}
+
+	DescribeTable("should reject invalid payments",
+		func(path string, value interface{}, message string) {
+			w := performRequestBody(ctx, "POST", "/v1/payments", strings.NewReader(modifiedPaymentRequest(path, value)))
+			Expect(w.Code).To(Equal(http.StatusUnprocessableEntity))
+			var res struct {
+				Errors []struct {
+					Field   string `json:"field"`
+					Message string `json:"message"`
+				} `json:"errors"`
+			}
+			_ = json.NewDecoder(w.Body).Decode(&res)
+			Expect(res.Errors).To(HaveLen(1))
+			Expect(res.Errors[0].Field).To(Equal(path))
+			Expect(res.Errors[0].Message).To(Equal(message))
+		},
+		Entry("non-uuid organisation", "organisation_id", "org", "must be a UUID"),
+		Entry("negative version", "version", -1, "must not be negative"),
+		Entry("zero amount", "attributes.amount", "0.00", "must be a positive decimal number"),
+		Entry("negative amount", "attributes.amount", "-1.00", "must be a positive decimal number"),
+		Entry("non-decimal amount", "attributes.amount", "1e10", "must be a positive decimal number"),
+		Entry("unknown currency", "attributes.currency", "XXX", "must be an ISO 4217 currency code"),
+		Entry("lowercase currency", "attributes.currency", "gbp", "must be an ISO 4217 currency code"),
+		Entry("invalid processing date", "attributes.processing_date", "2017-02-30", "must be a date formatted as YYYY-MM-DD"),
+		Entry("unknown bank id code", "attributes.debtor_party.bank_id_code", "FOO", "is not a supported code"),
+		Entry("unknown account number code", "attributes.beneficiary_party.account_number_code", "FOO", "is not a supported code"),
+		Entry("unknown sponsor bank id code", "attributes.sponsor_party.bank_id_code", "FOO", "is not a supported code"),
+		Entry("invalid exchange rate", "attributes.fx.exchange_rate", "0", "must be a positive decimal number"),
+		Entry("unknown original currency", "attributes.fx.original_currency", "FOO", "must be an ISO 4217 currency code"),
+		Entry("original currency same as currency", "attributes.fx.original_currency", "GBP", "must differ from the payment currency"),
+		Entry("invalid receiver charges", "attributes.charges_information.receiver_charges_amount", "one", "must be a decimal number"),
+	)
+
+	It("should accept payments without fx", func() {
+		w := performRequestBody(ctx, "POST", "/v1/payments", strings.NewReader(modifiedPaymentRequest("attributes.fx", map[string]string{})))
+		Expect(w.Code).To(Equal(http.StatusCreated))
+	})
+})
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+const (
+	webhookIDHeader        = "Webhook-Id"
+	webhookTimestampHeader = "Webhook-Timestamp"
+	webhookSignatureHeader = "Webhook-Signature"
+)
+
+// webhookEventTypes are the event types subscriptions can receive
+var webhookEventTypes = map[string]bool{
+	webhookEventType(PaymentEventCreated):       true,
+	webhookEventType(PaymentEventUpdated):       true,
+	webhookEventType(PaymentEventStatusChanged): true,
+	webhookEventType(PaymentEventDeleted):       true,
+	webhookEventType(PaymentEventRestored):      true,
+}
+
+// webhookEventType returns the event type of a payment event
+func webhookEventType(event string) string {
+	return "payment." + event
+}
+
+// webhookBlockedNetworks are the loopback, private, link-local, multicast and
+// reserved networks webhooks are not sent to, such that subscribers can not
+// reach services of the internal network
+var webhookBlockedNetworks = func() []*net.IPNet {
+	var networks []*net.IPNet
+	for _, cidr := range []string{
+		"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16", "172.16.0.0/12",
+		"192.0.0.0/24", "192.168.0.0/16", "198.18.0.0/15", "224.0.0.0/4", "240.0.0.0/4",
+		"::/128", "::1/128", "64:ff9b::/96", "fc00::/7", "fe80::/10", "ff00::/8",
+	} {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}()
+
+var errWebhookTargetBlocked = errors.New("webhook target is in a blocked network")
+
+// checkWebhookIP returns an error if webhooks must not be sent to the IP
+func checkWebhookIP(ip net.IP) error {
+	for _, network := range webhookBlockedNetworks {
+		if network.Contains(ip) {
+			return errWebhookTargetBlocked
+		}
+	}
+	return nil
+}
+
+// checkWebhookHost returns an error if the host resolves to an IP webhooks
+// must not be sent to. Hosts which can not be resolved are only rejected
+// when notifications are sent.
+func checkWebhookHost(ctx context.Context, host string) error {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil
+	}
+	for _, addr := range addrs {
+		if err = checkWebhookIP(addr.IP); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkWebhookURL returns an error if notifications must not be sent to the
+// URL
+func checkWebhookURL(u *url.URL) error {
+	if u.Scheme != "https" {
+		return fmt.Errorf("webhook URL scheme %q is not https", u.Scheme)
+	}
+	return nil
+}
+
+// newWebhookClient constructs a client which only connects to IPs outside of
+// the blocked networks. The IP is checked after resolving the host, such that
+// hosts resolving to other IPs later and redirects are blocked too.
+func newWebhookClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil {
+				return fmt.Errorf("invalid webhook address %s", address)
+			}
+			return checkWebhookIP(ip)
+		},
+	}
+	return &http.Client{
+		Timeout: timeout,
+		// Proxies are not used, as they would connect to blocked IPs
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: timeout,
+			MaxIdleConnsPerHost: 10,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+			return checkWebhookURL(req.URL)
+		},
+	}
+}
+
+// newWebhookSecret generates the secret of a new subscription
+func newWebhookSecret() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(secret), nil
+}
+
+// SignWebhook computes the Webhook-Signature header of a notification sent
+// at the Unix timestamp. Receivers verify notifications by computing the
+// signature with the secret of their subscription.
+func SignWebhook(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	_, _ = fmt.Fprintf(mac, "%d.", timestamp)
+	_, _ = mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookPublisher publishes events by creating deliveries for the matching
+// subscriptions. Deliveries are sent by a WebhookWorker.
+type webhookPublisher struct {
+	config *Config
+	db     Db
+}
+
+// NewWebhookPublisher constructs a publisher notifying the subscriptions of
+// the db
+func NewWebhookPublisher(config *Config, db Db) Publisher {
+	return &webhookPublisher{config: config, db: db}
+}
+
+func (p *webhookPublisher) Publish(ctx context.Context, event PaymentVersion) error {
+	subscriptions, err := p.db.GetSubscriptions(ctx)
+	if err != nil {
+		return err
+	}
+	eventType := webhookEventType(event.Event)
+	payload, err := json.Marshal(webhookEventToRest(p.config, eventType, event))
+	if err != nil {
+		return err
+	}
+	for _, s := range *subscriptions {
+		if !containsString(s.EventTypes, eventType) {
+			continue
+		}
+		if s.OrganisationID != "" && s.OrganisationID != event.Payment.OrganisationID {
+			continue
+		}
+		err = p.db.CreateWebhookDelivery(ctx, WebhookDelivery{
+			SubscriptionID: s.ID,
+			PaymentID:      event.Payment.ID,
+			Version:        event.Version,
+			EventType:      eventType,
+			Payload:        payload,
+			Status:         WebhookDeliveryPending,
+			NextAttemptAt:  event.Timestamp,
+			CreatedAt:      now(),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WebhookWorker sends pending deliveries. Failed deliveries are retried with
+// exponential backoff until the maximum number of attempts is reached.
+type WebhookWorker struct {
+	Db          Db
+	Client      *http.Client
+	Interval    time.Duration
+	MaxAttempts int
+	Backoff     time.Duration
+	BatchSize   int
+}
+
+// NewWebhookWorker constructs a worker sending the deliveries of the db
+func NewWebhookWorker(config *Config, db Db) *WebhookWorker {
+	return &WebhookWorker{
+		Db:          db,
+		Client:      newWebhookClient(config.WebhookTimeout),
+		Interval:    config.EventDispatchInterval,
+		MaxAttempts: config.WebhookMaxAttempts,
+		Backoff:     config.WebhookBackoff,
+		BatchSize:   100,
+	}
+}
+
+// Deliver attempts all due deliveries once and returns how many were
+// attempted
+func (w *WebhookWorker) Deliver(ctx context.Context) (int, error) {
+	deliveries, err := w.Db.GetDueWebhookDeliveries(ctx, now(), w.BatchSize)
+	if err != nil {
+		return 0, err
+	}
+	for i, d := range *deliveries {
+		subscription, err := w.Db.GetSubscriptionByID(ctx, d.SubscriptionID)
+		if ErrorKind(err) == ErrNotFound {
+			// Deleted after the delivery was fetched
+			continue
+		}
+		if err != nil {
+			return i, err
+		}
+		if err = w.Db.SaveWebhookDelivery(ctx, w.attempt(ctx, *subscription, d)); err != nil {
+			return i, err
+		}
+	}
+	return len(*deliveries), nil
+}
+
+// attempt sends the delivery and returns it with the attempt recorded
+func (w *WebhookWorker) attempt(ctx context.Context, subscription Subscription, delivery WebhookDelivery) WebhookDelivery {
+	attempt := WebhookAttempt{Timestamp: now()}
+	req, err := http.NewRequest(http.MethodPost, subscription.URL, bytes.NewReader(delivery.Payload))
+	if err == nil {
+		err = checkWebhookURL(req.URL)
+	}
+	if err == nil {
+		timestamp := attempt.Timestamp.Unix()
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(webhookIDHeader, IDToString(delivery.ID))
+		req.Header.Set(webhookTimestampHeader, strconv.FormatInt(timestamp, 10))
+		req.Header.Set(webhookSignatureHeader, SignWebhook(subscription.Secret, timestamp, delivery.Payload))
+		var res *http.Response
+		res, err = w.Client.Do(req.WithContext(ctx))
+		if err == nil {
+			attempt.StatusCode = res.StatusCode
+			_, _ = io.Copy(ioutil.Discard, res.Body)
+			res.Body.Close()
+			if res.StatusCode < 200 || res.StatusCode > 299 {
+				err = fmt.Errorf("unexpected status %d", res.StatusCode)
+			}
+		}
+	}
+	if err != nil {
+		attempt.Error = err.Error()
+	}
+	delivery.Attempts = append(delivery.Attempts, attempt)
+	switch {
+	case err == nil:
+		delivery.Status = WebhookDeliverySucceeded
+	case len(delivery.Attempts) >= w.MaxAttempts:
+		delivery.Status = WebhookDeliveryFailed
+	default:
+		delivery.NextAttemptAt = attempt.Timestamp.Add(w.Backoff << uint(len(delivery.Attempts)-1))
+	}
+	return delivery
+}
+
+// Run delivers due deliveries every interval until the context is done
+func (w *WebhookWorker) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.Interval)
+	defer ticker.Stop()
+	for {
+		if _, err := w.Deliver(ctx); err != nil {
+			contextLogger(ctx).Error("failed to deliver webhooks", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package main_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"time"
+
+	. "./"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// webhookReceiver records notifications and responds with the queued status
+// codes, then with 200
+type webhookReceiver struct {
+	mutex    sync.Mutex
+	requests []*http.Request
+	bodies   [][]byte
+	statuses []int
+}
+
+func (rec *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rec.mutex.Lock()
+	defer rec.mutex.Unlock()
+	body, _ := ioutil.ReadAll(r.Body)
+	rec.requests = append(rec.requests, r)
+	rec.bodies = append(rec.bodies, body)
+	status := http.StatusOK
+	if len(rec.statuses) > 0 {
+		status, rec.statuses = rec.statuses[0], rec.statuses[1:]
+	}
+	w.WriteHeader(status)
+}
+
+var _ = Describe("Webhooks", func() {
+	var memDb Db
+	var receiver *webhookReceiver
+	var server *httptest.Server
+	var subscription *Subscription
+	var dispatcher *Dispatcher
+	var worker *WebhookWorker
+
+	BeforeEach(func() {
+		memDb = NewMemoryDb()
+		receiver = &webhookReceiver{}
+		server = httptest.NewTLSServer(receiver)
+		subscription, _ = memDb.CreateSubscription(testCtx, paymentSample.OrganisationID, server.URL,
+			[]string{"payment.created", "payment.updated"}, "secret")
+		dispatcher = NewDispatcher(&testConfig, memDb, NewWebhookPublisher(&testConfig, memDb))
+		worker = NewWebhookWorker(&testConfig, memDb)
+		// The receiver listens on the loopback interface, which the client of
+		// the worker does not connect to
+		worker.Client = server.Client()
+		worker.MaxAttempts = 3
+		worker.Backoff = time.Minute
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	deliveries := func() []WebhookDelivery {
+		res, err := memDb.GetWebhookDeliveries(testCtx, subscription.ID)
+		Expect(err).To(BeNil())
+		return *res
+	}
+
+	// makeDue moves the next attempt of every delivery to the past
+	makeDue := func() {
+		for _, d := range deliveries() {
+			d.NextAttemptAt = time.Now().Add(-time.Second)
+			Expect(memDb.SaveWebhookDelivery(testCtx, d)).To(Succeed())
+		}
+	}
+
+	It("should deliver signed notifications", func() {
+		id, _ := memDb.CreatePayment(testCtx, paymentSample.OrganisationID, paymentSample.Attributes)
+		_, err := dispatcher.Dispatch(testCtx)
+		Expect(err).To(BeNil())
+		n, err := worker.Deliver(testCtx)
+		Expect(err).To(BeNil())
+		Expect(n).To(Equal(1))
+		Expect(receiver.requests).To(HaveLen(1))
+		r := receiver.requests[0]
+		timestamp, err := strconv.ParseInt(r.Header.Get("Webhook-Timestamp"), 10, 64)
+		Expect(err).To(BeNil())
+		Expect(r.Header.Get("Webhook-Signature")).To(Equal(SignWebhook("secret", timestamp, receiver.bodies[0])))
+		Expect(r.Header.Get("Content-Type")).To(Equal("application/json"))
+		var event struct {
+			ID   string `json:"id"`
+			Type string `json:"type"`
+			Data struct {
+				Payment struct {
+					ID string `json:"id"`
+				} `json:"payment"`
+			} `json:"data"`
+		}
+		Expect(json.Unmarshal(receiver.bodies[0], &event)).To(Succeed())
+		Expect(event.ID).To(Equal(IDToString(*id) + "-0"))
+		Expect(event.Type).To(Equal("payment.created"))
+		Expect(event.Data.Payment.ID).To(Equal(IDToString(*id)))
+		log := deliveries()
+		Expect(log).To(HaveLen(1))
+		Expect(log[0].Status).To(Equal(WebhookDeliverySucceeded))
+		Expect(log[0].Attempts).To(HaveLen(1))
+		Expect(log[0].Attempts[0].StatusCode).To(Equal(http.StatusOK))
+	})
+
+	It("should only deliver subscribed event types", func() {
+		id, _ := memDb.CreatePayment(testCtx, paymentSample.OrganisationID, paymentSample.Attributes)
+		Expect(memDb.DeletePayment(testCtx, *id)).To(Succeed())
+		_, _ = dispatcher.Dispatch(testCtx)
+		_, _ = worker.Deliver(testCtx)
+		Expect(receiver.requests).To(HaveLen(1))
+		Expect(deliveries()[0].EventType).To(Equal("payment.created"))
+	})
+
+	It("should retry with exponential backoff", func() {
+		receiver.statuses = []int{http.StatusInternalServerError, http.StatusServiceUnavailable}
+		_, _ = memDb.CreatePayment(testCtx, paymentSample.OrganisationID, paymentSample.Attributes)
+		_, _ = dispatcher.Dispatch(testCtx)
+		_, _ = worker.Deliver(testCtx)
+		d := deliveries()[0]
+		Expect(d.Status).To(Equal(WebhookDeliveryPending))
+		Expect(d.Attempts[0].StatusCode).To(Equal(http.StatusInternalServerError))
+		Expect(d.Attempts[0].Error).To(Equal("unexpected status 500"))
+		Expect(d.NextAttemptAt).To(BeTemporally("~", time.Now().Add(time.Minute), time.Second))
+		n, _ := worker.Deliver(testCtx)
+		Expect(n).To(Equal(0))
+		makeDue()
+		_, _ = worker.Deliver(testCtx)
+		d = deliveries()[0]
+		Expect(d.Attempts).To(HaveLen(2))
+		Expect(d.NextAttemptAt).To(BeTemporally("~", time.Now().Add(2*time.Minute), time.Second))
+		makeDue()
+		_, _ = worker.Deliver(testCtx)
+		d = deliveries()[0]
+		Expect(d.Status).To(Equal(WebhookDeliverySucceeded))
+		Expect(receiver.requests).To(HaveLen(3))
+	})
+
+	It("should fail deliveries after the maximum number of attempts", func() {
+		server.Close()
+		_, _ = memDb.CreatePayment(testCtx, paymentSample.OrganisationID, paymentSample.Attributes)
+		_, _ = dispatcher.Dispatch(testCtx)
+		for i := 0; i < 3; i++ {
+			makeDue()
+			_, _ = worker.Deliver(testCtx)
+		}
+		d := deliveries()[0]
+		Expect(d.Status).To(Equal(WebhookDeliveryFailed))
+		Expect(d.Attempts).To(HaveLen(3))
+		Expect(d.Attempts[2].StatusCode).To(Equal(0))
+		Expect(d.Attempts[2].Error).ToNot(BeEmpty())
+		makeDue()
+		n, _ := worker.Deliver(testCtx)
+		Expect(n).To(Equal(0))
+	})
+
+	It("should deliver events published again once", func() {
+		_, _ = memDb.CreatePayment(testCtx, paymentSample.OrganisationID, paymentSample.Attributes)
+		versions, _ := memDb.GetUnpublishedPaymentVersions(testCtx, 10)
+		publisher := NewWebhookPublisher(&testConfig, memDb)
+		Expect(publisher.Publish(testCtx, (*versions)[0])).To(Succeed())
+		Expect(publisher.Publish(testCtx, (*versions)[0])).To(Succeed())
+		Expect(deliveries()).To(HaveLen(1))
+	})
+
+	It("should only deliver events of the organisation of a subscription", func() {
+		other, _ := memDb.CreateSubscription(testCtx, paymentSample.OrganisationID, server.URL,
+			[]string{"payment.created"}, "secret")
+		_, _ = memDb.CreateSubscription(testCtx, "3e1f4f2b-1f3a-4a5e-9d4e-0c1d2e3f4a5b", server.URL,
+			[]string{"payment.created"}, "secret")
+		_, _ = memDb.CreatePayment(testCtx, paymentSample.OrganisationID, paymentSample.Attributes)
+		_, _ = dispatcher.Dispatch(testCtx)
+		n, _ := worker.Deliver(testCtx)
+		Expect(n).To(Equal(2))
+		log, _ := memDb.GetWebhookDeliveries(testCtx, other.ID)
+		Expect(*log).To(HaveLen(1))
+	})
+
+	It("should deliver events of all organisations to subscriptions of no organisation", func() {
+		all, _ := memDb.CreateSubscription(testCtx, "", server.URL, []string{"payment.created"}, "secret")
+		_, _ = memDb.CreatePayment(testCtx, paymentSample.OrganisationID, paymentSample.Attributes)
+		_, _ = memDb.CreatePayment(testCtx, "3e1f4f2b-1f3a-4a5e-9d4e-0c1d2e3f4a5b", paymentSample.Attributes)
+		_, _ = dispatcher.Dispatch(testCtx)
+		log, _ := memDb.GetWebhookDeliveries(testCtx, all.ID)
+		Expect(*log).To(HaveLen(2))
+		Expect(deliveries()).To(HaveLen(1))
+	})
+
+	It("should not connect to loopback, private or link-local addresses", func() {
+		_, _ = memDb.CreatePayment(testCtx, paymentSample.OrganisationID, paymentSample.Attributes)
+		_, _ = dispatcher.Dispatch(testCtx)
+		n, err := NewWebhookWorker(&testConfig, memDb).Deliver(testCtx)
+		Expect(err).To(BeNil())
+		Expect(n).To(Equal(1))
+		Expect(receiver.requests).To(BeEmpty())
+		Expect(deliveries()[0].Attempts[0].Error).To(ContainSubstring("blocked network"))
+	})
+
+	It("should only send notifications to https URLs", func() {
+		Expect(memDb.DeleteSubscription(testCtx, subscription.ID)).To(Succeed())
+		subscription, _ = memDb.CreateSubscription(testCtx, paymentSample.OrganisationID,
+			"http://"+server.Listener.Addr().String(), []string{"payment.created"}, "secret")
+		_, _ = memDb.CreatePayment(testCtx, paymentSample.OrganisationID, paymentSample.Attributes)
+		_, _ = dispatcher.Dispatch(testCtx)
+		_, _ = worker.Deliver(testCtx)
+		Expect(receiver.requests).To(BeEmpty())
+		Expect(deliveries()[0].Attempts[0].Error).To(ContainSubstring("not https"))
+	})
+
+	It("should not deliver to deleted subscriptions", func() {
+		_, _ = memDb.CreatePayment(testCtx, paymentSample.OrganisationID, paymentSample.Attributes)
+		_, _ = dispatcher.Dispatch(testCtx)
+		Expect(memDb.DeleteSubscription(testCtx, subscription.ID)).To(Succeed())
+		n, _ := worker.Deliver(testCtx)
+		Expect(n).To(Equal(0))
+		Expect(receiver.requests).To(BeEmpty())
+	})
+})